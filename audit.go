@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server/internal/store"
+	"strconv"
+	"time"
+)
+
+func recordAudit(e store.AuditEntry) {
+	e.Time = time.Now()
+	if err := stationStore.AppendAudit(e); err != nil {
+		slog.Warn("failed to write audit entry", "station_id", e.StationID, "cmd", e.Command, "error", err)
+	}
+}
+
+func handleStationHistory(w http.ResponseWriter, r *http.Request, stationID string) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit: %s", v))
+			return
+		}
+		limit = n
+	}
+
+	entries, err := stationStore.ListAudit(stationID, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read history: %v", err))
+		return
+	}
+	if entries == nil {
+		entries = []store.AuditEntry{}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stationID": stationID,
+		"count":     len(entries),
+		"entries":   entries,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"testing"
+)
+
+func auditEntries(t *testing.T, stationID string) []interface{} {
+	t.Helper()
+	rec := serve(handleStation, http.MethodGet, "/stations/"+stationID+"/history", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("history status %d: %s", rec.Code, rec.Body.String())
+	}
+	entries, _ := decodeJSON(t, rec)["entries"].([]interface{})
+	return entries
+}
+
+func TestRentAudited(t *testing.T) {
+	useStore(t, store.NewMemory())
+	fakeStation(t, "AUDIT1", protocol.Version1)
+
+	// Слот 1 занят: выдача проходит; слот 2 пуст: станция отвечает отказом
+	for _, slot := range []string{"1", "2"} {
+		if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=AUDIT1&cmd=rent&slot="+slot+"&wait=true", ""); rec.Code != http.StatusOK {
+			t.Fatalf("rent slot %s: status %d: %s", slot, rec.Code, rec.Body.String())
+		}
+	}
+
+	entries := auditEntries(t, "AUDIT1")
+	if len(entries) != 2 {
+		t.Fatalf("history = %v, want two entries", entries)
+	}
+	// Новые записи первыми
+	failed, sent := entries[0].(map[string]interface{}), entries[1].(map[string]interface{})
+	if sent["command"] != "rent" || sent["slot"] != "1" || sent["result"] != "sent" || sent["payload"] == "" {
+		t.Errorf("rent entry = %v", sent)
+	}
+	if failed["slot"] != "2" || failed["result"] != "failed" || failed["error"] == nil {
+		t.Errorf("failed rent entry = %v", failed)
+	}
+}
+
+// Журнал команд раскрывает, кто и что слал станции, и закрыт ключом
+func TestHistoryRequiresKey(t *testing.T) {
+	useStore(t, store.NewMemory())
+	useAPIKeys(t, map[string]string{"secretkey": "alice"})
+
+	if rec := serve(handleStation, http.MethodGet, "/stations/AUDITKEY1/history", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("history without a key: status %d, want 401", rec.Code)
+	}
+	if rec := serveWithKey(handleStation, http.MethodGet, "/stations/AUDITKEY1/history", "secretkey"); rec.Code != http.StatusOK {
+		t.Errorf("history with a key: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API ключи: ключ -> имя вызывающего, которое попадает в журнал команд
+var apiKeys map[string]string
+
+// parseAPIKeys разбирает строку вида "alice:key1,bob:key2"
+func parseAPIKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("invalid api key entry %q, expected name:key", pair)
+		}
+		keys[key] = name
+	}
+	return keys, nil
+}
+
+// authenticate возвращает имя вызывающего по заголовку X-API-Key.
+// Если ключи не настроены, доступ открыт и вызывающий - "anonymous".
+func authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if len(apiKeys) == 0 {
+		return "anonymous", true
+	}
+
+	given := r.Header.Get("X-API-Key")
+	for key, name := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return name, true
+		}
+	}
+
+	writeJSONError(w, http.StatusUnauthorized, "Missing or invalid X-API-Key")
+	return "", false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"sync"
+	"time"
+)
+
+type BulkSendRequest struct {
+	// Список ID станций или строка "all"
+	StationIDs json.RawMessage `json:"station_ids"`
+	Cmd        string          `json:"cmd"`
+	Token      string          `json:"token"`
+	// Формат token: hex (по умолчанию), base64 или dotted
+	TokenFormat string `json:"token_format,omitempty"`
+	Slot        string `json:"slot,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Port        string `json:"port,omitempty"`
+}
+
+type BulkResult struct {
+	Status  string `json:"status"`
+	Payload string `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func handleBulkSend(w http.ResponseWriter, r *http.Request) {
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST with a JSON body")
+		return
+	}
+
+	var req BulkSendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Error parsing JSON: %v", err))
+		return
+	}
+
+	if req.Cmd == "" || req.Token == "" || len(req.StationIDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Missing required parameters: station_ids, cmd, token")
+		return
+	}
+
+	if !protocol.IsKnownCommand(req.Cmd) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   fmt.Sprintf("Unknown command: %s", req.Cmd),
+			"allowed": protocol.KnownCommands(),
+		})
+		return
+	}
+	if !checkCommandPolicy(w, req.Cmd) {
+		return
+	}
+
+	var stationIDs []string
+	var all string
+	if err := json.Unmarshal(req.StationIDs, &all); err == nil {
+		if all != "all" {
+			writeJSONError(w, http.StatusBadRequest, `station_ids must be a list of IDs or "all"`)
+			return
+		}
+		stationIDs = getConnectedStationIDs()
+	} else if err := json.Unmarshal(req.StationIDs, &stationIDs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, `station_ids must be a list of IDs or "all"`)
+		return
+	}
+
+	// Проверяем параметры заранее, чтобы не отвечать ошибкой по каждой станции
+	params := protocol.Params{Slot: req.Slot, Address: req.Address, Port: req.Port, TokenFormat: req.TokenFormat}
+	if err := validateBulkCommand(stationIDs, req.Cmd, req.Token, params); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results := bulkSend(stationIDs, req.Cmd, req.Token, params)
+
+	for id, res := range results {
+		e := store.AuditEntry{
+			StationID: id,
+			Command:   req.Cmd,
+			Slot:      req.Slot,
+			Caller:    caller,
+			Payload:   res.Payload,
+			Result:    "sent",
+		}
+		if res.Status != "success" {
+			e.Result, e.Error = "failed", res.Error
+		}
+		recordAudit(e)
+	}
+
+	succeeded := 0
+	for _, res := range results {
+		if res.Status == "success" {
+			succeeded++
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"command":   req.Cmd,
+		"total":     len(results),
+		"succeeded": succeeded,
+		"results":   results,
+	})
+}
+
+// bulkSend рассылает команду станциям пулом из cfg.BulkWorkers горутин.
+// Кадр собирается под версию протокола каждой станции.
+func bulkSend(stationIDs []string, cmd, token string, params protocol.Params) map[string]BulkResult {
+	results := make(map[string]BulkResult, len(stationIDs))
+	var resMu sync.Mutex
+
+	workers := cfg.BulkWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				res := bulkSendOne(id, cmd, token, params)
+
+				resMu.Lock()
+				results[id] = res
+				resMu.Unlock()
+			}
+		}()
+	}
+
+	for _, id := range stationIDs {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// validateBulkCommand собирает кадр для каждой версии протокола среди
+// подключенных целевых станций. Ошибка - только если кадр не собирается ни
+// для одной: команду, которую знает лишь v2, остальные станции отклонят в
+// bulkSendOne по своей версии.
+func validateBulkCommand(stationIDs []string, cmd, token string, params protocol.Params) error {
+	versions := make(map[byte]bool)
+	for _, id := range stationIDs {
+		if station, ok := lookupStation(id, ""); ok {
+			versions[station.Version()] = true
+		}
+	}
+	if len(versions) == 0 {
+		// Целевых станций нет в сети: годится любая поддерживаемая версия
+		versions[protocol.Version1], versions[protocol.Version2] = true, true
+	}
+
+	var err error
+	for _, version := range []byte{protocol.Version1, protocol.Version2} {
+		if !versions[version] {
+			continue
+		}
+		if _, err = protocol.CreateCommandParams(cmd, token, params, version); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func bulkSendOne(id, cmd, token string, params protocol.Params) BulkResult {
+	station, exists := lookupStation(id, "")
+
+	if !exists {
+		return BulkResult{Status: "error", Error: "station not connected"}
+	}
+	if _, rebooting := station.rebooting(time.Now()); rebooting {
+		return BulkResult{Status: "error", Error: "station rebooting after restart"}
+	}
+	// Лимит тот же, что у /send: рассылка не должна его обходить
+	if ok, _ := limiterFor(cmd).allow(station.ID); !ok {
+		rateLimited.Inc(cmd)
+		return BulkResult{Status: "error", Error: "rate limited"}
+	}
+
+	if cmd == "rent" || cmd == "eject" {
+		release, ok := lockSlot(station.ID, params.Slot)
+		if !ok {
+			return BulkResult{Status: "error", Error: "slot busy with another rent/eject"}
+		}
+		defer release()
+	}
+
+	payload, err := protocol.CreateCommandParams(cmd, token, params, station.Version())
+	if err != nil {
+		return BulkResult{Status: "error", Error: err.Error()}
+	}
+
+	res := BulkResult{Status: "success", Payload: fmt.Sprintf("%x", payload)}
+	if hardwareCommands[cmd] {
+		// Аппаратные команды идут через очередь станции и держат ее до
+		// ответа, как в /send. Без ответа кадр все равно записан, а restart
+		// станция может не подтвердить, сразу оборвав соединение.
+		station.queue.run(context.Background(), station.queue.enqueue(), func() {
+			_, err = sendAndWait(context.Background(), station, cmd, payload, cfg.BulkTimeout)
+		})
+		if errors.Is(err, ErrReplyTimeout) || rebootedWithoutReply(cmd, err) {
+			err = nil
+		}
+	} else {
+		err = sendToStation(context.Background(), station, cmd, payload, cfg.BulkTimeout)
+	}
+	if err != nil {
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+	noteCommandSent(station, cmd, params)
+	return res
+}
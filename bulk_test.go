@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+func bulkResults(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	rec := serve(handleBulkSend, http.MethodPost, "/send/bulk", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	results, _ := decodeJSON(t, rec)["results"].(map[string]interface{})
+	return results
+}
+
+func bulkStatus(results map[string]interface{}, id string) string {
+	res, _ := results[id].(map[string]interface{})
+	status, _ := res["status"].(string)
+	return status
+}
+
+func TestBulkRestart(t *testing.T) {
+	for _, id := range []string{"BULK1", "BULK2", "BULK3"} {
+		fakeStation(t, id, protocol.Version1)
+	}
+	results := bulkResults(t, `{"station_ids":["BULK1","BULK2","BULK3","BULKGONE"],"cmd":"restart","token":"11223344"}`)
+	for _, id := range []string{"BULK1", "BULK2", "BULK3"} {
+		if got := bulkStatus(results, id); got != "success" {
+			t.Errorf("%s: status %q, want success", id, got)
+		}
+	}
+	if got := bulkStatus(results, "BULKGONE"); got != "error" {
+		t.Errorf("missing station: status %q, want error", got)
+	}
+}
+
+// Станция перезагружается по restart без ответа: соединение закрывается,
+// но кадр записан, и рассылка считает это успехом
+func TestBulkRestartDisconnectIsSuccess(t *testing.T) {
+	p := newTestPeer(t)
+	p.login(t, "BULKDROP1", protocol.Version1)
+	go func() {
+		for frame := range p.frames {
+			if frame[2] == protocol.CmdRestart {
+				p.conn.Close()
+				return
+			}
+		}
+	}()
+
+	results := bulkResults(t, `{"station_ids":["BULKDROP1"],"cmd":"restart","token":"11223344"}`)
+	if got := bulkStatus(results, "BULKDROP1"); got != "success" {
+		t.Errorf("status %q, want success: %v", got, results["BULKDROP1"])
+	}
+}
+
+// multi_eject есть только в v2: проверка заранее не должна отклонять
+// рассылку, если среди целей есть v2 станции
+func TestBulkValidatedAgainstTargetVersions(t *testing.T) {
+	fakeStation(t, "BULKV1", protocol.Version1)
+	fakeStation(t, "BULKV2", protocol.Version2)
+
+	results := bulkResults(t, `{"station_ids":["BULKV1","BULKV2"],"cmd":"multi_eject","token":"11223344","slot":"1,2"}`)
+	if got := bulkStatus(results, "BULKV2"); got != "success" {
+		t.Errorf("v2 station: status %q, want success", got)
+	}
+	if got := bulkStatus(results, "BULKV1"); got != "error" {
+		t.Errorf("v1 station: status %q, want error", got)
+	}
+
+	rec := serve(handleBulkSend, http.MethodPost, "/send/bulk", `{"station_ids":["BULKV1"],"cmd":"multi_eject","token":"11223344","slot":"1,2"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("multi_eject to v1 only: status %d, want 400", rec.Code)
+	}
+}
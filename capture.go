@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"server/internal/protocol"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Файл захвата - последовательность записей
+//
+//	Dir(1) + UnixNano(8) + Len(4) + Data(Len), числа big endian
+//
+// Dir: 'R' - прочитано от станции, 'W' - записано в станцию. Data - ровно
+// то, что вернул Read или принял Write, без разбиения на кадры.
+const (
+	captureRead  byte = 'R'
+	captureWrite byte = 'W'
+
+	captureHeaderLen = 13
+)
+
+// Сколько записей держим до логина, пока не известен ID станции
+const capturePendingMax = 64
+
+// captureFile - файл захвата одной станции. В -multi-conn его делят все
+// соединения станции, поэтому счетчик ссылок.
+type captureFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+	refs int
+}
+
+var (
+	captureMu    sync.Mutex
+	captureFiles = make(map[string]*captureFile)
+)
+
+// captureName оставляет в ID станции только безопасные для имени файла символы
+func captureName(stationID string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, stationID) + ".cap"
+}
+
+func acquireCapture(stationID string) (*captureFile, error) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	if cf, ok := captureFiles[stationID]; ok {
+		cf.refs++
+		return cf, nil
+	}
+	cf := &captureFile{path: filepath.Join(cfg.CaptureDir, captureName(stationID))}
+	if err := cf.open(); err != nil {
+		return nil, err
+	}
+	cf.refs = 1
+	captureFiles[stationID] = cf
+	return cf, nil
+}
+
+func releaseCapture(stationID string, cf *captureFile) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	cf.refs--
+	if cf.refs > 0 {
+		return
+	}
+	delete(captureFiles, stationID)
+	cf.mu.Lock()
+	cf.f.Close()
+	cf.mu.Unlock()
+}
+
+func (cf *captureFile) open() error {
+	f, err := os.OpenFile(cf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	cf.f, cf.size = f, info.Size()
+	return nil
+}
+
+// rotate переименовывает текущий файл в .1 (предыдущий .1 теряется) и
+// начинает новый
+func (cf *captureFile) rotate() error {
+	cf.f.Close()
+	if err := os.Rename(cf.path, cf.path+".1"); err != nil {
+		return err
+	}
+	return cf.open()
+}
+
+func (cf *captureFile) record(dir byte, t time.Time, data []byte) {
+	rec := make([]byte, captureHeaderLen+len(data))
+	rec[0] = dir
+	binary.BigEndian.PutUint64(rec[1:9], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(rec[9:13], uint32(len(data)))
+	copy(rec[captureHeaderLen:], data)
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cfg.CaptureMaxBytes > 0 && cf.size > 0 && cf.size+int64(len(rec)) > cfg.CaptureMaxBytes {
+		if err := cf.rotate(); err != nil {
+			slog.Error("capture rotation failed", "path", cf.path, "error", err)
+			return
+		}
+	}
+	n, err := cf.f.Write(rec)
+	cf.size += int64(n)
+	if err != nil {
+		slog.Error("capture write failed", "path", cf.path, "error", err)
+	}
+}
+
+type captureRecord struct {
+	dir  byte
+	t    time.Time
+	data []byte
+}
+
+// captureConn пишет в файл захвата все байты, прочитанные из соединения и
+// записанные в него. До bind записи копятся в памяти.
+type captureConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	stationID string
+	file      *captureFile
+	pending   []captureRecord
+}
+
+func newCaptureConn(c net.Conn) *captureConn {
+	return &captureConn{Conn: c}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.capture(captureRead, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.capture(captureWrite, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) capture(dir byte, data []byte) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file != nil {
+		c.file.record(dir, now, data)
+		return
+	}
+	if c.stationID == "" && len(c.pending) < capturePendingMax {
+		c.pending = append(c.pending, captureRecord{dir, now, append([]byte(nil), data...)})
+	}
+}
+
+// bind открывает файл станции и сбрасывает в него накопленное до логина
+func (c *captureConn) bind(stationID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stationID != "" {
+		return
+	}
+	c.stationID = stationID
+
+	cf, err := acquireCapture(stationID)
+	if err != nil {
+		slog.Error("capture open failed", "station_id", stationID, "error", err)
+		c.pending = nil
+		return
+	}
+	c.file = cf
+	for _, rec := range c.pending {
+		cf.record(rec.dir, rec.t, rec.data)
+	}
+	c.pending = nil
+}
+
+func (c *captureConn) Close() error {
+	c.mu.Lock()
+	if c.file != nil {
+		releaseCapture(c.stationID, c.file)
+		c.file = nil
+	}
+	c.pending = nil
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// ReplayEvent - один кадр из файла захвата, как его видит декодер
+type ReplayEvent struct {
+	Time    time.Time                `json:"time"`
+	Dir     string                   `json:"dir"`
+	Hex     string                   `json:"hex"`
+	Message *protocol.DecodedMessage `json:"message,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+}
+
+// replayCapture читает файл захвата, режет данные каждого направления на
+// кадры по PackLen и прогоняет их через protocol.Decode
+func replayCapture(r io.Reader, emit func(ReplayEvent)) error {
+	br := bufio.NewReader(r)
+	buffered := map[byte][]byte{}
+	header := make([]byte, captureHeaderLen)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading record header: %w", err)
+		}
+		dir := header[0]
+		if dir != captureRead && dir != captureWrite {
+			return fmt.Errorf("bad record direction 0x%02x", dir)
+		}
+		t := time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9])))
+		data := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("reading record data: %w", err)
+		}
+
+		buf := append(buffered[dir], data...)
+		for {
+			n := protocol.FrameLen(buf)
+			if n == 0 {
+				break
+			}
+			emit(replayEvent(t, dir, buf[:n]))
+			buf = buf[n:]
+		}
+		buffered[dir] = append([]byte(nil), buf...)
+	}
+}
+
+func replayEvent(t time.Time, dir byte, frame []byte) ReplayEvent {
+	ev := ReplayEvent{Time: t, Dir: "in", Hex: fmt.Sprintf("%x", frame)}
+	if dir == captureWrite {
+		ev.Dir = "out"
+	}
+	msg, err := protocol.Decode(frame)
+	// Decode разбирает payload как ответ станции; payload команды сервера
+	// так не разбирается, и это не ошибка
+	if dir == captureWrite && errors.Is(err, protocol.ErrBadPayload) {
+		err = nil
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if err == nil || msg.Cmd != 0 {
+		ev.Message = &msg
+	}
+	return ev
+}
+
+// runReplay - режим -replay: печатает кадры из файла захвата JSON строками
+func runReplay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	return replayCapture(f, func(ev ReplayEvent) {
+		enc.Encode(ev)
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"server/internal/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	IdleTimeout  time.Duration
+	KeepAlive    time.Duration
+	WriteTimeout time.Duration
+	LogFormat    string
+	LogLevel     string
+	BulkWorkers  int
+	BulkTimeout  time.Duration
+	StoreDriver  string
+	StoreDSN     string
+	APIKeys      string
+	LoginSecret  string
+
+	CommandPolicy string
+	AllowCommands string
+	DenyCommands  string
+
+	StrictPackLen      bool
+	ChecksumAlertAfter int
+	NackUnknown        bool
+	NackChecksum       bool
+	MaxRetransmits     int
+	RefreshOnLogin     bool
+	HeartbeatReply     string
+	RejectReturnIDs    string
+	ChecksumCoverage   string
+	AcceptVersions     string
+
+	ReplyTimeout         time.Duration
+	EjectAllDelay        time.Duration
+	InventoryPartTimeout time.Duration
+	EjectConfirmTimeout  time.Duration
+	EjectConfirmInterval time.Duration
+
+	WriteRetries      int
+	WriteRetryBackoff time.Duration
+
+	TCPAddr  string
+	HTTPAddr string
+
+	MaxConnections int
+	ListenRetry    time.Duration
+	ListenBacklog  int
+	MaxFrameSize   int
+	MultiConn      bool
+	StationIDCase  string
+	AllowCIDRs     string
+
+	HeartbeatInterval time.Duration
+	StaleAfter        time.Duration
+	RestartGrace      time.Duration
+	RestartCooldown   time.Duration
+
+	HardwareRate  float64
+	HardwareBurst int
+	QueryRate     float64
+	QueryBurst    int
+
+	IdempotencyTTL time.Duration
+
+	WebhookURL     string
+	WebhookTimeout time.Duration
+	// Пачки событий: до WebhookBatch событий или WebhookWindow ожидания
+	WebhookBatch  int
+	WebhookWindow time.Duration
+	WebhookGzip   bool
+
+	EventBuffer     int
+	EventDropPolicy string
+
+	CaptureDir      string
+	CaptureMaxBytes int64
+	Replay          string
+
+	EmulateSlotResults string
+	EmulateInventory   string
+	FakeStations       int
+
+	Emulate          bool
+	EmulateTarget    string
+	EmulateBoxID     string
+	EmulateToken     string
+	EmulateVersion   int
+	EmulateSlots     int
+	EmulateHeartbeat time.Duration
+	EmulateReconnect time.Duration
+	EmulateFirmware  string
+	EmulateICCID     string
+}
+
+var cfg = Config{
+	IdleTimeout:  5 * time.Minute,
+	KeepAlive:    time.Minute,
+	WriteTimeout: 10 * time.Second,
+	LogFormat:    "text",
+	LogLevel:     "info",
+	BulkWorkers:  16,
+	BulkTimeout:  5 * time.Second,
+	StoreDriver:  "memory",
+
+	CommandPolicy: "open",
+
+	StrictPackLen:  false,
+	HeartbeatReply: "echo",
+	MaxRetransmits: 3,
+	RefreshOnLogin: true,
+	AcceptVersions: "1,2",
+
+	ReplyTimeout:  10 * time.Second,
+	EjectAllDelay: 500 * time.Millisecond,
+
+	InventoryPartTimeout: 5 * time.Second,
+	EjectConfirmTimeout:  10 * time.Second,
+	EjectConfirmInterval: time.Second,
+
+	WriteRetries:      2,
+	WriteRetryBackoff: 100 * time.Millisecond,
+
+	TCPAddr:  ":9000",
+	HTTPAddr: ":8080",
+
+	MaxConnections: 1000,
+	ListenRetry:    5 * time.Second,
+	StationIDCase:  "preserve",
+	MaxFrameSize:   1024,
+
+	HeartbeatInterval: 30 * time.Second,
+	StaleAfter:        90 * time.Second,
+	RestartGrace:      2 * time.Minute,
+	RestartCooldown:   30 * time.Second,
+
+	HardwareRate:  0.5,
+	HardwareBurst: 2,
+	QueryRate:     5,
+	QueryBurst:    10,
+
+	IdempotencyTTL: 24 * time.Hour,
+
+	WebhookTimeout: 5 * time.Second,
+	WebhookWindow:  time.Second,
+
+	EventBuffer:     256,
+	EventDropPolicy: "newest",
+
+	CaptureMaxBytes: 10 << 20,
+
+	EmulateTarget:    "127.0.0.1:9000",
+	EmulateBoxID:     "EMU00001",
+	EmulateToken:     "11223344",
+	EmulateVersion:   1,
+	EmulateSlots:     12,
+	EmulateHeartbeat: 30 * time.Second,
+	EmulateReconnect: 5 * time.Second,
+	EmulateFirmware:  protocol.DefaultProfile.Firmware,
+	EmulateICCID:     protocol.DefaultProfile.ICCID,
+}
+
+func parseFlags() {
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "close a station connection after this long without incoming data (0 disables)")
+	flag.BoolVar(&cfg.RefreshOnLogin, "refresh-on-login", cfg.RefreshOnLogin, "send query_power_bank right after a station logs in so the inventory cache is filled without waiting for a client query")
+	flag.DurationVar(&cfg.KeepAlive, "keepalive", cfg.KeepAlive, "TCP keepalive probe period on station connections, catches peers that vanished behind NAT (0 disables keepalive)")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "deadline for a single write to a station (0 disables)")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log output format: text (local dev) or json (production)")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug (per-frame tracing), info, warn or error")
+	flag.IntVar(&cfg.BulkWorkers, "bulk-workers", cfg.BulkWorkers, "number of concurrent writers for /send/bulk")
+	flag.DurationVar(&cfg.BulkTimeout, "bulk-timeout", cfg.BulkTimeout, "per-station write deadline for /send/bulk")
+	flag.StringVar(&cfg.StoreDriver, "store-driver", cfg.StoreDriver, "station store: memory, file, or a registered database/sql driver name (sqlite, postgres)")
+	flag.StringVar(&cfg.StoreDSN, "store-dsn", cfg.StoreDSN, "store location: file path for the file store, DSN for SQL drivers")
+	flag.StringVar(&cfg.APIKeys, "api-keys", cfg.APIKeys, "comma-separated name:key pairs; when set, command endpoints require X-API-Key")
+	flag.StringVar(&cfg.CommandPolicy, "command-policy", cfg.CommandPolicy, "commands allowed via /send, /send/bulk and /macro: open (all) or production (no eject, eject_all, multi_eject, unlock_all, set_server, restart); read-only queries are always allowed")
+	flag.StringVar(&cfg.AllowCommands, "allow-commands", cfg.AllowCommands, "comma-separated commands; when set, only these (plus read-only queries) are allowed")
+	flag.StringVar(&cfg.DenyCommands, "deny-commands", cfg.DenyCommands, "comma-separated commands denied on top of -command-policy")
+	flag.StringVar(&cfg.LoginSecret, "login-secret", cfg.LoginSecret, "shared station secret; when set, login Magic must equal the first two bytes of HMAC-SHA256(secret, Rand)")
+	flag.BoolVar(&cfg.StrictPackLen, "strict-packlen", cfg.StrictPackLen, "drop frames whose PackLen does not match the received length (off by default for firmware with PackLen bugs)")
+	flag.IntVar(&cfg.ChecksumAlertAfter, "checksum-alert-after", cfg.ChecksumAlertAfter, "publish a checksum_failures event once a station connection has this many bad-checksum frames (0 disables)")
+	flag.StringVar(&cfg.ChecksumCoverage, "checksum-coverage", cfg.ChecksumCoverage, "comma-separated version:coverage pairs, coverage is payload (after Token) or frame (everything after PackLen), e.g. 1:frame")
+	flag.StringVar(&cfg.AcceptVersions, "accept-versions", cfg.AcceptVersions, "comma-separated protocol versions accepted from stations; frames with other version bytes are dropped (NACKed with -nack-unknown)")
+	flag.StringVar(&cfg.RejectReturnIDs, "reject-return-ids", cfg.RejectReturnIDs, "comma-separated power bank IDs whose returns are answered with a failure result so the station pushes them back out")
+	flag.BoolVar(&cfg.NackUnknown, "nack-unknown", cfg.NackUnknown, "answer unknown incoming commands with a NACK frame (result 0xff) instead of silence")
+	flag.BoolVar(&cfg.NackChecksum, "nack-checksum", cfg.NackChecksum, "answer bad-checksum frames with a NACK (result 0xfe) asking the station to resend")
+	flag.IntVar(&cfg.MaxRetransmits, "max-retransmits", cfg.MaxRetransmits, "consecutive bad-checksum frames a station is asked to resend before further ones are dropped silently (0 is unlimited)")
+	flag.StringVar(&cfg.HeartbeatReply, "heartbeat-reply", cfg.HeartbeatReply, "answer to station heartbeats: echo (the same frame), ack (empty payload) or time (server Unix time, 4 bytes)")
+	flag.DurationVar(&cfg.EjectConfirmTimeout, "eject-confirm-timeout", cfg.EjectConfirmTimeout, "how long eject with confirm=true polls the inventory for the slot to become empty before reporting stuck")
+	flag.DurationVar(&cfg.EjectConfirmInterval, "eject-confirm-interval", cfg.EjectConfirmInterval, "delay between inventory polls of eject with confirm=true")
+	flag.DurationVar(&cfg.ReplyTimeout, "reply-timeout", cfg.ReplyTimeout, "how long to wait for a station reply when a command needs one")
+	flag.DurationVar(&cfg.EjectAllDelay, "eject-all-delay", cfg.EjectAllDelay, "pause between consecutive ejects issued by eject_all")
+	flag.DurationVar(&cfg.InventoryPartTimeout, "inventory-part-timeout", cfg.InventoryPartTimeout, "how long to wait for the next frame of a multi-frame query_power_bank reply before discarding the parts")
+	flag.IntVar(&cfg.WriteRetries, "write-retries", cfg.WriteRetries, "extra attempts for a command write that timed out before sending anything")
+	flag.DurationVar(&cfg.WriteRetryBackoff, "write-retry-backoff", cfg.WriteRetryBackoff, "initial backoff between write retries, doubled per attempt")
+	flag.IntVar(&cfg.MaxConnections, "max-connections", cfg.MaxConnections, "maximum concurrent TCP connections; extra connections are closed right after accept (0 is unlimited)")
+	flag.StringVar(&cfg.AllowCIDRs, "allow-cidrs", cfg.AllowCIDRs, "comma-separated CIDRs or IPs allowed to connect to the TCP port; others are closed right after accept (empty allows all)")
+	flag.StringVar(&cfg.TCPAddr, "tcp-addr", cfg.TCPAddr, "address the station TCP server listens on (:0 picks a free port, see /server/info)")
+	flag.StringVar(&cfg.HTTPAddr, "http-addr", cfg.HTTPAddr, "address the HTTP API listens on (:0 picks a free port, see /server/info)")
+	flag.IntVar(&cfg.ListenBacklog, "listen-backlog", cfg.ListenBacklog, "accept queue length of the station TCP listener (0 keeps the system default, capped by net.core.somaxconn)")
+	flag.DurationVar(&cfg.ListenRetry, "listen-retry", cfg.ListenRetry, "delay before binding the TCP port again after it failed to bind or the listener broke (0 gives up)")
+	flag.StringVar(&cfg.StationIDCase, "station-id-case", cfg.StationIDCase, "case policy for station IDs from login and API lookups: preserve, upper or lower")
+	flag.BoolVar(&cfg.MultiConn, "multi-conn", cfg.MultiConn, "keep every connection of a re-logging station instead of closing the old one; /send can target one with connID")
+	flag.IntVar(&cfg.MaxFrameSize, "max-frame-size", cfg.MaxFrameSize, "largest frame accepted from a station in bytes; a larger PackLen closes the connection")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "heartbeat interval expected from stations until set_server changes it")
+	flag.DurationVar(&cfg.StaleAfter, "stale-after", cfg.StaleAfter, "report a connected station as stale after this long without incoming frames (0 disables)")
+	flag.DurationVar(&cfg.RestartCooldown, "restart-cooldown", cfg.RestartCooldown, "after a restart command, refuse further commands to the station with 409 for this long or until it logs in again (0 disables)")
+	flag.DurationVar(&cfg.RestartGrace, "restart-grace", cfg.RestartGrace, "after a restart command, report the station as restarting instead of stale and publish restart_timeout if it does not log in again within this window (0 disables)")
+	flag.Float64Var(&cfg.HardwareRate, "hardware-rate", cfg.HardwareRate, "per-station limit for rent/eject/eject_all/multi_eject/restart/unlock_all via /send, commands per second (0 disables)")
+	flag.IntVar(&cfg.HardwareBurst, "hardware-burst", cfg.HardwareBurst, "burst size for -hardware-rate")
+	flag.Float64Var(&cfg.QueryRate, "query-rate", cfg.QueryRate, "per-station limit for all other commands via /send, commands per second (0 disables)")
+	flag.IntVar(&cfg.QueryBurst, "query-burst", cfg.QueryBurst, "burst size for -query-rate")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long a /send result is kept for replay under its Idempotency-Key (0 disables)")
+	flag.StringVar(&cfg.WebhookURL, "webhook-url", cfg.WebhookURL, "POST every station event (e.g. slot occupancy changes) as JSON to this URL (empty disables)")
+	flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", cfg.WebhookTimeout, "timeout for a single webhook delivery")
+	flag.IntVar(&cfg.WebhookBatch, "webhook-batch", cfg.WebhookBatch, "POST events to the webhook as a JSON array of up to this many events (0 posts each event on its own)")
+	flag.DurationVar(&cfg.WebhookWindow, "webhook-window", cfg.WebhookWindow, "longest time an event waits in a webhook batch before the batch is posted")
+	flag.BoolVar(&cfg.WebhookGzip, "webhook-gzip", cfg.WebhookGzip, "gzip webhook batch bodies and send them with Content-Encoding: gzip")
+	flag.IntVar(&cfg.EventBuffer, "event-buffer", cfg.EventBuffer, "events buffered per subscriber (webhook, each /ws/events client) before drops")
+	flag.StringVar(&cfg.EventDropPolicy, "event-drop-policy", cfg.EventDropPolicy, "what a full subscriber buffer loses: newest (the incoming event) or oldest (the oldest buffered event)")
+	flag.StringVar(&cfg.CaptureDir, "capture-dir", cfg.CaptureDir, "record all bytes read from and written to each station into <dir>/<stationID>.cap (empty disables)")
+	flag.Int64Var(&cfg.CaptureMaxBytes, "capture-max-bytes", cfg.CaptureMaxBytes, "rotate a capture file to .1 once it would exceed this size (0 never rotates)")
+	flag.StringVar(&cfg.Replay, "replay", cfg.Replay, "decode a capture file, print its frames as JSON lines and exit")
+	flag.StringVar(&cfg.EmulateInventory, "emulate-inventory", cfg.EmulateInventory, "comma-separated slot:powerBankID[:level] the emulated station holds, e.g. 1:RL1H|001:4,3:RL1H|003:2 (empty keeps the built-in slots 1 and 3)")
+	flag.StringVar(&cfg.EmulateSlotResults, "emulate-slot-results", cfg.EmulateSlotResults, "comma-separated slot:result pairs the emulated station returns for rent/eject, e.g. 2:0 for an empty slot 2")
+	flag.IntVar(&cfg.FakeStations, "fake-stations", cfg.FakeStations, "register this many in-memory stations FAKE0001.. answered by the emulator, no TCP involved (uses -emulate-token/-version/-firmware/-iccid)")
+	flag.BoolVar(&cfg.Emulate, "emulate", cfg.Emulate, "run as a station emulator that connects to -emulate-target instead of serving")
+	flag.StringVar(&cfg.EmulateTarget, "emulate-target", cfg.EmulateTarget, "server address the emulator connects to")
+	flag.StringVar(&cfg.EmulateBoxID, "emulate-box-id", cfg.EmulateBoxID, "box ID the emulator logs in with")
+	flag.StringVar(&cfg.EmulateToken, "emulate-token", cfg.EmulateToken, "token the emulator sends in its frames, 8 hex characters")
+	flag.IntVar(&cfg.EmulateVersion, "emulate-version", cfg.EmulateVersion, "protocol version the emulator speaks (1 or 2)")
+	flag.IntVar(&cfg.EmulateSlots, "emulate-slots", cfg.EmulateSlots, "slot count the emulator reports at login")
+	flag.DurationVar(&cfg.EmulateHeartbeat, "emulate-heartbeat", cfg.EmulateHeartbeat, "interval between emulator heartbeats (0 disables)")
+	flag.DurationVar(&cfg.EmulateReconnect, "emulate-reconnect", cfg.EmulateReconnect, "delay before the emulator reconnects after a disconnect")
+	flag.StringVar(&cfg.EmulateFirmware, "emulate-firmware", cfg.EmulateFirmware, "firmware string the emulator returns for query_fw")
+	flag.StringVar(&cfg.EmulateICCID, "emulate-iccid", cfg.EmulateICCID, "ICCID the emulator returns for query_iccid")
+	flag.Parse()
+
+	protocol.StrictPackLen = cfg.StrictPackLen
+	protocol.NackUnknown = cfg.NackUnknown
+	protocol.NackChecksum = cfg.NackChecksum
+	if cfg.RejectReturnIDs != "" {
+		protocol.ReturnPolicy = returnPolicy(cfg.RejectReturnIDs)
+	}
+	if cfg.LoginSecret != "" {
+		protocol.LoginSecret = []byte(cfg.LoginSecret)
+	}
+}
+
+// parseChecksumCoverage разбирает строку вида "1:frame,2:payload"
+func parseChecksumCoverage(s string) (map[byte]protocol.ChecksumCoverage, error) {
+	coverage := make(map[byte]protocol.ChecksumCoverage)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		v, mode, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, expected version:coverage", pair)
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || !protocol.SupportsVersion(byte(version)) {
+			return nil, fmt.Errorf("invalid entry %q: unsupported protocol version %q", pair, v)
+		}
+		c, err := protocol.ParseCoverage(strings.TrimSpace(mode))
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %v", pair, err)
+		}
+		coverage[byte(version)] = c
+	}
+	return coverage, nil
+}
+
+// parseVersions разбирает список версий протокола вида "1,2"
+func parseVersions(s string) (map[byte]bool, error) {
+	versions := make(map[byte]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || !protocol.SupportsVersion(byte(n)) {
+			return nil, fmt.Errorf("unsupported protocol version %q", v)
+		}
+		versions[byte(n)] = true
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no versions given")
+	}
+	return versions, nil
+}
+
+// returnPolicy отклоняет возвраты повербанков из списка, остальные решает
+// protocol.DefaultReturnPolicy
+func returnPolicy(ids string) func(protocol.PowerBankReturn) byte {
+	rejected := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			rejected[id] = true
+		}
+	}
+	return func(r protocol.PowerBankReturn) byte {
+		if rejected[r.PowerBankID] {
+			return protocol.ReturnFailed
+		}
+		return protocol.DefaultReturnPolicy(r)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"time"
+)
+
+// Итог eject с confirm=true, поле confirmation
+const (
+	// Слот опустел: повербанк вышел
+	confirmEjected = "ejected"
+	// Станция ответила на eject, но слот так и остался занятым
+	confirmStuck = "stuck"
+	// Станция не ответила на запрос инвентаря за cfg.EjectConfirmTimeout
+	confirmTimeout = "timeout"
+)
+
+// dispatchConfirmedEject - eject с подтверждением: после успешного ответа
+// на 0x80 опрашивает query_power_bank, пока слот не опустеет или не выйдет
+// cfg.EjectConfirmTimeout. Мотор мог отработать, а повербанк застрять, и
+// повторять eject вслепую небезопасно. Все это время команда держит очередь
+// станции, как eject_all.
+func dispatchConfirmedEject(ctx context.Context, w http.ResponseWriter, station *Station, token, slot, caller string) {
+	if !checkRebooting(w, station) {
+		return
+	}
+	if !checkRateLimit(w, station.ID, "eject") {
+		return
+	}
+	n, err := protocol.ParseSlot(slot)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !checkSlotInCabinet(w, station, slot) {
+		return
+	}
+
+	var res EjectResult
+	var confirmation string
+	err = station.queue.run(ctx, station.queue.enqueue(), func() {
+		res = ejectSlot(ctx, station, token, caller, protocol.SlotEntry{Slot: n})
+		if res.Status == "ejected" {
+			confirmation = confirmEject(ctx, station, token, n)
+		}
+	})
+	if err != nil {
+		writeJSONError(w, canceledStatus(err), fmt.Sprintf("Request canceled: %v", err))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":    "success",
+		"stationID": station.ID,
+		"command":   "eject",
+		"slot":      n,
+		"eject":     res,
+	}
+	if confirmation == "" {
+		// До опроса не дошло: eject не удался
+		resp["status"] = "error"
+		w.WriteHeader(http.StatusBadGateway)
+	} else {
+		resp["confirmation"] = confirmation
+		if confirmation != confirmEjected {
+			resp["status"] = "error"
+			w.WriteHeader(http.StatusConflict)
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// confirmEject опрашивает инвентарь, пока слот не опустеет. stuck - если
+// хотя бы один ответ пришел и слот в нем занят, timeout - если станция не
+// ответила ни разу.
+func confirmEject(ctx context.Context, station *Station, token string, slot byte) string {
+	payload, err := protocol.CreateCommand("query_power_bank", token, "", station.Version())
+	if err != nil {
+		return confirmTimeout
+	}
+
+	deadline := time.Now().Add(cfg.EjectConfirmTimeout)
+	result := confirmTimeout
+	for {
+		wait := min(cfg.ReplyTimeout, time.Until(deadline))
+		if wait <= 0 {
+			return result
+		}
+		msg, err := sendAndWait(ctx, station, "query_power_bank", payload, wait)
+		switch {
+		case err == nil && !slotOccupied(msg.Inventory, slot):
+			return confirmEjected
+		case err == nil:
+			result = confirmStuck
+		case !errors.Is(err, ErrReplyTimeout):
+			// Клиент ушел или соединение закрылось
+			return result
+		}
+
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(min(cfg.EjectConfirmInterval, time.Until(deadline))):
+		}
+	}
+}
+
+// slotOccupied - есть ли в инвентаре повербанк в слоте; запись без ID
+// считается пустым слотом, как в occupiedSlots
+func slotOccupied(inventory []protocol.SlotEntry, slot byte) bool {
+	_, ok := occupiedSlots(inventory)[slot]
+	return ok
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+// stuckConn - станция, у которой мотор отрабатывает eject, а повербанк
+// застревает: инвентарь всегда показывает его в слоте
+type stuckConn struct {
+	fakeConn
+}
+
+func (c *stuckConn) Write(b []byte) (int, error) {
+	profile := c.profile
+	if len(b) > 2 && b[2] == protocol.CmdEject {
+		// Eject вынимает повербанк из копии, модель инвентаря не меняется
+		profile.Slots = profile.Slots.Copy()
+	}
+	if resp := protocol.EmulateResponse(append([]byte(nil), b...), profile); resp != nil {
+		go c.station.receive(resp)
+	}
+	return len(b), nil
+}
+
+func TestConfirmedEject(t *testing.T) {
+	timeout := cfg.EjectConfirmTimeout
+	t.Cleanup(func() { cfg.EjectConfirmTimeout = timeout })
+	cfg.EjectConfirmTimeout = 100 * time.Millisecond
+
+	fakeStation(t, "CONFIRM1", protocol.Version1)
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=CONFIRM1&cmd=eject&slot=1&confirm=true", "")
+	if resp := decodeJSON(t, rec); rec.Code != http.StatusOK || resp["confirmation"] != confirmEjected {
+		t.Errorf("eject: %d %v, want 200 with confirmation ejected", rec.Code, resp)
+	}
+
+	conn := &stuckConn{fakeConn{addr: "mem:CONFIRM2", profile: protocol.Profile{Slots: protocol.DefaultSlots.Copy()}}}
+	conn.station = scriptStation(t, "CONFIRM2", conn)
+	rec = serve(handleSendCommand, http.MethodGet, "/send?stationID=CONFIRM2&cmd=eject&slot=1&confirm=true", "")
+	resp := decodeJSON(t, rec)
+	eject, _ := resp["eject"].(map[string]interface{})
+	if rec.Code != http.StatusConflict || resp["confirmation"] != confirmStuck || eject["status"] != "ejected" {
+		t.Errorf("stuck eject: %d %v, want 409 with confirmation stuck", rec.Code, resp)
+	}
+}
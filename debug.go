@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"strings"
+)
+
+type DecodeRequest struct {
+	// Кадр в hex, пробелы и двоеточия допускаются
+	Hex string `json:"hex"`
+}
+
+// handleDecode разбирает произвольный кадр для отладки. Станция не
+// регистрируется, ответ не формируется.
+func handleDecode(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST with a JSON body")
+		return
+	}
+
+	var req DecodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Error parsing JSON: %v", err))
+		return
+	}
+
+	cleaned := strings.NewReplacer(" ", "", ":", "", "\n", "", "\t", "").Replace(req.Hex)
+	frame, err := hex.DecodeString(cleaned)
+	if err != nil || len(frame) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "hex must be a non-empty hex string")
+		return
+	}
+
+	json.NewEncoder(w).Encode(protocol.Inspect(frame))
+}
+
+type EncodeRequest struct {
+	Cmd   string `json:"cmd"`
+	Token string `json:"token"`
+	// Формат token: hex (по умолчанию), base64 или dotted
+	TokenFormat string `json:"token_format,omitempty"`
+	Slot        string `json:"slot,omitempty"`
+	Level       string `json:"level,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Port        string `json:"port,omitempty"`
+	// Интервал heartbeat для set_server, по умолчанию берется из slot
+	Interval string `json:"interval,omitempty"`
+	Version  byte   `json:"version,omitempty"`
+}
+
+// Поле запроса, к которому относится ошибка CreateCommand
+var encodeErrorFields = []struct {
+	err   error
+	field string
+}{
+	{protocol.ErrUnknownCommand, "cmd"},
+	{protocol.ErrUnsupportedVersion, "version"},
+	{protocol.ErrInvalidToken, "token"},
+	{protocol.ErrInvalidSlot, "slot"},
+	{protocol.ErrInvalidLevel, "level"},
+	{protocol.ErrInvalidBrightness, "slot"},
+	{protocol.ErrInvalidInterval, "interval"},
+	{protocol.ErrInvalidAddress, "address"},
+	{protocol.ErrInvalidPort, "port"},
+	{protocol.ErrPayloadTooLarge, "address"},
+}
+
+// handleEncode собирает кадр так же, как /send, без станции. Нужен для
+// генерации тестовых векторов.
+func handleEncode(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST with a JSON body")
+		return
+	}
+
+	var req EncodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Error parsing JSON: %v", err))
+		return
+	}
+	if req.Version == 0 {
+		req.Version = protocol.Version1
+	}
+
+	// CreateCommand принимает уровень и интервал через Slot
+	slot := req.Slot
+	switch {
+	case req.Cmd == "voice_set" && req.Level != "":
+		slot = req.Level
+	case req.Cmd == "set_server" && req.Interval != "":
+		slot = req.Interval
+	}
+
+	params := protocol.Params{Slot: slot, Address: req.Address, Port: req.Port, TokenFormat: req.TokenFormat}
+	frame, err := protocol.CreateCommandParams(req.Cmd, req.Token, params, req.Version)
+	if err != nil {
+		resp := map[string]interface{}{"error": err.Error()}
+		for _, f := range encodeErrorFields {
+			if errors.Is(err, f.err) {
+				resp["field"] = f.field
+				break
+			}
+		}
+		if errors.Is(err, protocol.ErrUnknownCommand) {
+			resp["allowed"] = protocol.KnownCommands()
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"command": req.Cmd,
+		"frame":   fmt.Sprintf("%x", frame),
+		"fields":  protocol.Breakdown(frame),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+func TestDecodeEndpoint(t *testing.T) {
+	login := loginFrame("DECODE1", protocol.Version1)
+	rec := serve(handleDecode, http.MethodPost, "/decode", fmt.Sprintf(`{"hex":"%x"}`, login))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeJSON(t, rec)
+	decoded, _ := resp["decoded"].(map[string]interface{})
+	loginFields, _ := decoded["login"].(map[string]interface{})
+	if resp["command"] != "login" || resp["checksumValid"] != true || resp["lengthValid"] != true || loginFields["boxID"] != "DECODE1" {
+		t.Errorf("login frame decoded as %v", resp)
+	}
+
+	// Битая checksum: поля заголовка отдаются, ошибка названа
+	bad := append([]byte(nil), login...)
+	bad[len(bad)-1] ^= 0xFF
+	resp = decodeJSON(t, serve(handleDecode, http.MethodPost, "/decode", `{"hex":"`+hex.EncodeToString(bad)+`"}`))
+	if resp["checksumValid"] != false || resp["error"] == nil || resp["fields"] == nil {
+		t.Errorf("bad checksum frame decoded as %v", resp)
+	}
+
+	resp = decodeJSON(t, serve(handleDecode, http.MethodPost, "/decode", `{"hex":"00 07 61"}`))
+	if resp["command"] != "unknown" || resp["error"] == nil {
+		t.Errorf("short frame decoded as %v", resp)
+	}
+
+	if rec := serve(handleDecode, http.MethodPost, "/decode", `{"hex":"zz"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("non-hex input: status %d, want 400", rec.Code)
+	}
+}
+
+func TestEncodeEndpoint(t *testing.T) {
+	tests := []struct {
+		name, body, cmd, payload string
+	}{
+		{"heartbeat", `{"cmd":"heartbeat","token":"11223344"}`, "0x61", ""},
+		{"rent", `{"cmd":"rent","token":"11223344","slot":"5"}`, "0x65", "05"},
+		// AddressLen + "10.0.0.1\0" + PortLen + "9000\0" + Interval
+		{"set_server", `{"cmd":"set_server","token":"11223344","address":"10.0.0.1","port":"9000","interval":"30"}`, "0x63",
+			"0009" + hex.EncodeToString([]byte("10.0.0.1\x00")) + "0005" + hex.EncodeToString([]byte("9000\x00")) + "1e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(handleEncode, http.MethodPost, "/encode", tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+			}
+			resp := decodeJSON(t, rec)
+			fields, _ := resp["fields"].(map[string]interface{})
+			if fields["cmd"] != tt.cmd || fields["payload"] != tt.payload || fields["token"] != "11223344" {
+				t.Errorf("fields = %v, want cmd %s payload %q", fields, tt.cmd, tt.payload)
+			}
+			frame, err := hex.DecodeString(resp["frame"].(string))
+			if err != nil || !protocol.ChecksumValid(frame) || protocol.ValidateLength(frame) != nil {
+				t.Errorf("frame %v is not a valid frame", resp["frame"])
+			}
+		})
+	}
+
+	resp := decodeJSON(t, serve(handleEncode, http.MethodPost, "/encode", `{"cmd":"rent","token":"11223344","slot":"0"}`))
+	if resp["field"] != "slot" {
+		t.Errorf("bad slot error = %v, want field slot", resp)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"strconv"
+	"time"
+)
+
+type EjectResult struct {
+	Slot        int    `json:"slot"`
+	PowerBankID string `json:"powerBankID,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// handleEjectAll выдает все занятые слоты по кэшированному инвентарю,
+// запрашивая его у станции, если кэша еще нет
+func handleEjectAll(ctx context.Context, w http.ResponseWriter, station *Station, token, caller string) {
+	version := station.Version()
+
+	inventory := station.cachedInventory()
+	if inventory == nil {
+		payload, err := protocol.CreateCommand("query_power_bank", token, "", version)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		msg, err := sendAndWait(ctx, station, "query_power_bank", payload, cfg.ReplyTimeout)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrReplyTimeout) {
+				status = http.StatusGatewayTimeout
+			} else if s := canceledStatus(err); s != 0 {
+				status = s
+			}
+			writeJSONError(w, status, fmt.Sprintf("Failed to query inventory: %v", err))
+			return
+		}
+		inventory = msg.Inventory
+	}
+
+	results := make([]EjectResult, 0, len(inventory))
+	for i, entry := range inventory {
+		if i > 0 {
+			// Даем мотору закончить предыдущую выдачу
+			select {
+			case <-time.After(cfg.EjectAllDelay):
+			case <-ctx.Done():
+			}
+		}
+		// Клиент ушел - оставшиеся слоты не трогаем
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, ejectSlot(ctx, station, token, caller, entry))
+	}
+
+	ejected := 0
+	for _, res := range results {
+		if res.Status == "ejected" {
+			ejected++
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"stationID": station.ID,
+		"command":   "eject_all",
+		"total":     len(results),
+		"ejected":   ejected,
+		"results":   results,
+	})
+}
+
+func ejectSlot(ctx context.Context, station *Station, token, caller string, entry protocol.SlotEntry) EjectResult {
+	slot := strconv.Itoa(int(entry.Slot))
+	res := EjectResult{Slot: int(entry.Slot), PowerBankID: entry.PowerBankID}
+
+	release, ok := lockSlot(station.ID, slot)
+	if !ok {
+		res.Status, res.Error = "error", "slot busy with another rent/eject"
+		return res
+	}
+	defer release()
+
+	payload, err := protocol.CreateCommand("eject", token, slot, station.Version())
+	if err != nil {
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+
+	audit := store.AuditEntry{
+		StationID: station.ID,
+		Command:   "eject",
+		Slot:      slot,
+		Caller:    caller,
+		Payload:   fmt.Sprintf("%x", payload),
+	}
+
+	msg, err := sendAndWait(ctx, station, "eject", payload, cfg.ReplyTimeout)
+	switch {
+	case err != nil:
+		res.Status, res.Error = "error", err.Error()
+	case msg.SlotResult != nil && msg.SlotResult.Success:
+		res.Status = "ejected"
+	default:
+		res.Status = "failed"
+	}
+
+	audit.Result, audit.Error = res.Status, res.Error
+	recordAudit(audit)
+	return res
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+// Станция с двумя занятыми слотами получает ровно две выдачи
+func TestEjectAll(t *testing.T) {
+	keepConfig(t)
+	cfg.EjectAllDelay = 0
+
+	p := newTestPeer(t)
+	p.login(t, "EJECTALL1", protocol.Version1)
+	received := p.emulate(testProfile())
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=EJECTALL1&cmd=eject_all", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeJSON(t, rec); resp["total"] != float64(2) || resp["ejected"] != float64(2) {
+		t.Errorf("response = %v, want 2 of 2 ejected", resp)
+	}
+
+	var ejected []byte
+	for _, frame := range received() {
+		if frame[2] == protocol.CmdEject {
+			ejected = append(ejected, frame[9:]...)
+		}
+	}
+	if string(ejected) != "\x01\x03" {
+		t.Errorf("ejected slots = %x, want 01 03", ejected)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"server/internal/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseSlotResults разбирает "2:0,5:0x02" - слот и result byte, который
+// эмулятор вернет на rent/eject для этого слота
+func parseSlotResults(s string) (map[uint16]byte, error) {
+	results := make(map[uint16]byte)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		slotStr, resultStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid slot result entry %q, expected slot:result", pair)
+		}
+		slot, err := strconv.ParseUint(strings.TrimSpace(slotStr), 10, 16)
+		if err != nil || slot == 0 {
+			return nil, fmt.Errorf("invalid slot in %q: must be 1-65535", pair)
+		}
+		result, err := strconv.ParseUint(strings.TrimSpace(resultStr), 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid result in %q: must be a byte", pair)
+		}
+		results[uint16(slot)] = byte(result)
+	}
+	return results, nil
+}
+
+// parseInventory разбирает "1:RL1H|001:4,3:RL1H|003" - слот, ID
+// повербанка и необязательный уровень заряда, которые держит эмулятор
+func parseInventory(s string) ([]protocol.SlotEntry, error) {
+	var entries []protocol.SlotEntry
+	seen := make(map[byte]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid inventory entry %q, expected slot:powerBankID[:level]", item)
+		}
+		slot, err := strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 8)
+		if err != nil || slot == 0 {
+			return nil, fmt.Errorf("invalid slot in %q: must be 1-255", item)
+		}
+		if seen[byte(slot)] {
+			return nil, fmt.Errorf("slot %d listed twice", slot)
+		}
+		seen[byte(slot)] = true
+		id := strings.TrimSpace(fields[1])
+		if id == "" || len(id) > 8 {
+			return nil, fmt.Errorf("invalid power bank ID in %q: must be 1-8 bytes", item)
+		}
+		e := protocol.SlotEntry{Slot: byte(slot), PowerBankID: id}
+		if len(fields) == 3 {
+			level, err := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid level in %q: must be a byte", item)
+			}
+			e.Level = byte(level)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func applySlotResults(results map[uint16]byte) {
+	protocol.ResetSlotResults()
+	for slot, result := range results {
+		protocol.SetSlotResult(slot, result)
+	}
+}
+
+// runEmulator - режим -emulate: процесс подключается к серверу как
+// станция, логинится и отвечает на команды. При обрыве переподключается.
+func runEmulator() {
+	token, err := protocol.ParseToken(cfg.EmulateToken)
+	if err != nil {
+		log.Fatalf("Invalid -emulate-token: %v", err)
+	}
+	version := byte(cfg.EmulateVersion)
+	if !protocol.SupportsVersion(version) {
+		log.Fatalf("Invalid -emulate-version: %d", cfg.EmulateVersion)
+	}
+
+	for {
+		err := emulateSession(token, version)
+		slog.Warn("emulator disconnected, reconnecting", "target", cfg.EmulateTarget, "error", err, "delay", cfg.EmulateReconnect)
+		time.Sleep(cfg.EmulateReconnect)
+	}
+}
+
+func emulateSession(token []byte, version byte) error {
+	c, err := net.Dial("tcp", cfg.EmulateTarget)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	payload := protocol.LoginPayload{
+		Rand:        []byte{0x01, 0x02, 0x03, 0x04},
+		Magic:       0x1234,
+		BoxID:       cfg.EmulateBoxID,
+		HardwareRev: "H6",
+		SlotCount:   cfg.EmulateSlots,
+	}
+	if protocol.LoginAuthEnabled() {
+		payload.Magic = protocol.ExpectedMagic(payload.Rand)
+	}
+	login := protocol.LoginFrame(payload, token, version)
+	if _, err := writeFrame(c, login, cfg.WriteTimeout); err != nil {
+		return err
+	}
+	slog.Info("emulator logged in", "target", cfg.EmulateTarget, "box_id", cfg.EmulateBoxID, "version", version)
+
+	profile := protocol.Profile{Firmware: cfg.EmulateFirmware, ICCID: cfg.EmulateICCID, SlotCount: cfg.EmulateSlots}
+
+	heartbeat, err := protocol.CreateCommand("heartbeat", cfg.EmulateToken, "", version)
+	if err != nil {
+		return err
+	}
+	// Запись из двух горутин: heartbeat и ответы на команды
+	var writeMu sync.Mutex
+	write := func(frame []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := writeFrame(c, frame, cfg.WriteTimeout)
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if cfg.EmulateHeartbeat > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.EmulateHeartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := write(heartbeat); err != nil {
+						c.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	buf := make([]byte, 0, 4096)
+	chunk := make([]byte, 1024)
+	for {
+		n, err := c.Read(chunk)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, chunk[:n]...)
+
+		// Сервер может склеить несколько кадров в одно чтение
+		for {
+			if err := protocol.CheckPackLen(buf, cfg.MaxFrameSize); len(buf) >= 2 && err != nil {
+				return err
+			}
+			size := protocol.FrameLen(buf)
+			if size == 0 {
+				break
+			}
+			frame := buf[:size]
+			if resp := protocol.EmulateResponse(frame, profile); resp != nil {
+				slog.Info("emulator replying", "cmd", fmt.Sprintf("0x%02x", frame[2]), "hex", fmt.Sprintf("%x", resp))
+				if err := write(resp); err != nil {
+					return err
+				}
+			}
+			buf = buf[size:]
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+// Эмулятор подключается к настоящему TCP серверу, логинится и выдает
+// повербанк по rent
+func TestEmulatorRentRoundTrip(t *testing.T) {
+	keepConfig(t)
+	inventory := protocol.DefaultSlots.Inventory()
+	t.Cleanup(func() { protocol.DefaultSlots.Set(inventory) })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- serveTCP(l, nil) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	cfg.EmulateTarget = l.Addr().String()
+	cfg.EmulateBoxID = "EMUTEST1"
+	cfg.EmulateHeartbeat = 0
+	token, _ := protocol.ParseToken(cfg.EmulateToken)
+	session := make(chan error, 1)
+	go func() { session <- emulateSession(token, protocol.Version1) }()
+
+	var station *Station
+	eventually(t, "emulator registered", func() bool {
+		var ok bool
+		station, ok = lookupStation("EMUTEST1", "")
+		return ok
+	})
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=EMUTEST1&cmd=rent&slot=1&sync=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rent: status %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeJSON(t, rec)
+	slot, _ := resp["slotResult"].(map[string]interface{})
+	if resp["status"] != "success" || slot["success"] != true || slot["powerBankID"] != "RL1H|001" {
+		t.Errorf("rent response = %v", resp)
+	}
+
+	// Сервер рвет соединение - сессия эмулятора завершается
+	station.Conn.Close()
+	if err := <-session; err == nil {
+		t.Errorf("emulator session ended without an error")
+	}
+	// Обработчик соединения читает cfg до самого выхода
+	eventually(t, "connection closed", func() bool { return openConnections.Load() == 0 })
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Ошибки всех обработчиков - JSON с полем error и нужным статусом
+func TestJSONErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+	}{
+		{"send without station", handleSendCommand, http.MethodGet, "/send?cmd=rent&slot=1", "", http.StatusBadRequest},
+		{"send unknown station", handleSendCommand, http.MethodGet, "/send?stationID=NOSUCH&cmd=rent&slot=1", "", http.StatusBadRequest},
+		{"bulk via GET", handleBulkSend, http.MethodGet, "/send/bulk", "", http.StatusMethodNotAllowed},
+		{"bulk bad JSON", handleBulkSend, http.MethodPost, "/send/bulk", "{", http.StatusBadRequest},
+		{"decode bad hex", handleDecode, http.MethodPost, "/decode", `{"hex":"zz"}`, http.StatusBadRequest},
+		{"encode via GET", handleEncode, http.MethodGet, "/encode", "", http.StatusMethodNotAllowed},
+		{"macro via GET", handleMacro, http.MethodGet, "/macro", "", http.StatusMethodNotAllowed},
+		{"station detail", handleStation, http.MethodGet, "/stations/NOSUCH", "", http.StatusNotFound},
+		{"station action", handleStation, http.MethodGet, "/stations/NOSUCH/bogus", "", http.StatusNotFound},
+		{"stats via POST", handleStats, http.MethodPost, "/stats", "", http.StatusMethodNotAllowed},
+		{"server info via POST", handleServerInfo, http.MethodPost, "/server/info", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(tt.handler, tt.method, tt.target, tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			if msg, _ := decodeJSON(t, rec)["error"].(string); msg == "" {
+				t.Errorf("no error message: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSendBodyValidated(t *testing.T) {
+	tests := []struct {
+		name, body, field, msg string
+	}{
+		{"unknown field", `{"station_id":"BODY1","cmd":"rent","slott":"1"}`, "slott", `unknown field "slott"`},
+		{"wrong type", `{"station_id":"BODY1","cmd":"rent","slot":1}`, "slot", `field "slot" must be a string, got number`},
+		{"wrong type bool", `{"station_id":"BODY1","cmd":"rent","wait":"yes"}`, "wait", `field "wait" must be a boolean, got string`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handleSendCommand(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body.String())
+			}
+			resp := decodeJSON(t, rec)
+			if msg, _ := resp["error"].(string); resp["field"] != tt.field || !strings.Contains(msg, tt.msg) {
+				t.Errorf("error = %v, want field %s and %q", resp, tt.field, tt.msg)
+			}
+		})
+	}
+}
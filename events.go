@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/ws"
+	"sync"
+	"time"
+)
+
+// Event - событие для внешних потребителей: вебхук и /ws/events
+type Event struct {
+	Type      string      `json:"type"`
+	StationID string      `json:"stationID"`
+	Time      time.Time   `json:"time"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// Типы событий
+const (
+	EventSlotOccupied = "slot_occupied"
+	EventSlotEmpty    = "slot_empty"
+	EventReturned     = "power_bank_returned"
+	EventChecksum     = "checksum_failures"
+	// Станция перелогинилась после restart / не вернулась за -restart-grace
+	EventRestarted      = "station_restarted"
+	EventRestartTimeout = "restart_timeout"
+	// Аномалия протокола, поток /ws/errors
+	EventProtocolError = "protocol_error"
+)
+
+// Виды аномалий в событии EventProtocolError
+const (
+	anomalyPackLen       = "invalid_pack_len"
+	anomalyChecksum      = "checksum_failure"
+	anomalyUnknown       = "unknown_command"
+	anomalyLoginRejected = "login_rejected"
+)
+
+// SlotChange - данные событий занятости слота
+type SlotChange struct {
+	Slot        byte   `json:"slot"`
+	PowerBankID string `json:"powerBankID,omitempty"`
+	Level       byte   `json:"level,omitempty"`
+}
+
+// ReturnInfo - данные события возврата повербанка
+type ReturnInfo struct {
+	protocol.PowerBankReturn
+	Accepted bool `json:"accepted"`
+}
+
+// ChecksumAlert - данные события о битых checksum от станции
+type ChecksumAlert struct {
+	Failures int `json:"failures"`
+}
+
+// ProtocolAnomaly - данные события EventProtocolError
+type ProtocolAnomaly struct {
+	Kind      string `json:"kind"`
+	SessionID string `json:"sessionID"`
+	Cmd       string `json:"cmd,omitempty"`
+	Frame     string `json:"frame"`
+	Error     string `json:"error,omitempty"`
+}
+
+// publishAnomaly публикует аномалию кадра от станции. До логина stationID
+// пустой, соединение узнается по sessionID.
+func publishAnomaly(stationID, sessionID, kind string, frame []byte, err error) {
+	a := ProtocolAnomaly{Kind: kind, SessionID: sessionID, Frame: fmt.Sprintf("%x", frame)}
+	if len(frame) >= 3 {
+		a.Cmd = fmt.Sprintf("0x%02x", frame[2])
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	publish(Event{Type: EventProtocolError, StationID: stationID, Data: a})
+}
+
+// Политики для переполненного буфера подписчика
+const (
+	dropNewest = "newest" // теряется новое событие
+	dropOldest = "oldest" // теряется самое старое событие из буфера
+)
+
+// subscriber получает события через буфер на cfg.EventBuffer событий.
+// Медленный подписчик теряет события, но не задерживает чтение из станции.
+type subscriber struct {
+	name   string
+	ch     chan Event
+	filter func(Event) bool
+}
+
+var (
+	subsMu      sync.Mutex
+	subscribers = make(map[*subscriber]struct{})
+)
+
+// subscribe регистрирует подписчика; filter nil - все события. name
+// попадает в метрику потерянных событий.
+func subscribe(name string, filter func(Event) bool) (<-chan Event, func()) {
+	size := cfg.EventBuffer
+	if size < 1 {
+		size = 1
+	}
+	sub := &subscriber{name: name, ch: make(chan Event, size), filter: filter}
+	subsMu.Lock()
+	subscribers[sub] = struct{}{}
+	subsMu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			subsMu.Lock()
+			delete(subscribers, sub)
+			subsMu.Unlock()
+		})
+	}
+	return sub.ch, cancel
+}
+
+// publish раздает событие подписчикам без блокировки
+func publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	for sub := range subscribers {
+		if sub.filter != nil && !sub.filter(ev) {
+			continue
+		}
+		sub.offer(ev)
+	}
+}
+
+// offer кладет событие в буфер, не блокируясь
+func (sub *subscriber) offer(ev Event) {
+	select {
+	case sub.ch <- ev:
+		return
+	default:
+	}
+	if cfg.EventDropPolicy == dropOldest {
+		// Освобождаем место; если подписчик успел вычитать сам, тоже хорошо
+		select {
+		case <-sub.ch:
+			eventsDropped.Inc(sub.name)
+		default:
+		}
+		select {
+		case sub.ch <- ev:
+			return
+		default:
+		}
+	}
+	eventsDropped.Inc(sub.name)
+	slog.Debug("event subscriber is full, dropping event", "subscriber", sub.name, "type", ev.Type, "station_id", ev.StationID)
+}
+
+// runWebhook отправляет каждое событие POST запросом на cfg.WebhookURL,
+// с -webhook-batch - пачками, см. runWebhookBatches
+func runWebhook() {
+	events, _ := subscribe("webhook", nil)
+	client := &http.Client{Timeout: cfg.WebhookTimeout}
+	if cfg.WebhookBatch > 0 {
+		runWebhookBatches(client, events)
+		return
+	}
+	for ev := range events {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Post(cfg.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Warn("webhook delivery failed", "type", ev.Type, "station_id", ev.StationID, "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("webhook rejected event", "type", ev.Type, "station_id", ev.StationID, "status", resp.StatusCode)
+		}
+	}
+}
+
+// handleEventsWS - поток событий по WebSocket. ?station_id и ?type
+// оставляют только события этой станции или этого типа.
+func handleEventsWS(w http.ResponseWriter, r *http.Request) {
+	serveEventsWS(w, r, "ws", r.URL.Query().Get("type"))
+}
+
+// handleErrorsWS - /ws/errors: только аномалии протокола, ?station_id
+// как в /ws/events
+func handleErrorsWS(w http.ResponseWriter, r *http.Request) {
+	serveEventsWS(w, r, "ws_errors", EventProtocolError)
+}
+
+// serveEventsWS отдает по WebSocket события типа typ (пустой - все);
+// name - имя подписчика в метрике потерянных событий
+func serveEventsWS(w http.ResponseWriter, r *http.Request, name, typ string) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	stationID := r.URL.Query().Get("station_id")
+
+	conn, err := ws.Upgrade(w, r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := subscribe(name, func(ev Event) bool {
+		return (stationID == "" || ev.StationID == stationID) && (typ == "" || ev.Type == typ)
+	})
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		conn.ReadLoop()
+		close(done)
+	}()
+
+	for {
+		select {
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if err := conn.WriteText(data, cfg.WriteTimeout); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// slotChanges сравнивает два снимка инвентаря. Без предыдущего снимка
+// изменений нет: неизвестно, что было в слотах раньше.
+func slotChanges(prev, next []protocol.SlotEntry) []Event {
+	if prev == nil || next == nil {
+		return nil
+	}
+	before, after := occupiedSlots(prev), occupiedSlots(next)
+
+	var events []Event
+	for _, e := range next {
+		if _, ok := after[e.Slot]; !ok {
+			continue
+		}
+		if old, ok := before[e.Slot]; ok && old.PowerBankID == e.PowerBankID {
+			continue
+		}
+		events = append(events, Event{Type: EventSlotOccupied, Data: SlotChange{Slot: e.Slot, PowerBankID: e.PowerBankID, Level: e.Level}})
+	}
+	for _, e := range prev {
+		if _, ok := before[e.Slot]; !ok {
+			continue
+		}
+		if _, ok := after[e.Slot]; !ok {
+			events = append(events, Event{Type: EventSlotEmpty, Data: SlotChange{Slot: e.Slot, PowerBankID: e.PowerBankID}})
+		}
+	}
+	return events
+}
+
+// occupiedSlots - слоты с повербанком; запись без ID считается пустым слотом
+func occupiedSlots(inventory []protocol.SlotEntry) map[byte]protocol.SlotEntry {
+	slots := make(map[byte]protocol.SlotEntry, len(inventory))
+	for _, e := range inventory {
+		if e.PowerBankID != "" {
+			slots[e.Slot] = e
+		}
+	}
+	return slots
+}
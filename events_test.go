@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+// Второй инвентарь отличается одним слотом - событие только по нему
+func TestSlotChangeEvents(t *testing.T) {
+	events, cancel := subscribe("test", func(ev Event) bool { return ev.StationID == "SLOTEV1" })
+	defer cancel()
+	station, _ := fakeStation(t, "SLOTEV1", protocol.Version1)
+
+	station.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: testToken, Inventory: []protocol.SlotEntry{
+		{Slot: 1, PowerBankID: "RL1H|001", Level: 4}, {Slot: 3, PowerBankID: "RL1H|003", Level: 2},
+	}})
+	station.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: testToken, Inventory: []protocol.SlotEntry{
+		{Slot: 1, PowerBankID: "RL1H|001", Level: 4}, {Slot: 2, PowerBankID: "RL1H|002", Level: 1}, {Slot: 3, PowerBankID: "RL1H|003", Level: 2},
+	}})
+
+	select {
+	case ev := <-events:
+		want := SlotChange{Slot: 2, PowerBankID: "RL1H|002", Level: 1}
+		if ev.Type != EventSlotOccupied || !reflect.DeepEqual(ev.Data, want) {
+			t.Errorf("event = %s %+v, want slot_occupied %+v", ev.Type, ev.Data, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no slot event")
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %s %+v", ev.Type, ev.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Подписчик, который не читает события, не останавливает чтение из
+// станции: лишние события теряются и считаются в метрике
+func TestStalledSubscriber(t *testing.T) {
+	keepConfig(t)
+	cfg.EventBuffer = 1
+	// Счетчик глобальный: свое имя подписчика на каждый запуск теста
+	name := fmt.Sprintf("stalled%d", time.Now().UnixNano())
+	_, cancel := subscribe(name, nil)
+	defer cancel()
+
+	p := newTestPeer(t)
+	p.login(t, "STALL1", protocol.Version1)
+	for i := 0; i < 5; i++ {
+		bad := heartbeatFrame(t, protocol.Version1)
+		bad[4] ^= 0xFF
+		p.send(t, bad)
+	}
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Fatalf("reply cmd = 0x%02x, want heartbeat", resp[2])
+	}
+	if got := scrapeMetric(t, fmt.Sprintf("events_dropped_total{subscriber=%q}", name)); got != "4" {
+		t.Errorf("dropped events = %s, want 4", got)
+	}
+}
+
+// Кадр с неверной checksum попадает в поток ошибок с ID сессии и кадром
+func TestChecksumAnomalyEvent(t *testing.T) {
+	errs, cancel := subscribe("test", func(ev Event) bool { return ev.Type == EventProtocolError && ev.StationID == "ANOMALY1" })
+	defer cancel()
+	p := newTestPeer(t)
+	station := p.login(t, "ANOMALY1", protocol.Version1)
+
+	bad := heartbeatFrame(t, protocol.Version1)
+	bad[4] ^= 0xFF
+	p.send(t, bad)
+
+	select {
+	case ev := <-errs:
+		a, _ := ev.Data.(ProtocolAnomaly)
+		if a.Kind != anomalyChecksum || a.Cmd != "0x61" || a.SessionID != station.SessionID || a.Frame != fmt.Sprintf("%x", bad) || a.Error == "" {
+			t.Errorf("anomaly = %+v", ev.Data)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no protocol_error event for a bad checksum")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"server/internal/protocol"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeAddr - адрес станции в памяти
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "mem" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// fakeConn - StationConn без сокета: команды сервера отвечает эмулятор
+// протокола с профилем profile, ответы идут в station.receive так же, как
+// кадры из handleConnection
+type fakeConn struct {
+	addr    fakeAddr
+	profile protocol.Profile
+
+	mu      sync.Mutex
+	station *Station
+	closed  bool
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	frame := append([]byte(nil), b...)
+	station := c.station
+	c.mu.Unlock()
+
+	// Отвечаем асинхронно, как настоящая станция: Write вызывается под
+	// writeMu, а ответ может сам потребовать записи
+	if resp := protocol.EmulateResponse(frame, c.profile); resp != nil && station != nil {
+		go station.receive(resp)
+	}
+	return len(b), nil
+}
+
+// returnPowerBank - пользователь вставил повербанк в слот станции в памяти.
+// Кадр возврата проходит через HandleIncoming и receive, как по TCP, а
+// ответ сервера уходит обратно эмулятору.
+func (c *fakeConn) returnPowerBank(e protocol.SlotEntry) error {
+	c.mu.Lock()
+	station := c.station
+	c.mu.Unlock()
+	if station == nil {
+		return net.ErrClosed
+	}
+
+	station.mu.Lock()
+	token := append([]byte(nil), station.token...)
+	station.mu.Unlock()
+	frame, err := protocol.EmulateReturn(c.profile, e, token, station.Version())
+	if err != nil {
+		return err
+	}
+	resp, _ := protocol.HandleIncoming(frame)
+	station.receive(frame)
+	if resp != nil {
+		if _, err := station.write(resp, cfg.WriteTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// injectFakeStation регистрирует станцию id на fakeConn, как будто она
+// залогинилась по TCP
+func injectFakeStation(id string, token []byte, version byte, profile protocol.Profile) (*Station, *fakeConn) {
+	// У каждой станции свои слоты, общая модель только задает начальные
+	if profile.Slots == nil {
+		profile.Slots = protocol.DefaultSlots.Copy()
+	}
+	conn := &fakeConn{addr: fakeAddr("mem:" + id), profile: profile}
+	station := newStation(id, conn, time.Now(), token, version)
+	station.SessionID = newSessionID()
+	conn.mu.Lock()
+	conn.station = station
+	conn.mu.Unlock()
+
+	mu.Lock()
+	prev, exists := registerStation(station)
+	mu.Unlock()
+	if exists && !cfg.MultiConn {
+		prev.Conn.Close()
+	}
+	if cfg.RefreshOnLogin {
+		go refreshInventory(station)
+	}
+	slog.Info("fake station registered", "station_id", id, "conn_id", station.ConnID, "session_id", station.SessionID)
+	return station, conn
+}
+
+// handleStationReturn - POST /stations/{id}/return?slot=N&powerBankID=ID[&level=L]:
+// возврат повербанка в станцию в памяти (-fake-stations) для тестов
+// клиентов. Настоящей станции так повербанк не вернуть.
+func handleStationReturn(w http.ResponseWriter, r *http.Request, stationID string) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST to return a power bank")
+		return
+	}
+	station, exists := lookupStation(stationID, r.URL.Query().Get("connID"))
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No station connected with ID: %s", stationID))
+		return
+	}
+	conn, ok := station.Conn.(*fakeConn)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Station %s is not an in-memory station", stationID))
+		return
+	}
+
+	q := r.URL.Query()
+	slot, err := protocol.ParseSlot(q.Get("slot"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entry := protocol.SlotEntry{Slot: slot, PowerBankID: q.Get("powerBankID")}
+	if v := q.Get("level"); v != "" {
+		level, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid level: %s", v))
+			return
+		}
+		entry.Level = byte(level)
+	}
+
+	if err := conn.returnPowerBank(entry); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, protocol.ErrSlotOccupied) {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"stationID": station.ID,
+		"slot":      entry.Slot,
+		"inventory": conn.profile.Slots.Inventory(),
+	})
+}
+
+// injectFakeStations - режим -fake-stations: n станций в памяти с токеном
+// и версией эмулятора, чтобы гонять API без сокетов и железа
+func injectFakeStations(n int) {
+	token, err := protocol.ParseToken(cfg.EmulateToken)
+	if err != nil {
+		log.Fatalf("Invalid -emulate-token: %v", err)
+	}
+	version := byte(cfg.EmulateVersion)
+	if !protocol.SupportsVersion(version) {
+		log.Fatalf("Invalid -emulate-version: %d", cfg.EmulateVersion)
+	}
+	profile := protocol.Profile{Firmware: cfg.EmulateFirmware, ICCID: cfg.EmulateICCID, SlotCount: cfg.EmulateSlots}
+	for i := 1; i <= n; i++ {
+		injectFakeStation(normalizeStationID(fmt.Sprintf("FAKE%04d", i)), token, version, profile)
+	}
+}
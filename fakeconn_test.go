@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+// Станция в памяти отвечает на rent без сокета, ответ проходит receive, а
+// выданный повербанк из слота пропадает
+func TestFakeStationRent(t *testing.T) {
+	_, conn := fakeStation(t, "FAKERENT1", protocol.Version1)
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=FAKERENT1&cmd=rent&slot=1&sync=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rent: status %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeJSON(t, rec)
+	slot, _ := resp["slotResult"].(map[string]interface{})
+	if resp["status"] != "success" || resp["delivery"] != deliveryAcknowledged || slot["success"] != true || slot["powerBankID"] != "RL1H|001" {
+		t.Errorf("rent response = %v", resp)
+	}
+	for _, e := range conn.profile.Slots.Inventory() {
+		if e.Slot == 1 {
+			t.Errorf("slot 1 after rent = %+v, want empty", e)
+		}
+	}
+}
+
+// С -refresh-on-login станция сразу после логина получает query_power_bank,
+// и кэш инвентаря заполняется без запроса клиента
+func TestInventoryRefreshedOnLogin(t *testing.T) {
+	refresh := cfg.RefreshOnLogin
+	t.Cleanup(func() { cfg.RefreshOnLogin = refresh })
+	cfg.RefreshOnLogin = true
+
+	station, _ := fakeStation(t, "REFRESH1", protocol.Version1)
+	eventually(t, "inventory cached", func() bool { return station.cachedInventory() != nil })
+	if got := station.cachedInventory(); len(got) == 0 || got[0].PowerBankID != "RL1H|001" {
+		t.Errorf("cached inventory = %+v", got)
+	}
+
+	// По TCP query_power_bank идет следующим кадром после ответа на логин
+	p := newTestPeer(t)
+	p.login(t, "REFRESH2", protocol.Version1)
+	if frame := p.next(t); frame[2] != protocol.CmdQueryPowerBank {
+		t.Errorf("frame after login = %x, want query_power_bank", frame)
+	}
+}
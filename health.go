@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var startTime = time.Now()
+
+// Состояние TCP listener для /healthz
+var (
+	listenerMu  sync.Mutex
+	listenerUp  bool
+	listenerErr error
+)
+
+func setListenerState(up bool, err error) {
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+	listenerUp, listenerErr = up, err
+}
+
+type HealthResponse struct {
+	Status     string  `json:"status"`
+	Listener   string  `json:"listener"`
+	Error      string  `json:"error,omitempty"`
+	Stations   int     `json:"stations"`
+	Uptime     float64 `json:"uptimeSeconds"`
+	Goroutines int     `json:"goroutines"`
+}
+
+// handleHealthz отвечает 503, если TCP listener не поднят: балансировщик
+// должен вывести инстанс, к которому не могут подключиться станции
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	listenerMu.Lock()
+	up, err := listenerUp, listenerErr
+	listenerMu.Unlock()
+
+	mu.RLock()
+	stations := len(connections)
+	mu.RUnlock()
+
+	resp := HealthResponse{
+		Status:     "ok",
+		Listener:   "up",
+		Stations:   stations,
+		Uptime:     time.Since(startTime).Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	status := http.StatusOK
+	if !up {
+		resp.Status, resp.Listener = "unavailable", "down"
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
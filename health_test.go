@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Порт занят: listener не поднялся, /healthz отвечает 503 с причиной
+func TestHealthzListenerDown(t *testing.T) {
+	keepConfig(t)
+	t.Cleanup(func() { setListenerState(false, nil) })
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	cfg.TCPAddr = busy.Addr().String()
+	cfg.ListenRetry = 0
+	startTCPServer()
+
+	rec := serve(handleHealthz, http.MethodGet, "/healthz", "")
+	resp := decodeJSON(t, rec)
+	if rec.Code != http.StatusServiceUnavailable || resp["listener"] != "down" || resp["error"] == nil {
+		t.Errorf("healthz = %d %v, want 503 with the listen error", rec.Code, resp)
+	}
+
+	setListenerState(true, nil)
+	if rec := serve(handleHealthz, http.MethodGet, "/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("healthz with the listener up = %d, want 200", rec.Code)
+	}
+}
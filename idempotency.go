@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idemEntry - сохраненный ответ на запрос с Idempotency-Key. done
+// закрывается, когда первый запрос завершился; cached - ответ успешный и
+// сохранен для повторов.
+type idemEntry struct {
+	done    chan struct{}
+	cached  bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+var (
+	idemMu    sync.Mutex
+	idemCache = make(map[string]*idemEntry)
+)
+
+// responseRecorder запоминает ответ, чтобы отдать его повторно
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// withIdempotency выполняет fn один раз на пару (станция, ключ) в течение
+// cfg.IdempotencyTTL. Повтор получает сохраненный ответ без новой записи
+// в сокет. Кэшируются только успешные ответы, чтобы клиент мог повторить
+// запрос после ошибки.
+func withIdempotency(w http.ResponseWriter, key, stationID string, fn func(http.ResponseWriter)) {
+	if key == "" || cfg.IdempotencyTTL <= 0 {
+		fn(w)
+		return
+	}
+	cacheKey := stationID + "\x00" + key
+
+	idemMu.Lock()
+	sweepIdempotency(time.Now())
+	if e, ok := idemCache[cacheKey]; ok {
+		idemMu.Unlock()
+		// Параллельный запрос с тем же ключом ждет результата первого
+		<-e.done
+		if !e.cached {
+			// Первый запрос неуспешен или упал, ответ не сохранен: выполняем
+			// запрос сами
+			withIdempotency(w, key, stationID, fn)
+			return
+		}
+		slog.Info("idempotent replay", "station_id", stationID, "key", key)
+		replay(w, e, true)
+		return
+	}
+	e := &idemEntry{done: make(chan struct{})}
+	idemCache[cacheKey] = e
+	idemMu.Unlock()
+	// Ждущие не должны зависнуть, даже если fn паникует
+	defer func() {
+		idemMu.Lock()
+		if !e.cached {
+			delete(idemCache, cacheKey)
+		}
+		idemMu.Unlock()
+		close(e.done)
+	}()
+
+	rec := &responseRecorder{header: make(http.Header)}
+	fn(rec)
+
+	e.status, e.header, e.body = rec.status, rec.header, rec.body.Bytes()
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	e.expires = time.Now().Add(cfg.IdempotencyTTL)
+	e.cached = e.status >= 200 && e.status <= 299
+
+	replay(w, e, false)
+}
+
+func replay(w http.ResponseWriter, e *idemEntry, replayed bool) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// sweepIdempotency удаляет просроченные записи, вызывается под idemMu
+func sweepIdempotency(now time.Time) {
+	for k, e := range idemCache {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				delete(idemCache, k)
+			}
+		default:
+		}
+	}
+}
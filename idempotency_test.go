@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"server/internal/store"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotentRentReplayed(t *testing.T) {
+	keepConfig(t)
+	cfg.IdempotencyTTL = time.Minute
+	useStore(t, store.NewMemory())
+	conn := &scriptConn{}
+	// Кэш ключей и занятые слоты живут весь процесс: своя станция и свой
+	// ключ на каждый прогон (-count)
+	run := time.Now().UnixNano()
+	id, key := fmt.Sprintf("IDEM%d", run), fmt.Sprintf("order-%d", run)
+	scriptStation(t, id, conn)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/send?stationID="+id+"&cmd=rent&slot=2", nil)
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		handleSendCommand(rec, req)
+		return rec
+	}
+
+	first := send()
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("first call: status %d: %s", first.Code, first.Body.String())
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("first call marked as replayed")
+	}
+	eventually(t, "queued rent written", func() bool { return conn.attempts() == 1 })
+	written := conn.written()
+
+	second := send()
+	if second.Code != first.Code || !bytes.Equal(second.Body.Bytes(), first.Body.Bytes()) {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body.String(), first.Code, first.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay not marked with Idempotent-Replayed")
+	}
+	// Повтор в очередь не попадает; даем ей время, если бы попал
+	time.Sleep(50 * time.Millisecond)
+	if conn.attempts() != 1 || !bytes.Equal(conn.written(), written) {
+		t.Errorf("replay wrote to the station again: %d writes", conn.attempts())
+	}
+}
+
+// idemKey - свой ключ на каждый прогон: кэш живет весь процесс
+func idemKey(name string) string {
+	return fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+}
+
+// Параллельный запрос не получает чужую ошибку как повтор: неуспешный
+// ответ не сохраняется, и ждущий выполняет запрос сам
+func TestIdempotentWaiterRetriesAfterError(t *testing.T) {
+	keepConfig(t)
+	cfg.IdempotencyTTL = time.Minute
+	key := idemKey("fail")
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	go withIdempotency(httptest.NewRecorder(), key, "IDEMERR1", func(w http.ResponseWriter) {
+		close(started)
+		<-finish
+		writeJSONError(w, http.StatusBadGateway, "station disconnected")
+	})
+	<-started
+
+	var calls atomic.Int32
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		withIdempotency(rec, key, "IDEMERR1", func(w http.ResponseWriter) {
+			calls.Add(1)
+			w.Write([]byte(`{"status":"success"}`))
+		})
+		done <- rec
+	}()
+	// Даем второму запросу встать в ожидание первого
+	time.Sleep(20 * time.Millisecond)
+	close(finish)
+
+	select {
+	case rec := <-done:
+		if calls.Load() != 1 || rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("waiter after an error: calls %d, status %d, replayed %q", calls.Load(), rec.Code, rec.Header().Get("Idempotent-Replayed"))
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("waiter still blocked")
+	}
+}
+
+// Паника первого запроса не оставляет ждущих висеть
+func TestIdempotentWaiterAfterPanic(t *testing.T) {
+	keepConfig(t)
+	cfg.IdempotencyTTL = time.Minute
+	key := idemKey("panic")
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		withIdempotency(httptest.NewRecorder(), key, "IDEMPANIC1", func(w http.ResponseWriter) {
+			close(started)
+			<-finish
+			panic("handler failed")
+		})
+	}()
+	<-started
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		withIdempotency(rec, key, "IDEMPANIC1", func(w http.ResponseWriter) {
+			w.Write([]byte(`{"status":"success"}`))
+		})
+		done <- rec
+	}()
+	// Даем второму запросу встать в ожидание первого
+	time.Sleep(20 * time.Millisecond)
+	close(finish)
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK {
+			t.Errorf("waiter after a panic: status %d", rec.Code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("waiter blocked after the first request panicked")
+	}
+}
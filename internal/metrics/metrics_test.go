@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	c := NewCounter("test_frames_total", "Frames.")
+	c.Inc()
+	c.Add(2)
+	v := NewCounterVec("test_commands_total", "Commands.", "cmd")
+	v.Inc("rent")
+	v.Inc(`a"b`)
+	h := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1})
+	h.Observe(0.5)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE test_frames_total counter\ntest_frames_total 3\n",
+		`test_commands_total{cmd="a\"b"} 1`,
+		`test_commands_total{cmd="rent"} 1`,
+		`test_duration_seconds_bucket{le="0.1"} 0`,
+		`test_duration_seconds_bucket{le="1"} 1`,
+		`test_duration_seconds_bucket{le="+Inf"} 1`,
+		"test_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition missing %q:\n%s", want, body)
+		}
+	}
+}
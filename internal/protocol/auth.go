@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"server/internal/metrics"
+)
+
+// LoginSecret - общий ключ станций. Если задан, Magic в Login должен
+// совпадать с ExpectedMagic(Rand), иначе логин отклоняется.
+var LoginSecret []byte
+
+var loginAuthFailures = metrics.NewCounter("station_login_auth_failures_total", "Logins rejected because Magic did not match the shared secret.")
+
+// ExpectedMagic - первые два байта HMAC-SHA256(LoginSecret, Rand)
+func ExpectedMagic(rand []byte) uint16 {
+	mac := hmac.New(sha256.New, LoginSecret)
+	mac.Write(rand)
+	return binary.BigEndian.Uint16(mac.Sum(nil))
+}
+
+// LoginAuthEnabled - проверяется ли Magic при логине
+func LoginAuthEnabled() bool {
+	return len(LoginSecret) > 0
+}
+
+func verifyLogin(login *LoginPayload) bool {
+	if !LoginAuthEnabled() {
+		return true
+	}
+	return ExpectedMagic(login.Rand) == login.Magic
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Cmd байты протокола. Одним байтом обозначаются и команда сервера, и
+// ответ станции на нее.
+const (
+	CmdLogin          byte = 0x60
+	CmdHeartbeat      byte = 0x61
+	CmdQueryFirmware  byte = 0x62
+	CmdSetServer      byte = 0x63
+	CmdQueryPowerBank byte = 0x64
+	CmdRent           byte = 0x65
+	CmdReturn         byte = 0x66
+	CmdRestart        byte = 0x67
+	CmdQueryCycles    byte = 0x68
+	CmdQueryICCID     byte = 0x69
+	CmdQueryServer    byte = 0x6A
+	CmdQueryStatus    byte = 0x6B
+	CmdQueryCapacity  byte = 0x6C
+	CmdQueryTime      byte = 0x6D
+	CmdSetTime        byte = 0x6E
+	CmdSetVoice       byte = 0x70
+	CmdSetBrightness  byte = 0x71
+	CmdGetVoice       byte = 0x77
+	CmdEject          byte = 0x80
+	CmdUnlockAll      byte = 0x81
+	CmdMultiEject     byte = 0x82
+)
+
+// Границы payload set_server: AddressLen(2) + Address\0 + PortLen(2) +
+// Port\0 + Interval(1), адрес - DNS имя до 253 байт, порт до 5 цифр
+const (
+	MinSetServerPayload = 2 + 2 + 2 + 2 + 1
+	MaxSetServerPayload = 2 + 254 + 2 + 6 + 1
+)
+
+// MaxMultiEjectSlots - сколько слотов выдает один кадр multi_eject
+const MaxMultiEjectSlots = 32
+
+// Допустимые часы шкафа для set_time: все, что вне диапазона, - явно не
+// то время, которое хотели поставить
+var (
+	MinCabinetTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	MaxCabinetTime = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Допустимая длина payload команды сервера в байтах, [min, max]. Команды
+// без записи payload не несут.
+var commandPayloadLimits = map[byte][2]int{
+	CmdQueryPowerBank: {0, 1},
+	CmdRent:           {1, 2},
+	CmdEject:          {1, 2},
+	CmdSetVoice:       {1, 1},
+	CmdSetBrightness:  {1, 1},
+	CmdSetServer:      {MinSetServerPayload, MaxSetServerPayload},
+	CmdSetTime:        {4, 4},
+	CmdMultiEject:     {2, 1 + MaxMultiEjectSlots},
+}
+
+// ValidateCommandPayload проверяет длину payload команды сервера cmd:
+// длиннее границы - ErrPayloadTooLarge, короче - ErrBadPayload
+func ValidateCommandPayload(cmd byte, payload []byte) error {
+	limits := commandPayloadLimits[cmd]
+	n := len(payload)
+	switch {
+	case n > limits[1] && limits[1] == 0:
+		return fmt.Errorf("%w: %s takes no payload, got %d bytes", ErrPayloadTooLarge, CommandName(cmd), n)
+	case n > limits[1]:
+		return fmt.Errorf("%w: %s payload is %d bytes, limit %d", ErrPayloadTooLarge, CommandName(cmd), n, limits[1])
+	case n < limits[0]:
+		return fmt.Errorf("%w: %s payload must be at least %d bytes, got %d", ErrBadPayload, CommandName(cmd), limits[0], n)
+	}
+	return nil
+}
+
+// Имена команд по cmd байту. Имена команд сервера совпадают с именами в
+// /send, login и return_power_bank шлет только станция.
+var commandNames = map[byte]string{
+	CmdLogin:          "login",
+	CmdHeartbeat:      "heartbeat",
+	CmdQueryFirmware:  "query_fw",
+	CmdSetServer:      "set_server",
+	CmdQueryPowerBank: "query_power_bank",
+	CmdRent:           "rent",
+	CmdReturn:         "return_power_bank",
+	CmdRestart:        "restart",
+	CmdQueryCycles:    "query_cycles",
+	CmdQueryICCID:     "query_iccid",
+	CmdQueryServer:    "query_server",
+	CmdQueryStatus:    "query_status",
+	CmdQueryCapacity:  "query_capacity",
+	CmdQueryTime:      "query_time",
+	CmdSetTime:        "set_time",
+	CmdSetVoice:       "voice_set",
+	CmdSetBrightness:  "set_brightness",
+	CmdGetVoice:       "voice_get",
+	CmdEject:          "eject",
+	CmdUnlockAll:      "unlock_all",
+	CmdMultiEject:     "multi_eject",
+}
+
+// Обратное отображение имя -> cmd байт
+var commandBytes = func() map[string]byte {
+	m := make(map[string]byte, len(commandNames))
+	for b, name := range commandNames {
+		m[name] = b
+	}
+	return m
+}()
+
+// CommandName возвращает имя команды или "unknown"
+func CommandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// CommandByte возвращает cmd байт по имени команды
+func CommandByte(name string) (byte, bool) {
+	b, ok := commandBytes[name]
+	return b, ok
+}
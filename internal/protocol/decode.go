@@ -0,0 +1,564 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrShortFrame  = errors.New("frame too short")
+	ErrBadChecksum = errors.New("invalid checksum")
+	ErrBadPayload  = errors.New("malformed payload")
+)
+
+type LoginPayload struct {
+	Rand    []byte `json:"rand"`
+	Magic   uint16 `json:"magic"`
+	BoxID   string `json:"boxID"`
+	ReqData []byte `json:"reqData,omitempty"`
+
+	// Поля из ReqData, если станция их прислала
+	HardwareRev string `json:"hardwareRev,omitempty"`
+	SlotCount   int    `json:"slotCount,omitempty"`
+}
+
+// Теги ReqData
+const (
+	reqTagHardwareRev = 0x01
+	reqTagSlotCount   = 0x02
+)
+
+type SlotEntry struct {
+	Slot        byte   `json:"slot"`
+	PowerBankID string `json:"powerBankID"`
+	Level       byte   `json:"level"`
+}
+
+// SlotResult - ответ станции на rent (0x65) и eject (0x80):
+// Slot(1) + Result(1) + PowerBankID(8), в v2 Slot может занимать 2 байта
+type SlotResult struct {
+	Slot    uint16 `json:"slot"`
+	Result  byte   `json:"result"`
+	Success bool   `json:"success"`
+	// Расшифровка Result, см. SlotResultMeaning
+	Meaning     string `json:"meaning"`
+	PowerBankID string `json:"powerBankID,omitempty"`
+}
+
+// SlotResultMeaning - человекочитаемое значение result byte rent/eject
+func SlotResultMeaning(result byte) string {
+	switch result {
+	case SlotResultSuccess:
+		return "power bank released"
+	case SlotResultFailed:
+		return "failed: slot empty or lock did not open"
+	case ResultUnsupported:
+		return "command not supported by station"
+	}
+	return fmt.Sprintf("unknown result 0x%02x", result)
+}
+
+// FirmwareVersion - ответ на query_fw (0x62) вида "RL1,H6,08,14":
+// модель, ревизия платы, major и minor. Raw хранится всегда; остальные поля
+// заполняются, только если строка в ожидаемом формате (Parsed).
+type FirmwareVersion struct {
+	Raw         string `json:"raw"`
+	Parsed      bool   `json:"parsed"`
+	Model       string `json:"model,omitempty"`
+	HardwareRev string `json:"hardwareRev,omitempty"`
+	Major       int    `json:"major"`
+	Minor       int    `json:"minor"`
+}
+
+// CabinetStatus - ответ на query_status (0x6B):
+// Temperature(1, int8 °C) + DoorState(1, 0 - закрыта) + FaultFlags(1)
+type CabinetStatus struct {
+	Temperature int8     `json:"temperature"`
+	DoorOpen    bool     `json:"doorOpen"`
+	FaultFlags  byte     `json:"faultFlags"`
+	Faults      []string `json:"faults,omitempty"`
+}
+
+// PowerBankCycles - запись ответа на query_cycles (0x68): сколько циклов
+// заряда прошел повербанк в слоте
+type PowerBankCycles struct {
+	Slot        byte   `json:"slot"`
+	PowerBankID string `json:"powerBankID"`
+	Cycles      uint16 `json:"cycles"`
+}
+
+// Capacity - ответ на query_capacity (0x6C): Total(2, BE) - слотов в
+// шкафу, Occupied(2, BE) - из них с повербанком
+type Capacity struct {
+	Total    int `json:"total"`
+	Occupied int `json:"occupied"`
+}
+
+// HeartbeatStatus - состояние шкафа, которое часть прошивок кладет в
+// payload heartbeat (0x61): Temperature(1, int8 °C) + DoorState(1, 0 -
+// закрыта) + ErrorCode(1, 0 - нет ошибки)
+type HeartbeatStatus struct {
+	Temperature int8 `json:"temperature"`
+	DoorOpen    bool `json:"doorOpen"`
+	ErrorCode   byte `json:"errorCode"`
+}
+
+// ServerConfig - ответ на query_server (0x6A) в формате payload set_server:
+// AddressLen(2) + Address\0 + PortLen(2) + Port\0 + Interval(1)
+type ServerConfig struct {
+	Address  string `json:"address"`
+	Port     string `json:"port"`
+	Interval byte   `json:"interval"`
+}
+
+// Биты FaultFlags
+var cabinetFaults = []struct {
+	bit  byte
+	name string
+}{
+	{0x01, "fan"},
+	{0x02, "overheat"},
+	{0x04, "lock"},
+	{0x08, "power"},
+}
+
+// DecodedMessage - разобранный кадр от станции. Заполняются только поля,
+// относящиеся к команде.
+type DecodedMessage struct {
+	Cmd      byte   `json:"cmd"`
+	Version  byte   `json:"version"`
+	Checksum uint16 `json:"checksum"`
+	Token    []byte `json:"token"`
+	Payload  []byte `json:"payload,omitempty"`
+
+	Login           *LoginPayload    `json:"login,omitempty"`
+	Firmware        string           `json:"firmware,omitempty"`
+	FirmwareVersion *FirmwareVersion `json:"firmwareVersion,omitempty"`
+	ICCID           string           `json:"iccid,omitempty"`
+	Inventory       []SlotEntry      `json:"inventory,omitempty"`
+	// Инвентарь большого шкафа пришел не целиком: следом идет продолжение
+	InventoryMore bool             `json:"inventoryMore,omitempty"`
+	Status        *CabinetStatus   `json:"status,omitempty"`
+	Capacity      *Capacity        `json:"capacity,omitempty"`
+	Heartbeat     *HeartbeatStatus `json:"heartbeat,omitempty"`
+	Server        *ServerConfig    `json:"server,omitempty"`
+	// Результаты по слотам из ответа на multi_eject
+	SlotResults []SlotResult `json:"slotResults,omitempty"`
+	// Циклы заряда повербанков из ответа на query_cycles
+	Cycles []PowerBankCycles `json:"cycles,omitempty"`
+	// Часы шкафа из ответа на query_time
+	Time       *time.Time       `json:"time,omitempty"`
+	SlotResult *SlotResult      `json:"slotResult,omitempty"`
+	Return     *PowerBankReturn `json:"return,omitempty"`
+}
+
+// Decode разбирает кадр без формирования ответа и без побочных эффектов
+func Decode(data []byte) (DecodedMessage, error) {
+	var msg DecodedMessage
+	if len(data) < 9 {
+		return msg, ErrShortFrame
+	}
+	if err := ValidateLength(data); err != nil && StrictPackLen {
+		return msg, err
+	}
+	if !validateChecksum(data) {
+		return msg, ErrBadChecksum
+	}
+
+	msg.Cmd = data[2]
+	msg.Version = data[3]
+	if msg.Version == Version2 {
+		msg.Checksum = binary.BigEndian.Uint16(data[4:6])
+	} else {
+		msg.Checksum = uint16(data[4])
+	}
+	msg.Token, msg.Payload = splitFrame(data)
+
+	var err error
+	switch msg.Cmd {
+	case CmdLogin:
+		msg.Login, err = decodeLogin(msg.Payload)
+	case CmdQueryFirmware:
+		msg.Firmware, err = readLString(msg.Payload)
+		if err == nil {
+			msg.FirmwareVersion = parseFirmware(msg.Firmware)
+		}
+	case CmdQueryICCID:
+		msg.ICCID, err = readLString(msg.Payload)
+	case CmdQueryPowerBank:
+		msg.Inventory, msg.InventoryMore, err = decodeInventory(msg.Payload)
+	case CmdQueryStatus:
+		msg.Status, err = decodeCabinetStatus(msg.Payload)
+	case CmdHeartbeat:
+		// Обычный heartbeat без payload; payload другого формата не ошибка,
+		// сам heartbeat от этого не перестает быть heartbeat
+		msg.Heartbeat = decodeHeartbeat(msg.Payload)
+	case CmdQueryServer:
+		// Команда от сервера без payload, ответ - адрес, порт и интервал
+		if len(msg.Payload) > 0 {
+			msg.Server, err = decodeServerConfig(msg.Payload)
+		}
+	case CmdQueryCycles:
+		// Команда от сервера без payload, ответ - Count + записи
+		if len(msg.Payload) > 0 {
+			msg.Cycles, err = decodeCycles(msg.Payload)
+		}
+	case CmdQueryCapacity:
+		// Команда от сервера без payload, ответ - Total + Occupied
+		if len(msg.Payload) > 0 {
+			msg.Capacity, err = decodeCapacity(msg.Payload)
+		}
+	case CmdQueryTime:
+		// Команда от сервера без payload, ответ - Unix time(4, BE)
+		if len(msg.Payload) > 0 {
+			var t time.Time
+			if t, err = decodeTime(msg.Payload); err == nil {
+				msg.Time = &t
+			}
+		}
+	case CmdReturn:
+		// Ответ сервера на возврат - Slot + Result, его не разбираем
+		if len(msg.Payload) >= 9 {
+			msg.Return, err = decodeReturn(msg.Payload)
+		}
+	case CmdMultiEject:
+		// Команда от сервера - Count + слоты, ответ - Count + результаты
+		if len(msg.Payload) >= 1 && len(msg.Payload) == 1+int(msg.Payload[0])*10 {
+			msg.SlotResults = decodeSlotResults(msg.Payload)
+		}
+	case CmdRent, CmdEject:
+		// Команда от сервера несет только номер слота, ответ - результат
+		if len(msg.Payload) >= 2 {
+			msg.SlotResult = decodeSlotResult(msg.Payload, msg.Version)
+		}
+	}
+	return msg, err
+}
+
+func decodeLogin(p []byte) (*LoginPayload, error) {
+	// Rand(4) + Magic(2) + BoxIDLen(2) + BoxID + [ReqDataLen(2) + ReqData]
+	if len(p) < 8 {
+		return nil, fmt.Errorf("%w: login payload is %d bytes", ErrBadPayload, len(p))
+	}
+	login := &LoginPayload{
+		Rand:  p[0:4],
+		Magic: binary.BigEndian.Uint16(p[4:6]),
+	}
+	boxID, err := readLString(p[6:])
+	if err != nil {
+		return nil, err
+	}
+	login.BoxID = boxID
+
+	rest := p[8+int(binary.BigEndian.Uint16(p[6:8])):]
+	if len(rest) < 2 {
+		// ReqData необязательное поле
+		return login, nil
+	}
+	reqDataLen := int(binary.BigEndian.Uint16(rest[0:2]))
+	if len(rest)-2 < reqDataLen {
+		return login, fmt.Errorf("%w: ReqDataLen %d exceeds %d remaining bytes", ErrBadPayload, reqDataLen, len(rest)-2)
+	}
+	login.ReqData = rest[2 : 2+reqDataLen]
+	if err := parseReqData(login, login.ReqData); err != nil {
+		return login, err
+	}
+	return login, nil
+}
+
+// parseReqData разбирает метаданные устройства из ReqData.
+// Формат - последовательность TLV: Tag(1) + Len(1) + Value(Len)
+//
+//	0x01 HardwareRev - ASCII строка, например "H6"
+//	0x02 SlotCount   - uint16 BE, число слотов в шкафу
+//
+// Неизвестные теги пропускаются, чтобы новые прошивки не ломали логин.
+func parseReqData(login *LoginPayload, data []byte) error {
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return fmt.Errorf("%w: truncated ReqData tag header", ErrBadPayload)
+		}
+		tag, n := data[0], int(data[1])
+		if len(data)-2 < n {
+			return fmt.Errorf("%w: ReqData tag 0x%02x length %d exceeds %d remaining bytes", ErrBadPayload, tag, n, len(data)-2)
+		}
+		value := data[2 : 2+n]
+		switch tag {
+		case reqTagHardwareRev:
+			login.HardwareRev = trimNull(value)
+		case reqTagSlotCount:
+			if n != 2 {
+				return fmt.Errorf("%w: ReqData slot count must be 2 bytes, got %d", ErrBadPayload, n)
+			}
+			login.SlotCount = int(binary.BigEndian.Uint16(value))
+		}
+		data = data[2+n:]
+	}
+	return nil
+}
+
+// readLString читает строку вида Len(2) + bytes, отбрасывая null terminator
+func readLString(p []byte) (string, error) {
+	if len(p) < 2 {
+		return "", fmt.Errorf("%w: missing string length", ErrBadPayload)
+	}
+	n := int(binary.BigEndian.Uint16(p[0:2]))
+	if len(p) < 2+n {
+		return "", fmt.Errorf("%w: string length %d exceeds %d remaining bytes", ErrBadPayload, n, len(p)-2)
+	}
+	return trimNull(p[2 : 2+n]), nil
+}
+
+func trimNull(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// ValidICCID проверяет, что ICCID - только цифры правдоподобной длины
+// (ITU-T E.118: до 22 цифр, на практике 19-20)
+func ValidICCID(s string) bool {
+	if len(s) < 18 || len(s) > 22 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseFirmware(s string) *FirmwareVersion {
+	fw := &FirmwareVersion{Raw: s}
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return fw
+	}
+	major, err1 := strconv.Atoi(strings.TrimSpace(parts[2]))
+	minor, err2 := strconv.Atoi(strings.TrimSpace(parts[3]))
+	if err1 != nil || err2 != nil {
+		return fw
+	}
+	fw.Model = strings.TrimSpace(parts[0])
+	fw.HardwareRev = strings.TrimSpace(parts[1])
+	fw.Major, fw.Minor = major, minor
+	fw.Parsed = true
+	return fw
+}
+
+// FilterInventory оставляет только записи для слота
+func FilterInventory(entries []SlotEntry, slot byte) []SlotEntry {
+	out := []SlotEntry{}
+	for _, e := range entries {
+		if e.Slot == slot {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Флаг продолжения в конце кадра инвентаря
+const inventoryContinues byte = 0x01
+
+func decodeInventory(p []byte) ([]SlotEntry, bool, error) {
+	// RemainNum(1) + (Slot(1) + PowerBankID(8) + Level(1)) * RemainNum +
+	// [More(1)]. Большой шкаф шлет инвентарь несколькими кадрами, у всех,
+	// кроме последнего, More = 0x01. Прошивки без разбиения More не шлют.
+	if len(p) < 1 {
+		return nil, false, fmt.Errorf("%w: empty inventory payload", ErrBadPayload)
+	}
+	count := int(p[0])
+	if len(p) < 1+count*10 {
+		return nil, false, fmt.Errorf("%w: inventory declares %d entries but has %d bytes", ErrBadPayload, count, len(p)-1)
+	}
+	more := len(p) == 1+count*10+1 && p[len(p)-1] == inventoryContinues
+	entries := make([]SlotEntry, 0, count)
+	for i := 0; i < count; i++ {
+		e := p[1+i*10 : 1+(i+1)*10]
+		entries = append(entries, SlotEntry{
+			Slot:        e[0],
+			PowerBankID: trimNull(e[1:9]),
+			Level:       e[9],
+		})
+	}
+	return entries, more, nil
+}
+
+func decodeCabinetStatus(p []byte) (*CabinetStatus, error) {
+	if len(p) < 3 {
+		return nil, fmt.Errorf("%w: cabinet status is %d bytes, want 3", ErrBadPayload, len(p))
+	}
+	status := &CabinetStatus{
+		Temperature: int8(p[0]),
+		DoorOpen:    p[1] != 0,
+		FaultFlags:  p[2],
+	}
+	for _, f := range cabinetFaults {
+		if p[2]&f.bit != 0 {
+			status.Faults = append(status.Faults, f.name)
+		}
+	}
+	return status, nil
+}
+
+func decodeHeartbeat(p []byte) *HeartbeatStatus {
+	if len(p) != 3 {
+		return nil
+	}
+	return &HeartbeatStatus{
+		Temperature: int8(p[0]),
+		DoorOpen:    p[1] != 0,
+		ErrorCode:   p[2],
+	}
+}
+
+func decodeCycles(p []byte) ([]PowerBankCycles, error) {
+	// Count(1) + (Slot(1) + PowerBankID(8) + Cycles(2, BE)) * Count
+	count := int(p[0])
+	if len(p) < 1+count*11 {
+		return nil, fmt.Errorf("%w: charge cycles declare %d entries but have %d bytes", ErrBadPayload, count, len(p)-1)
+	}
+	entries := make([]PowerBankCycles, 0, count)
+	for i := 0; i < count; i++ {
+		e := p[1+i*11 : 1+(i+1)*11]
+		entries = append(entries, PowerBankCycles{
+			Slot:        e[0],
+			PowerBankID: trimNull(e[1:9]),
+			Cycles:      binary.BigEndian.Uint16(e[9:11]),
+		})
+	}
+	return entries, nil
+}
+
+func decodeCapacity(p []byte) (*Capacity, error) {
+	if len(p) != 4 {
+		return nil, fmt.Errorf("%w: capacity is %d bytes, want 4", ErrBadPayload, len(p))
+	}
+	c := &Capacity{
+		Total:    int(binary.BigEndian.Uint16(p[0:2])),
+		Occupied: int(binary.BigEndian.Uint16(p[2:4])),
+	}
+	if c.Occupied > c.Total {
+		return c, fmt.Errorf("%w: %d occupied of %d slots", ErrBadPayload, c.Occupied, c.Total)
+	}
+	return c, nil
+}
+
+func decodeTime(p []byte) (time.Time, error) {
+	if len(p) != 4 {
+		return time.Time{}, fmt.Errorf("%w: cabinet time is %d bytes, want 4", ErrBadPayload, len(p))
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(p)), 0), nil
+}
+
+func decodeServerConfig(p []byte) (*ServerConfig, error) {
+	if len(p) > MaxSetServerPayload {
+		return nil, fmt.Errorf("%w: server config is %d bytes, limit %d", ErrBadPayload, len(p), MaxSetServerPayload)
+	}
+	address, err := readLString(p)
+	if err != nil {
+		return nil, fmt.Errorf("server address: %w", err)
+	}
+	rest := p[2+int(binary.BigEndian.Uint16(p[0:2])):]
+	port, err := readLString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("server port: %w", err)
+	}
+	rest = rest[2+int(binary.BigEndian.Uint16(rest[0:2])):]
+	if len(rest) < 1 {
+		return nil, fmt.Errorf("%w: missing heartbeat interval", ErrBadPayload)
+	}
+	return &ServerConfig{Address: address, Port: port, Interval: rest[0]}, nil
+}
+
+// decodeSlotResults: Count(1) + (Slot(1) + Result(1) + PowerBankID(8)) * Count
+func decodeSlotResults(p []byte) []SlotResult {
+	count := int(p[0])
+	results := make([]SlotResult, 0, count)
+	for i := 0; i < count; i++ {
+		e := p[1+i*10 : 1+(i+1)*10]
+		results = append(results, SlotResult{
+			Slot:        uint16(e[0]),
+			Result:      e[1],
+			Success:     e[1] == SlotResultSuccess,
+			Meaning:     SlotResultMeaning(e[1]),
+			PowerBankID: trimNull(e[2:10]),
+		})
+	}
+	return results
+}
+
+func decodeSlotResult(p []byte, version byte) *SlotResult {
+	// Двухбайтовый слот узнаем по длине: 3 байта без ID или 11 с ID
+	slot, rest := uint16(p[0]), p[1:]
+	if SupportsWideSlot(version) && (len(p) == 3 || len(p) == 11) {
+		slot, rest = binary.BigEndian.Uint16(p[0:2]), p[2:]
+	}
+	res := &SlotResult{
+		Slot:    slot,
+		Result:  rest[0],
+		Success: rest[0] == SlotResultSuccess,
+		Meaning: SlotResultMeaning(rest[0]),
+	}
+	if len(rest) >= 9 {
+		res.PowerBankID = trimNull(rest[1:9])
+	}
+	return res
+}
+
+// Команды, на которые у handleFrame есть ветка
+var handledCommands = map[byte]bool{
+	CmdLogin: true, CmdHeartbeat: true, CmdQueryFirmware: true, CmdSetServer: true,
+	CmdQueryPowerBank: true, CmdRent: true, CmdReturn: true, CmdRestart: true,
+	CmdQueryICCID: true, CmdQueryStatus: true, CmdSetVoice: true, CmdSetBrightness: true,
+	CmdGetVoice: true, CmdEject: true, CmdUnlockAll: true, CmdQueryServer: true,
+	CmdQueryTime: true, CmdSetTime: true, CmdQueryCapacity: true,
+	CmdQueryCycles: true, CmdMultiEject: true,
+}
+
+// IsHandledCommand сообщает, знает ли сервер входящую команду cmd
+func IsHandledCommand(cmd byte) bool {
+	return handledCommands[cmd]
+}
+
+// Inspection - результат отладочного разбора кадра
+type Inspection struct {
+	Command       string          `json:"command"`
+	Fields        *FrameFields    `json:"fields,omitempty"`
+	LengthValid   bool            `json:"lengthValid"`
+	ChecksumValid bool            `json:"checksumValid"`
+	Decoded       *DecodedMessage `json:"decoded,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// Inspect разбирает кадр тем же путем, что и Decode, но не останавливается
+// на первой ошибке: поля заголовка и проверки возвращаются даже для битого
+// кадра. Метрики и состояние не затрагиваются.
+func Inspect(data []byte) Inspection {
+	var in Inspection
+	if len(data) < 5 || len(data) < headerLen(data[3]) {
+		in.Command = "unknown"
+		in.Error = ErrShortFrame.Error()
+		return in
+	}
+
+	in.Command = CommandName(data[2])
+	fields := Breakdown(data)
+	in.Fields = &fields
+	in.LengthValid = ValidateLength(data) == nil
+	in.ChecksumValid = validateChecksum(data)
+
+	msg, err := Decode(data)
+	if err != nil {
+		in.Error = err.Error()
+		if errors.Is(err, ErrBadChecksum) || errors.Is(err, ErrLengthMismatch) {
+			return in
+		}
+	}
+	in.Decoded = &msg
+	return in
+}
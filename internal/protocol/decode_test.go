@@ -0,0 +1,331 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// loginPayload собирает Rand + Magic + BoxID и, если reqData не nil, ReqData
+func loginPayload(boxID string, reqData []byte) []byte {
+	p := []byte{1, 2, 3, 4, 0x12, 0x34}
+	p = binary.BigEndian.AppendUint16(p, uint16(len(boxID)))
+	p = append(p, boxID...)
+	if reqData != nil {
+		p = binary.BigEndian.AppendUint16(p, uint16(len(reqData)))
+		p = append(p, reqData...)
+	}
+	return p
+}
+
+func TestDecodeLoginReqData(t *testing.T) {
+	// HardwareRev "H6", неизвестный тег 0x7F, SlotCount 12
+	reqData := []byte{0x01, 0x03, 'H', '6', 0x00, 0x7F, 0x01, 0xAA, 0x02, 0x02, 0x00, 0x0C}
+	login, err := decodeLogin(loginPayload("BOX1", reqData))
+	if err != nil {
+		t.Fatalf("decodeLogin: %v", err)
+	}
+	if login.BoxID != "BOX1" || login.Magic != 0x1234 || login.HardwareRev != "H6" || login.SlotCount != 12 {
+		t.Errorf("login = %+v", login)
+	}
+
+	login, err = decodeLogin(loginPayload("BOX1", nil))
+	if err != nil || login.BoxID != "BOX1" || login.ReqData != nil {
+		t.Errorf("login without ReqData = %+v, %v", login, err)
+	}
+}
+
+func TestDecodeLoginTruncatedReqData(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"tag value cut", loginPayload("BOX1", []byte{0x01, 0x05, 'H', '6'})},
+		{"tag header cut", loginPayload("BOX1", []byte{0x02})},
+		{"slot count width", loginPayload("BOX1", []byte{0x02, 0x01, 0x0C})},
+		{"ReqDataLen past end", loginPayload("BOX1", []byte{0x01, 0x02, 'H', '6'})[:16]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, err := decodeLogin(tt.payload)
+			if !errors.Is(err, ErrBadPayload) {
+				t.Fatalf("err = %v, want ErrBadPayload", err)
+			}
+			// BoxID разобран до ReqData, станция все равно опознается
+			if login == nil || login.BoxID != "BOX1" {
+				t.Errorf("login = %+v, want BoxID kept", login)
+			}
+		})
+	}
+}
+
+func TestDecodeCabinetStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    CabinetStatus
+	}{
+		{"normal", []byte{25, 0, 0}, CabinetStatus{Temperature: 25}},
+		{"negative temperature", []byte{0xF6, 1, 0x03}, CabinetStatus{Temperature: -10, DoorOpen: true, FaultFlags: 0x03, Faults: []string{"fan", "overheat"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Decode(buildFrame(CmdQueryStatus, Version1, testToken, tt.payload))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(*msg.Status, tt.want) {
+				t.Errorf("status = %+v, want %+v", *msg.Status, tt.want)
+			}
+		})
+	}
+
+	if _, err := Decode(buildFrame(CmdQueryStatus, Version1, testToken, []byte{25, 0})); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("short status: err = %v, want ErrBadPayload", err)
+	}
+}
+
+// Ответ станции на query_fw сервер не переспрашивает
+func TestFirmwareReplyNotAnswered(t *testing.T) {
+	if resp, _ := HandleIncoming(buildFrame(CmdQueryFirmware, Version1, testToken, lstring("RL1,H6,08,14"))); resp != nil {
+		t.Errorf("HandleIncoming(firmware reply) replied %x, want no reply", resp)
+	}
+	if resp, _ := HandleIncoming(buildFrame(CmdQueryFirmware, Version1, testToken, nil)); resp == nil {
+		t.Errorf("query_fw request left without a reply")
+	}
+}
+
+func TestICCIDReplyNotAnswered(t *testing.T) {
+	if resp, _ := HandleIncoming(buildFrame(CmdQueryICCID, Version1, testToken, lstring("89860416121880245965"))); resp != nil {
+		t.Errorf("HandleIncoming(ICCID reply) replied %x, want no reply", resp)
+	}
+}
+
+func TestDecodeFirmwareVersion(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want FirmwareVersion
+	}{
+		{"RL1,H6,08,14", FirmwareVersion{Raw: "RL1,H6,08,14", Parsed: true, Model: "RL1", HardwareRev: "H6", Major: 8, Minor: 14}},
+		{"V2.3-beta", FirmwareVersion{Raw: "V2.3-beta"}},
+		{"RL1,H6,x,14", FirmwareVersion{Raw: "RL1,H6,x,14"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			msg, err := Decode(buildFrame(CmdQueryFirmware, Version1, testToken, lstring(tt.raw)))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if msg.Firmware != tt.raw || msg.FirmwareVersion == nil || *msg.FirmwareVersion != tt.want {
+				t.Errorf("firmware = %q, %+v, want %+v", msg.Firmware, msg.FirmwareVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyLoginMagic(t *testing.T) {
+	defer func() { LoginSecret = nil }()
+	LoginSecret = []byte("secret")
+	rnd := []byte{1, 2, 3, 4}
+	// HMAC-SHA256("secret", 01020304) начинается с faf2
+	if got := ExpectedMagic(rnd); got != 0xFAF2 {
+		t.Fatalf("ExpectedMagic = %04x, want faf2", got)
+	}
+	if !verifyLogin(&LoginPayload{Rand: rnd, Magic: 0xFAF2}) {
+		t.Errorf("valid Magic rejected")
+	}
+	if verifyLogin(&LoginPayload{Rand: rnd, Magic: 0x1234}) {
+		t.Errorf("invalid Magic accepted")
+	}
+
+	LoginSecret = nil
+	if !verifyLogin(&LoginPayload{Rand: rnd, Magic: 0x1234}) {
+		t.Errorf("Magic checked without a secret")
+	}
+}
+
+func TestReturnResult(t *testing.T) {
+	defer func() { ReturnPolicy = nil }()
+	ret := func(status ...byte) []byte {
+		payload := append([]byte{5}, padPowerBankID([]byte("RL1H|005"))...)
+		return buildFrame(CmdReturn, Version1, testToken, append(payload, status...))
+	}
+	tests := []struct {
+		name   string
+		frame  []byte
+		policy func(PowerBankReturn) byte
+		want   byte
+	}{
+		{"accepted", ret(), nil, ReturnAccepted},
+		{"seating problem", ret(0x02), nil, ReturnFailed},
+		{"server NACK", ret(), func(PowerBankReturn) byte { return ReturnFailed }, ReturnFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ReturnPolicy = tt.policy
+			resp, _ := HandleIncoming(tt.frame)
+			if want := buildFrame(CmdReturn, Version1, testToken, []byte{5, tt.want}); !bytes.Equal(resp, want) {
+				t.Errorf("reply = %x, want %x", resp, want)
+			}
+		})
+	}
+
+	// Отклоненный повербанк эмулируемая станция выталкивает из слота
+	profile := Profile{Slots: NewSlotModel(nil)}
+	frame, err := EmulateReturn(profile, SlotEntry{Slot: 5, PowerBankID: "RL1H|005"}, testToken, Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReturnPolicy = func(PowerBankReturn) byte { return ReturnFailed }
+	resp, _ := HandleIncoming(frame)
+	EmulateResponse(resp, profile)
+	if inv := profile.Slots.Inventory(); len(inv) != 0 {
+		t.Errorf("rejected power bank still in the slot: %+v", inv)
+	}
+}
+
+func TestQueryServer(t *testing.T) {
+	frame, err := CreateCommand("query_server", "11223344", "", Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x00, 0x07, CmdQueryServer, Version1, 0x00, 0x11, 0x22, 0x33, 0x44}; !bytes.Equal(frame, want) {
+		t.Errorf("query_server = %x, want %x", frame, want)
+	}
+
+	payload := append(lstring("charge.example.com"), lstring("9000")...)
+	payload = append(payload, 30)
+	msg, err := Decode(buildFrame(CmdQueryServer, Version1, testToken, payload))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if want := (ServerConfig{Address: "charge.example.com", Port: "9000", Interval: 30}); msg.Server == nil || *msg.Server != want {
+		t.Errorf("server = %+v, want %+v", msg.Server, want)
+	}
+	if resp, _ := HandleIncoming(buildFrame(CmdQueryServer, Version1, testToken, payload)); resp != nil {
+		t.Errorf("query_server reply answered with %x", resp)
+	}
+	if _, err := Decode(buildFrame(CmdQueryServer, Version1, testToken, payload[:len(payload)-1])); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("reply without interval: err = %v, want ErrBadPayload", err)
+	}
+}
+
+func TestDecodeHeartbeat(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    *HeartbeatStatus
+	}{
+		{"plain", nil, nil},
+		// -5 °C, дверь открыта, ошибка 0x03
+		{"with status", []byte{0xFB, 0x01, 0x03}, &HeartbeatStatus{Temperature: -5, DoorOpen: true, ErrorCode: 0x03}},
+		{"unknown format", []byte{0x01, 0x02}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Decode(buildFrame(CmdHeartbeat, Version1, testToken, tt.payload))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(msg.Heartbeat, tt.want) {
+				t.Errorf("heartbeat = %+v, want %+v", msg.Heartbeat, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeInventoryParts(t *testing.T) {
+	first := []SlotEntry{{Slot: 1, PowerBankID: "RL1H|001", Level: 4}, {Slot: 2, PowerBankID: "RL1H|002", Level: 3}}
+	last := []SlotEntry{{Slot: 3, PowerBankID: "RL1H|003", Level: 1}}
+
+	msg, err := Decode(buildFrame(CmdQueryPowerBank, Version1, testToken, append(inventoryPayload(first), inventoryContinues)))
+	if err != nil || !msg.InventoryMore || !reflect.DeepEqual(msg.Inventory, first) {
+		t.Errorf("first part = %+v more=%v, %v", msg.Inventory, msg.InventoryMore, err)
+	}
+	msg, err = Decode(buildFrame(CmdQueryPowerBank, Version1, testToken, inventoryPayload(last)))
+	if err != nil || msg.InventoryMore || !reflect.DeepEqual(msg.Inventory, last) {
+		t.Errorf("last part = %+v more=%v, %v", msg.Inventory, msg.InventoryMore, err)
+	}
+}
+
+func TestCabinetTime(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	frame, err := CreateCommand("set_time", "11223344", strconv.FormatInt(at.Unix(), 10), Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload := splitFrame(frame)
+	if want := binary.BigEndian.AppendUint32(nil, uint32(at.Unix())); !bytes.Equal(payload, want) {
+		t.Errorf("set_time payload = %x, want %x", payload, want)
+	}
+	for _, bad := range []string{"2019", "noon", strconv.FormatInt(MaxCabinetTime.Unix(), 10)} {
+		if _, err := CreateCommand("set_time", "11223344", bad, Version1); !errors.Is(err, ErrInvalidTime) {
+			t.Errorf("set_time %s: err = %v, want ErrInvalidTime", bad, err)
+		}
+	}
+
+	// Ответ на query_time - те же 4 байта
+	msg, err := Decode(buildFrame(CmdQueryTime, Version1, testToken, payload))
+	if err != nil || msg.Time == nil || !msg.Time.Equal(at) {
+		t.Errorf("query_time reply = %v, %v, want %s", msg.Time, err, at)
+	}
+	if _, err := Decode(buildFrame(CmdQueryTime, Version1, testToken, payload[:3])); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("3-byte time: err = %v, want ErrBadPayload", err)
+	}
+}
+
+func TestQueryCapacity(t *testing.T) {
+	frame, err := CreateCommand("query_capacity", "11223344", "", Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x00, 0x07, CmdQueryCapacity, Version1, 0x00, 0x11, 0x22, 0x33, 0x44}; !bytes.Equal(frame, want) {
+		t.Errorf("query_capacity = %x, want %x", frame, want)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    *Capacity
+		err     error
+	}{
+		{"12 of 24", []byte{0x00, 0x18, 0x00, 0x0C}, &Capacity{Total: 24, Occupied: 12}, nil},
+		{"truncated", []byte{0x00, 0x18, 0x00}, nil, ErrBadPayload},
+		{"more occupied than total", []byte{0x00, 0x08, 0x00, 0x09}, nil, ErrBadPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Decode(buildFrame(CmdQueryCapacity, Version1, testToken, tt.payload))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.want != nil && (msg.Capacity == nil || *msg.Capacity != *tt.want) {
+				t.Errorf("capacity = %+v, want %+v", msg.Capacity, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryCycles(t *testing.T) {
+	frame, err := CreateCommand("query_cycles", "11223344", "", Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x00, 0x07, CmdQueryCycles, Version1, 0x00, 0x11, 0x22, 0x33, 0x44}; !bytes.Equal(frame, want) {
+		t.Errorf("query_cycles = %x, want %x", frame, want)
+	}
+
+	want := []PowerBankCycles{{Slot: 1, PowerBankID: "RL1H|001", Cycles: 150}, {Slot: 4, PowerBankID: "RL1H|004", Cycles: 1024}}
+	msg, err := Decode(buildFrame(CmdQueryCycles, Version1, testToken, cyclesPayload(want)))
+	if err != nil || !reflect.DeepEqual(msg.Cycles, want) {
+		t.Errorf("cycles = %+v, %v, want %+v", msg.Cycles, err, want)
+	}
+	truncated := cyclesPayload(want)
+	if _, err := Decode(buildFrame(CmdQueryCycles, Version1, testToken, truncated[:len(truncated)-1])); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("truncated cycles: err = %v, want ErrBadPayload", err)
+	}
+}
@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Profile - значения, которые эмулируемая станция возвращает на query_fw,
+// query_iccid и query_capacity, и содержимое ее слотов. Slots nil - общий
+// DefaultSlots.
+type Profile struct {
+	Firmware  string
+	ICCID     string
+	SlotCount int
+	Slots     *SlotModel
+}
+
+// DefaultProfile используется в ответах HandleIncoming
+var DefaultProfile = Profile{
+	Firmware:  "RL1,H6,08,14",
+	ICCID:     "89860416121880245965",
+	SlotCount: 12,
+}
+
+// SlotModel - какие повербанки лежат в слотах эмулируемой станции.
+// inventory отвечает по ней, а rent/eject выдают повербанк, который
+// действительно лежит в слоте, и слот после этого пустеет.
+type SlotModel struct {
+	mu    sync.Mutex
+	slots map[byte]SlotEntry
+}
+
+// NewSlotModel возвращает модель с повербанками entries
+func NewSlotModel(entries []SlotEntry) *SlotModel {
+	m := &SlotModel{}
+	m.Set(entries)
+	return m
+}
+
+// Set заменяет содержимое всех слотов
+func (m *SlotModel) Set(entries []SlotEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.slots = make(map[byte]SlotEntry, len(entries))
+	for _, e := range entries {
+		m.slots[e.Slot] = e
+	}
+}
+
+// Inventory - занятые слоты по возрастанию номера
+func (m *SlotModel) Inventory() []SlotEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]SlotEntry, 0, len(m.slots))
+	for _, e := range m.slots {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Slot < entries[j].Slot })
+	return entries
+}
+
+// Insert кладет повербанк в слот, как при возврате. Занятый слот -
+// ErrSlotOccupied.
+func (m *SlotModel) Insert(e SlotEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.slots[e.Slot]; ok {
+		return fmt.Errorf("%w: slot %d holds %s", ErrSlotOccupied, e.Slot, old.PowerBankID)
+	}
+	m.slots[e.Slot] = e
+	return nil
+}
+
+// take вынимает повербанк из слота; false, если слот пуст
+func (m *SlotModel) take(slot uint16) (SlotEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slot > 0xFF {
+		return SlotEntry{}, false
+	}
+	e, ok := m.slots[byte(slot)]
+	delete(m.slots, byte(slot))
+	return e, ok
+}
+
+// Copy - независимая модель с тем же содержимым
+func (m *SlotModel) Copy() *SlotModel {
+	return NewSlotModel(m.Inventory())
+}
+
+// EmulateReturn - эмулируемая станция принимает повербанк в слот: кладет
+// его в модель profile и собирает кадр return_power_bank (0x66) серверу.
+// Если сервер отклонит возврат, EmulateResponse вытолкнет повербанк обратно.
+func EmulateReturn(profile Profile, e SlotEntry, token []byte, version byte) ([]byte, error) {
+	if e.Slot == 0 || e.PowerBankID == "" || len(e.PowerBankID) > 8 {
+		return nil, fmt.Errorf("%w: returned power bank needs a slot and a 1-8 byte ID", ErrBadPayload)
+	}
+	if err := profile.slots().Insert(e); err != nil {
+		return nil, err
+	}
+	payload := append([]byte{e.Slot}, padPowerBankID([]byte(e.PowerBankID))...)
+	return buildFrame(CmdReturn, version, token, payload), nil
+}
+
+// DefaultSlots - слоты эмулятора по умолчанию: повербанки в слотах 1 и 3
+var DefaultSlots = NewSlotModel([]SlotEntry{
+	{Slot: 1, PowerBankID: "RL1H|001", Level: 4}, // 81-100%
+	{Slot: 3, PowerBankID: "RL1H|003", Level: 2}, // 41-60%
+})
+
+func (p Profile) slots() *SlotModel {
+	if p.Slots != nil {
+		return p.Slots
+	}
+	return DefaultSlots
+}
+
+// Result byte в ответах на rent/eject
+const (
+	SlotResultFailed  byte = 0x00
+	SlotResultSuccess byte = 0x01
+)
+
+// Результаты, которые эмулируемая станция возвращает на rent/eject по
+// номеру слота. Слоты без записи отвечают по SlotModel: успехом, если в
+// слоте есть повербанк.
+var (
+	emuMu          sync.Mutex
+	emuSlotResults = map[uint16]byte{}
+)
+
+// SetSlotResult задает result byte, который эмулятор вернет для слота
+func SetSlotResult(slot uint16, result byte) {
+	emuMu.Lock()
+	defer emuMu.Unlock()
+	emuSlotResults[slot] = result
+}
+
+// ResetSlotResults возвращает все слоты к ответу по умолчанию
+func ResetSlotResults() {
+	emuMu.Lock()
+	defer emuMu.Unlock()
+	emuSlotResults = map[uint16]byte{}
+}
+
+func emulatedSlotResult(slot uint16) (byte, bool) {
+	emuMu.Lock()
+	defer emuMu.Unlock()
+	r, ok := emuSlotResults[slot]
+	return r, ok
+}
+
+// emulatedSlotResponse - ответ на rent/eject: настроенный результат слота,
+// если он задан и не успех, иначе повербанк из слота по модели profile.
+// Пустой слот - SlotResultFailed. При неуспехе PowerBankID пустой: выдавать
+// нечего.
+func emulatedSlotResponse(cmd, version byte, token []byte, slot uint16, profile Profile) []byte {
+	id, result := emulatedEject(slot, profile)
+	return buildSlotResponse(cmd, version, token, slot, id, result)
+}
+
+// emulatedEject выдает повербанк из слота: ID и result byte ответа
+func emulatedEject(slot uint16, profile Profile) ([]byte, byte) {
+	if result, ok := emulatedSlotResult(slot); ok && result != SlotResultSuccess {
+		return nil, result
+	}
+	bank, ok := profile.slots().take(slot)
+	if !ok {
+		return nil, SlotResultFailed
+	}
+	return []byte(bank.PowerBankID), SlotResultSuccess
+}
+
+// LoginFrame собирает кадр Login (0x60), который шлет станция при
+// подключении. HardwareRev и SlotCount попадают в ReqData, если заданы.
+func LoginFrame(login LoginPayload, token []byte, version byte) []byte {
+	rnd := make([]byte, 4)
+	copy(rnd, login.Rand)
+
+	var req []byte
+	if login.HardwareRev != "" {
+		req = append(req, reqTagHardwareRev, byte(len(login.HardwareRev)))
+		req = append(req, login.HardwareRev...)
+	}
+	if login.SlotCount > 0 {
+		req = append(req, reqTagSlotCount, 2)
+		req = binary.BigEndian.AppendUint16(req, uint16(login.SlotCount))
+	}
+
+	payload := append(rnd, 0, 0)
+	binary.BigEndian.PutUint16(payload[4:6], login.Magic)
+	payload = append(payload, lstring(login.BoxID)...)
+	if len(req) > 0 {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(req)))
+		payload = append(payload, req...)
+	}
+	return buildFrame(CmdLogin, version, token, payload)
+}
+
+// EmulateResponse - ответ эмулируемой станции с профилем profile на кадр
+// от сервера теми же билдерами, что и HandleIncoming. Кадры, которые не являются командами
+// сервера (ack на login и heartbeat, ответы на ответы станции), остаются
+// без ответа, иначе станция и сервер отвечали бы друг другу бесконечно.
+func EmulateResponse(data []byte, profile Profile) []byte {
+	if len(data) < 9 || len(data) < headerLen(data[3]) || !validateChecksum(data) {
+		return nil
+	}
+	if data[2] == CmdReturn {
+		emulateReturnResult(data, profile)
+		return nil
+	}
+	if !isServerCommand(data) {
+		return nil
+	}
+	resp, _ := handleFrame(data, profile)
+	return resp
+}
+
+// emulateReturnResult разбирает ответ сервера на возврат Slot(1) +
+// Result(1): отклоненный повербанк станция выталкивает, слот пустеет
+func emulateReturnResult(data []byte, profile Profile) {
+	_, payload := splitFrame(data)
+	if len(payload) == 2 && payload[1] == ReturnFailed {
+		profile.slots().take(uint16(payload[0]))
+	}
+}
+
+// isServerCommand отличает команду сервера от ответа по длине payload
+func isServerCommand(data []byte) bool {
+	_, payload := splitFrame(data)
+	switch data[2] {
+	case CmdQueryFirmware, CmdRestart, CmdQueryICCID, CmdQueryStatus, CmdGetVoice, CmdUnlockAll, CmdQueryServer, CmdQueryTime, CmdQueryCapacity, CmdQueryCycles:
+		return len(payload) == 0
+	case CmdQueryPowerBank:
+		return isInventoryQuery(payload)
+	case CmdRent, CmdEject:
+		_, ok := slotField(payload, data[3])
+		return ok
+	case CmdSetVoice, CmdSetBrightness:
+		return len(payload) == 1
+	case CmdMultiEject:
+		// Count + слоты; ответ - Count + записи по 10 байт
+		return len(payload) >= 2 && len(payload) == 1+int(payload[0])
+	case CmdSetServer, CmdSetTime:
+		return len(payload) > 0
+	}
+	return false
+}
+
+// FrameLen возвращает полную длину первого кадра в data по PackLen или 0,
+// если кадр еще не пришел целиком
+func FrameLen(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	n := int(binary.BigEndian.Uint16(data[0:2])) + 2
+	if len(data) < n {
+		return 0
+	}
+	return n
+}
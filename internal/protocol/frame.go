@@ -0,0 +1,338 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Версии фрейма:
+//
+//	v1: PackLen(2) + Cmd(1) + Version(1) + CheckSum(1) + Token(4) + Payload, XOR
+//	v2: PackLen(2) + Cmd(1) + Version(1) + CheckSum(2) + Token(4) + Payload, CRC16
+//
+// По умолчанию checksum считается по Payload (см. Coverage), а PackLen -
+// длина фрейма без самого поля PackLen.
+const (
+	Version1 byte = 0x01
+	Version2 byte = 0x02
+)
+
+var (
+	ErrLengthMismatch  = errors.New("PackLen does not match frame length")
+	ErrPackLenTooSmall = errors.New("PackLen is below the minimum frame size")
+	ErrFrameTooLarge   = errors.New("PackLen exceeds the maximum frame size")
+)
+
+// NackUnknown - отвечать на неизвестную команду кадром с тем же cmd и
+// result byte ResultUnsupported, чтобы станция не повторяла ее бесконечно
+var NackUnknown = false
+
+// NackChecksum - отвечать на кадр с неверной checksum кадром с тем же cmd
+// и result byte ResultRetransmit: прошивки, которые это умеют, повторяют
+// кадр, вместо того чтобы он потерялся
+var NackChecksum = false
+
+// HeartbeatMode - чем сервер отвечает на heartbeat (0x61) станции
+type HeartbeatMode int
+
+const (
+	// HeartbeatEcho - тот же кадр обратно
+	HeartbeatEcho HeartbeatMode = iota
+	// HeartbeatAck - кадр heartbeat без payload
+	HeartbeatAck
+	// HeartbeatTime - кадр heartbeat с временем сервера: Unix time(4, BE)
+	HeartbeatTime
+)
+
+// HeartbeatReply - ответ на heartbeat. Часть прошивок ждет не эхо, а
+// время сервера.
+var HeartbeatReply = HeartbeatEcho
+
+// ParseHeartbeatMode разбирает "echo", "ack" или "time"
+func ParseHeartbeatMode(s string) (HeartbeatMode, error) {
+	switch s {
+	case "echo":
+		return HeartbeatEcho, nil
+	case "ack":
+		return HeartbeatAck, nil
+	case "time":
+		return HeartbeatTime, nil
+	}
+	return 0, fmt.Errorf("unknown heartbeat reply %q, expected echo, ack or time", s)
+}
+
+// ResultUnsupported - result byte в NACK на неизвестную команду
+const ResultUnsupported byte = 0xFF
+
+// ResultRetransmit - result byte в NACK на кадр с неверной checksum
+const ResultRetransmit byte = 0xFE
+
+// MinPackLen - PackLen самого короткого кадра: Cmd + Version + CheckSum + Token
+const MinPackLen = 7
+
+// StrictPackLen - отбрасывать фреймы, у которых PackLen не совпадает с
+// фактической длиной. Соединения станций режут поток по PackLen, так что
+// несовпадение бывает только у кадров, переданных в HandleIncoming напрямую.
+// По умолчанию выключено ради прошивок с багом в PackLen.
+var StrictPackLen = false
+
+// ValidateLength сверяет PackLen с длиной фрейма (PackLen не включает
+// само поле PackLen)
+func ValidateLength(data []byte) error {
+	if len(data) < 2 {
+		return ErrShortFrame
+	}
+	packLen := int(binary.BigEndian.Uint16(data[0:2]))
+	if packLen != len(data)-2 {
+		return fmt.Errorf("%w: PackLen %d, frame has %d bytes after it", ErrLengthMismatch, packLen, len(data)-2)
+	}
+	return nil
+}
+
+// CheckPackLen отсекает заведомо битые кадры до разбора: PackLen меньше
+// заголовка или полный кадр больше maxFrame байт
+func CheckPackLen(data []byte, maxFrame int) error {
+	if len(data) < 2 {
+		return ErrShortFrame
+	}
+	packLen := int(binary.BigEndian.Uint16(data[0:2]))
+	if packLen < MinPackLen {
+		return fmt.Errorf("%w: PackLen %d", ErrPackLenTooSmall, packLen)
+	}
+	if maxFrame > 0 && packLen+2 > maxFrame {
+		return fmt.Errorf("%w: PackLen %d, limit %d bytes", ErrFrameTooLarge, packLen, maxFrame)
+	}
+	return nil
+}
+
+// AcceptedVersions - версии, кадры которых HandleIncoming обрабатывает.
+// Кадр другой версии отбрасывается (с NackUnknown - NACK), а не
+// разбирается как v1.
+var AcceptedVersions = map[byte]bool{Version1: true, Version2: true}
+
+func SupportsVersion(version byte) bool {
+	return version == Version1 || version == Version2
+}
+
+// SupportsSlotQuery - понимает ли прошивка query_power_bank с номером
+// слота. В v1 запрос всегда по всему шкафу.
+func SupportsSlotQuery(version byte) bool {
+	return version >= Version2
+}
+
+// SupportsWideSlot - можно ли в rent/eject передать слот двумя байтами
+// (uint16 BE). Двухбайтовое поле шлем только для слотов больше 255, кадры
+// с меньшими слотами не меняются.
+func SupportsWideSlot(version byte) bool {
+	return version >= Version2
+}
+
+// MaxSlot - наибольший номер слота для rent/eject в данной версии
+func MaxSlot(version byte) int {
+	if SupportsWideSlot(version) {
+		return 0xFFFF
+	}
+	return 0xFF
+}
+
+// encodeSlot: один байт для слотов до 255, иначе два байта BE
+func encodeSlot(slot uint16) []byte {
+	if slot > 0xFF {
+		return binary.BigEndian.AppendUint16(nil, slot)
+	}
+	return []byte{byte(slot)}
+}
+
+// slotField разбирает номер слота в payload rent/eject: один байт или,
+// начиная с v2, два байта BE
+func slotField(payload []byte, version byte) (uint16, bool) {
+	switch {
+	case len(payload) == 1:
+		return uint16(payload[0]), true
+	case len(payload) == 2 && SupportsWideSlot(version):
+		return binary.BigEndian.Uint16(payload), true
+	}
+	return 0, false
+}
+
+func checksumLen(version byte) int {
+	if version == Version2 {
+		return 2
+	}
+	return 1
+}
+
+// headerLen - длина заголовка вместе с Token, т.е. смещение Payload
+func headerLen(version byte) int {
+	return 4 + checksumLen(version) + 4
+}
+
+func xorChecksum(data []byte) byte {
+	var chk byte
+	for _, b := range data {
+		chk ^= b
+	}
+	return chk
+}
+
+// crc16 - CRC-16/MODBUS (poly 0xA001 reflected, init 0xFFFF)
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ChecksumCoverage - по каким байтам фрейма считается checksum
+type ChecksumCoverage int
+
+const (
+	// CoveragePayload - только Payload, после Token
+	CoveragePayload ChecksumCoverage = iota
+	// CoverageFrame - весь фрейм после PackLen, кроме самого поля CheckSum
+	// (так считают некоторые прошивки)
+	CoverageFrame
+)
+
+// Coverage - покрытие checksum по версиям протокола. Версии без записи
+// считаются по Payload.
+var Coverage = map[byte]ChecksumCoverage{
+	Version1: CoveragePayload,
+	Version2: CoveragePayload,
+}
+
+// ParseCoverage разбирает "payload" или "frame"
+func ParseCoverage(s string) (ChecksumCoverage, error) {
+	switch s {
+	case "payload":
+		return CoveragePayload, nil
+	case "frame":
+		return CoverageFrame, nil
+	}
+	return 0, fmt.Errorf("unknown checksum coverage %q, expected payload or frame", s)
+}
+
+// checksumInput - байты, по которым считается checksum фрейма. Длина
+// фрейма должна быть не меньше headerLen.
+func checksumInput(frame []byte) []byte {
+	version := frame[3]
+	hl := headerLen(version)
+	if Coverage[version] != CoverageFrame {
+		return frame[hl:]
+	}
+	// Cmd + Version, затем Token + Payload в обход поля CheckSum
+	in := make([]byte, 0, len(frame)-2-checksumLen(version))
+	in = append(in, frame[2:4]...)
+	return append(in, frame[4+checksumLen(version):]...)
+}
+
+// putChecksum заполняет поле CheckSum уже собранного фрейма
+func putChecksum(frame []byte) {
+	in := checksumInput(frame)
+	if frame[3] == Version2 {
+		binary.BigEndian.PutUint16(frame[4:6], crc16(in))
+		return
+	}
+	frame[4] = xorChecksum(in)
+}
+
+// ChecksumValid сообщает, сходится ли checksum кадра
+func ChecksumValid(data []byte) bool {
+	return validateChecksum(data)
+}
+
+func validateChecksum(data []byte) bool {
+	if len(data) < 5 {
+		return false
+	}
+	version := data[3]
+	hl := headerLen(version)
+	if len(data) < hl {
+		return false
+	}
+
+	if version == Version2 {
+		expected := binary.BigEndian.Uint16(data[4:6])
+		calculated := crc16(checksumInput(data))
+		slog.Debug("CRC16 validation", "expected", fmt.Sprintf("0x%04x", expected), "calculated", fmt.Sprintf("0x%04x", calculated))
+		return expected == calculated
+	}
+
+	expected := data[4]
+	if len(data) > hl || Coverage[version] == CoverageFrame {
+		calculated := xorChecksum(checksumInput(data))
+		slog.Debug("checksum validation", "expected", fmt.Sprintf("0x%02x", expected), "calculated", fmt.Sprintf("0x%02x", calculated))
+		return expected == calculated
+	}
+	// Для пакетов без payload checksum должен быть 0x00
+	slog.Debug("checksum validation, no payload", "expected", "0x00", "got", fmt.Sprintf("0x%02x", expected))
+	return expected == 0x00
+}
+
+// splitFrame возвращает Token и Payload с учетом версии. Длина должна
+// быть проверена заранее через validateChecksum.
+func splitFrame(data []byte) (token, payload []byte) {
+	hl := headerLen(data[3])
+	return data[hl-4 : hl], data[hl:]
+}
+
+// FrameToken возвращает Token кадра или nil, если кадр короче заголовка
+func FrameToken(data []byte) []byte {
+	if len(data) < 4 || len(data) < headerLen(data[3]) {
+		return nil
+	}
+	token, _ := splitFrame(data)
+	return token
+}
+
+// maxPayloadLen - сколько байт payload помещается во фрейм, чтобы PackLen
+// не переполнил uint16
+func maxPayloadLen(version byte) int {
+	return 0xFFFF - (headerLen(version) - 2)
+}
+
+// buildFrame собирает фрейм, вычисляя PackLen и checksum для версии
+func buildFrame(cmd, version byte, token, payload []byte) []byte {
+	hl := headerLen(version)
+	frame := make([]byte, hl+len(payload))
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(frame)-2))
+	frame[2] = cmd
+	frame[3] = version
+	copy(frame[hl-4:hl], token)
+	copy(frame[hl:], payload)
+	putChecksum(frame)
+	return frame
+}
+
+// FrameFields - разбор фрейма по полям в hex, для отладки
+type FrameFields struct {
+	PackLen  uint16 `json:"packLen"`
+	Cmd      string `json:"cmd"`
+	Version  byte   `json:"version"`
+	Checksum string `json:"checksum"`
+	Token    string `json:"token"`
+	Payload  string `json:"payload"`
+}
+
+// Breakdown раскладывает собранный фрейм по полям заголовка
+func Breakdown(frame []byte) FrameFields {
+	hl := headerLen(frame[3])
+	return FrameFields{
+		PackLen:  binary.BigEndian.Uint16(frame[0:2]),
+		Cmd:      fmt.Sprintf("0x%02x", frame[2]),
+		Version:  frame[3],
+		Checksum: fmt.Sprintf("%x", frame[4:hl-4]),
+		Token:    fmt.Sprintf("%x", frame[hl-4:hl]),
+		Payload:  fmt.Sprintf("%x", frame[hl:]),
+	}
+}
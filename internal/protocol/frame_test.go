@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestCRC16Modbus(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+	}{
+		{"", 0xFFFF},
+		{"123456789", 0x4B37},
+		{"\x01\x04\x00\x00\x00\x01", 0xCA31},
+	}
+	for _, tt := range tests {
+		if got := crc16([]byte(tt.in)); got != tt.want {
+			t.Errorf("crc16(%q) = 0x%04x, want 0x%04x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumByVersion(t *testing.T) {
+	payload := []byte{0x01, 0x02, 0x04}
+
+	v1 := buildFrame(CmdRent, Version1, testToken, payload)
+	if v1[4] != 0x07 {
+		t.Errorf("v1 checksum = 0x%02x, want XOR 0x07", v1[4])
+	}
+	v2 := buildFrame(CmdRent, Version2, testToken, payload)
+	if got := binary.BigEndian.Uint16(v2[4:6]); got != crc16(payload) {
+		t.Errorf("v2 checksum = 0x%04x, want CRC16 0x%04x", got, crc16(payload))
+	}
+
+	for name, frame := range map[string][]byte{"v1": v1, "v2": v2} {
+		if !ChecksumValid(frame) {
+			t.Errorf("%s frame does not validate", name)
+		}
+		bad := append([]byte(nil), frame...)
+		bad[len(bad)-1] ^= 0x10
+		if ChecksumValid(bad) {
+			t.Errorf("%s frame with a corrupted payload validates", name)
+		}
+	}
+
+	// v1 без payload: checksum 0x00
+	if empty := buildFrame(CmdHeartbeat, Version1, testToken, nil); empty[4] != 0 || !ChecksumValid(empty) {
+		t.Errorf("v1 frame without payload = %x", empty)
+	}
+}
+
+// Кадр, собранный с одним покрытием, не проходит проверку с другим
+func TestChecksumCoverage(t *testing.T) {
+	defer func(prev ChecksumCoverage) { Coverage[Version1] = prev }(Coverage[Version1])
+	payload := []byte{0x01, 0x02, 0x04}
+
+	Coverage[Version1] = CoveragePayload
+	byPayload := buildFrame(CmdRent, Version1, testToken, payload)
+	Coverage[Version1] = CoverageFrame
+	byFrame := buildFrame(CmdRent, Version1, testToken, payload)
+	// Cmd, Version, Token и Payload в обход CheckSum
+	if want := xorChecksum([]byte{CmdRent, Version1, 0x11, 0x22, 0x33, 0x44, 0x01, 0x02, 0x04}); byFrame[4] != want {
+		t.Errorf("frame coverage checksum = 0x%02x, want 0x%02x", byFrame[4], want)
+	}
+
+	for _, tt := range []struct {
+		coverage ChecksumCoverage
+		own      []byte
+		other    []byte
+	}{
+		{CoveragePayload, byPayload, byFrame},
+		{CoverageFrame, byFrame, byPayload},
+	} {
+		Coverage[Version1] = tt.coverage
+		if !ChecksumValid(tt.own) {
+			t.Errorf("coverage %d: own frame %x does not validate", tt.coverage, tt.own)
+		}
+		if ChecksumValid(tt.other) {
+			t.Errorf("coverage %d: frame %x built with the other coverage validates", tt.coverage, tt.other)
+		}
+	}
+}
+
+func TestValidateLength(t *testing.T) {
+	frame := buildFrame(CmdHeartbeat, Version1, testToken, nil)
+	withPackLen := func(n int) []byte {
+		f := append([]byte(nil), frame...)
+		binary.BigEndian.PutUint16(f[0:2], uint16(len(f)-2+n))
+		return f
+	}
+
+	if err := ValidateLength(frame); err != nil {
+		t.Errorf("exact match: %v", err)
+	}
+	for name, f := range map[string][]byte{"under-length": withPackLen(3), "over-length": withPackLen(-1)} {
+		if err := ValidateLength(f); !errors.Is(err, ErrLengthMismatch) {
+			t.Errorf("%s: err = %v, want ErrLengthMismatch", name, err)
+		}
+	}
+}
+
+func TestStrictPackLen(t *testing.T) {
+	if StrictPackLen {
+		t.Fatalf("StrictPackLen is on by default")
+	}
+	frame := buildFrame(CmdHeartbeat, Version1, testToken, nil)
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(frame)))
+
+	if resp, _ := HandleIncoming(frame); resp == nil {
+		t.Errorf("mismatched PackLen dropped with StrictPackLen off")
+	}
+	StrictPackLen = true
+	defer func() { StrictPackLen = false }()
+	if resp, _ := HandleIncoming(frame); resp != nil {
+		t.Errorf("mismatched PackLen answered with StrictPackLen on: %x", resp)
+	}
+	if _, err := Decode(frame); !errors.Is(err, ErrLengthMismatch) {
+		t.Errorf("Decode: err = %v, want ErrLengthMismatch", err)
+	}
+}
+
+// На первый же кадр с неверной checksum уходит NACK с тем же cmd и Token
+func TestChecksumNack(t *testing.T) {
+	defer func(prev bool) { NackChecksum = prev }(NackChecksum)
+	for _, version := range []byte{Version1, Version2} {
+		bad := buildFrame(CmdReturn, version, testToken, []byte{0x05})
+		bad[len(bad)-1] ^= 0xFF
+
+		NackChecksum = false
+		if resp, _ := HandleIncoming(bad); resp != nil {
+			t.Errorf("v%d: reply %x with NACK disabled", version, resp)
+		}
+		NackChecksum = true
+		resp, _ := HandleIncoming(bad)
+		if want := buildFrame(CmdReturn, version, testToken, []byte{ResultRetransmit}); !bytes.Equal(resp, want) {
+			t.Errorf("v%d: NACK = %x, want %x", version, resp, want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import "sync"
+
+// Обработчики разобранных входящих кадров по cmd байту, для встраивания
+// пакета в другие Go программы без HTTP и WebSocket
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[byte][]func(DecodedMessage))
+)
+
+// RegisterHandler подписывает fn на входящие кадры с командой cmd.
+// HandleIncoming вызывает обработчики синхронно, в порядке регистрации,
+// для каждого кадра с верной checksum, который удалось разобрать, поэтому
+// fn не должен блокироваться.
+func RegisterHandler(cmd byte, fn func(DecodedMessage)) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[cmd] = append(handlers[cmd], fn)
+}
+
+// notifyHandlers разбирает кадр и отдает его обработчикам cmd, если они есть
+func notifyHandlers(data []byte) {
+	handlersMu.RLock()
+	fns := handlers[data[2]]
+	handlersMu.RUnlock()
+	if len(fns) == 0 {
+		return
+	}
+	msg, err := Decode(data)
+	if err != nil {
+		return
+	}
+	for _, fn := range fns {
+		fn(msg)
+	}
+}
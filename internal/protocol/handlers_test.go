@@ -0,0 +1,39 @@
+package protocol
+
+import "testing"
+
+func TestRegisterHandler(t *testing.T) {
+	returns := make(chan DecodedMessage, 1)
+	RegisterHandler(CmdReturn, func(msg DecodedMessage) {
+		select {
+		case returns <- msg:
+		default:
+		}
+	})
+
+	HandleIncoming(buildFrame(CmdHeartbeat, Version1, testToken, nil))
+	frame, err := EmulateReturn(testProfile(), SlotEntry{Slot: 5, PowerBankID: "RL1H|HND", Level: 3}, testToken, Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	HandleIncoming(frame)
+
+	// Обработчик синхронный: кадр уже доставлен
+	select {
+	case msg := <-returns:
+		if msg.Cmd != CmdReturn || msg.Return == nil || msg.Return.Slot != 5 || msg.Return.PowerBankID != "RL1H|HND" {
+			t.Errorf("handler got %+v", msg)
+		}
+	default:
+		t.Fatalf("handler not called for a return frame")
+	}
+
+	bad := append([]byte(nil), frame...)
+	bad[len(bad)-1] ^= 0xFF
+	HandleIncoming(bad)
+	select {
+	case msg := <-returns:
+		t.Errorf("handler called for a frame with a bad checksum: %+v", msg)
+	default:
+	}
+}
@@ -1,449 +1,794 @@
 package protocol
 
 import (
-	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"server/internal/metrics"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func xorChecksum(data []byte) byte {
-	var chk byte
-	for _, b := range data {
-		chk ^= b
+var (
+	framesReceived   = metrics.NewCounterVec("station_frames_received_total", "Frames received from stations, by command byte.", "cmd")
+	checksumFailures = metrics.NewCounter("station_checksum_failures_total", "Frames dropped because of an invalid checksum.")
+	versionRejected  = metrics.NewCounterVec("station_frames_version_rejected_total", "Frames dropped because their version byte is not accepted, by version.", "version")
+	lengthMismatches = metrics.NewCounter("station_length_mismatches_total", "Frames whose PackLen did not match the received length.")
+)
+
+// Команды, которые умеет собирать CreateCommand
+var knownCommands = []string{
+	"heartbeat",
+	"query_fw",
+	"restart",
+	"query_iccid",
+	"voice_get",
+	"query_power_bank",
+	"rent",
+	"eject",
+	"voice_set",
+	"set_server",
+	"query_server",
+	"query_status",
+	"query_capacity",
+	"query_cycles",
+	"query_time",
+	"set_time",
+	"set_brightness",
+	"unlock_all",
+	"multi_eject",
+}
+
+func KnownCommands() []string {
+	names := append([]string(nil), knownCommands...)
+	sort.Strings(names)
+	return names
+}
+
+func IsKnownCommand(cmd string) bool {
+	for _, name := range knownCommands {
+		if name == cmd {
+			return true
+		}
 	}
-	return chk
+	return false
+}
+
+// Команды, на которые станция не отвечает: heartbeat от сервера только
+// продлевает сессию
+var noReplyCommands = map[string]bool{
+	"heartbeat": true,
+}
+
+// ExpectsReply сообщает, присылает ли станция ответ на команду
+func ExpectsReply(cmd string) bool {
+	return IsKnownCommand(cmd) && !noReplyCommands[cmd]
 }
 
-func validateChecksum(data []byte) bool {
-	if len(data) < 5 {
+// Команды, доступные только начиная с определенной версии протокола.
+// Все остальные известные команды кодируются в любой поддерживаемой версии.
+var commandMinVersion = map[string]byte{
+	"multi_eject": Version2,
+}
+
+// CommandSupported сообщает, можно ли закодировать команду для станции
+// с данной версией протокола
+func CommandSupported(cmd string, version byte) bool {
+	if !SupportsVersion(version) || !IsKnownCommand(cmd) {
 		return false
 	}
-	expected := data[4]
-	// Checksum вычисляется для payload (данные после Token)
-	if len(data) > 9 {
-		calculated := xorChecksum(data[9:])
-		log.Printf("Checksum validation: expected=0x%02x, calculated=0x%02x", expected, calculated)
-		return expected == calculated
+	min, ok := commandMinVersion[cmd]
+	return !ok || version >= min
+}
+
+// parseSlot разбирает однобайтовый числовой параметр (слот, уровень
+// громкости) и проверяет диапазон [min, max]
+func parseSlot(s string, min, max int) (byte, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("must be a number between %d and %d, got %q", min, max, s)
+	}
+	return byte(v), nil
+}
+
+// parseRentSlot разбирает номер слота для rent/eject. Слоты больше 255
+// доступны только версиям с двухбайтовым полем слота.
+func parseRentSlot(s string, version byte) (uint16, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || v < 1 || v > 0xFFFF {
+		return 0, fmt.Errorf("must be a number between 1 and %d, got %q", MaxSlot(version), s)
+	}
+	if v > MaxSlot(version) {
+		return 0, fmt.Errorf("slot %d needs a two-byte slot field, protocol version %d supports 1-%d", v, version, MaxSlot(version))
 	}
-	// Для пакетов без payload checksum должен быть 0x00
-	log.Printf("No payload, checksum should be 0x00, got 0x%02x", expected)
-	return expected == 0x00
+	return uint16(v), nil
 }
 
-func CreateCommand(cmd string, tokenHex string, slotStr string) []byte {
+// ParseSlot разбирает номер слота 1-255 из параметра API. Ошибка
+// оборачивает ErrInvalidSlot.
+func ParseSlot(s string) (byte, error) {
+	slot, err := parseSlot(s, 1, 255)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidSlot, err)
+	}
+	return slot, nil
+}
+
+// ParseRentSlot разбирает слот rent/eject для версии version, как
+// CreateCommand. Ошибка оборачивает ErrInvalidSlot.
+func ParseRentSlot(s string, version byte) (uint16, error) {
+	slot, err := parseRentSlot(s, version)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidSlot, err)
+	}
+	return slot, nil
+}
+
+// ParseSlotList разбирает слоты multi_eject через запятую, "1,3,5": от 1
+// до MaxMultiEjectSlots разных слотов 1-255
+func ParseSlotList(s string) ([]byte, error) {
+	var slots []byte
+	seen := make(map[byte]bool)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		slot, err := ParseSlot(item)
+		if err != nil {
+			return nil, err
+		}
+		if seen[slot] {
+			return nil, fmt.Errorf("%w: slot %d listed twice", ErrInvalidSlot, slot)
+		}
+		seen[slot] = true
+		slots = append(slots, slot)
+	}
+	if len(slots) == 0 || len(slots) > MaxMultiEjectSlots {
+		return nil, fmt.Errorf("%w: need 1-%d slots, got %d", ErrInvalidSlot, MaxMultiEjectSlots, len(slots))
+	}
+	return slots, nil
+}
+
+var (
+	ErrUnknownCommand     = errors.New("unknown command")
+	ErrUnsupportedVersion = errors.New("command not supported by protocol version")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrInvalidSlot        = errors.New("invalid slot")
+	ErrInvalidLevel       = errors.New("invalid voice level")
+	ErrInvalidBrightness  = errors.New("invalid brightness")
+	ErrInvalidInterval    = errors.New("invalid heartbeat interval")
+	ErrInvalidAddress     = errors.New("invalid server address")
+	ErrInvalidPort        = errors.New("invalid server port")
+	ErrInvalidTime        = errors.New("invalid cabinet time")
+	ErrSlotOccupied       = errors.New("slot occupied")
+	ErrPayloadTooLarge    = errors.New("payload too large")
+
+	// Уточнения ErrInvalidToken: errors.Is(err, ErrInvalidToken) для них тоже true
+	ErrTokenFormat = fmt.Errorf("%w format", ErrInvalidToken)
+	ErrTokenLength = fmt.Errorf("%w length", ErrInvalidToken)
+)
+
+// TokenLen - длина Token во фрейме в байтах
+const TokenLen = 4
+
+// ParseToken разбирает токен из hex. Битый hex (нечетная длина, не-hex
+// символ) и неверная длина возвращают разные ошибки.
+func ParseToken(tokenHex string) ([]byte, error) {
 	token, err := hex.DecodeString(tokenHex)
-	if err != nil || len(token) != 4 {
-		log.Printf("Invalid token: %v", err)
-		return nil
+	var invalid hex.InvalidByteError
+	switch {
+	case errors.As(err, &invalid):
+		pos := strings.IndexByte(tokenHex, byte(invalid))
+		return nil, fmt.Errorf("%w: non-hex character %q at position %d in %q", ErrTokenFormat, rune(invalid), pos+1, tokenHex)
+	case errors.Is(err, hex.ErrLength):
+		return nil, fmt.Errorf("%w: odd number of hex characters (%d) in %q", ErrTokenFormat, len(tokenHex), tokenHex)
+	case err != nil:
+		return nil, fmt.Errorf("%w: %v", ErrTokenFormat, err)
 	}
+	if len(token) != TokenLen {
+		return nil, fmt.Errorf("%w: must be %d bytes (%d hex characters), got %d bytes in %q", ErrTokenLength, TokenLen, TokenLen*2, len(token), tokenHex)
+	}
+	return token, nil
+}
 
-	buf := &bytes.Buffer{}
-	cmdByte := byte(0x00)
+// Форматы записи токена на входе CreateCommandParams
+const (
+	TokenHex    = "hex"
+	TokenBase64 = "base64"
+	// Четыре десятичных октета через точку, как IPv4: "18.52.86.120"
+	TokenDotted = "dotted"
+)
+
+// ParseTokenFormat разбирает токен в формате format, пустой format - hex.
+// Длина проверяется после декодирования для любого формата.
+func ParseTokenFormat(s, format string) ([]byte, error) {
+	var token []byte
+	switch format {
+	case "", TokenHex:
+		return ParseToken(s)
+	case TokenBase64:
+		var err error
+		token, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad base64 in %q: %v", ErrTokenFormat, s, err)
+		}
+	case TokenDotted:
+		for _, part := range strings.Split(strings.TrimSpace(s), ".") {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || n > 255 {
+				return nil, fmt.Errorf("%w: octet %q in %q must be a number between 0 and 255", ErrTokenFormat, part, s)
+			}
+			token = append(token, byte(n))
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown token format %q, use %s, %s or %s", ErrTokenFormat, format, TokenHex, TokenBase64, TokenDotted)
+	}
+	if len(token) != TokenLen {
+		return nil, fmt.Errorf("%w: must be %d bytes, got %d bytes in %s token %q", ErrTokenLength, TokenLen, len(token), format, s)
+	}
+	return token, nil
+}
+
+// Params - параметры команды. Slot используется как номер слота, уровень
+// громкости, интервал heartbeat или Unix time для set_time в зависимости от
+// команды. TokenFormat -
+// формат токена (TokenHex, TokenBase64, TokenDotted), пустой - hex.
+type Params struct {
+	Slot        string
+	Address     string
+	Port        string
+	TokenFormat string
+}
+
+func CreateCommand(cmd string, tokenHex string, slotStr string, version byte) ([]byte, error) {
+	return CreateCommandParams(cmd, tokenHex, Params{Slot: slotStr}, version)
+}
+
+func CreateCommandParams(cmd string, tokenStr string, p Params, version byte) ([]byte, error) {
+	slotStr := p.Slot
+	if !IsKnownCommand(cmd) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, cmd)
+	}
+	if !CommandSupported(cmd, version) {
+		return nil, fmt.Errorf("%w %d: %s", ErrUnsupportedVersion, version, cmd)
+	}
+
+	token, err := ParseTokenFormat(tokenStr, p.TokenFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdByte := commandBytes[cmd]
 	var payload []byte
-	var packLen uint16 = 7 // Базовая длина: PackLen(2) + Cmd(1) + Version(1) + CheckSum(1) + Token(4)
 
 	switch cmd {
-	case "heartbeat":
-		cmdByte = 0x61
-	case "query_fw":
-		cmdByte = 0x62
-	case "restart":
-		cmdByte = 0x67
-	case "query_iccid":
-		cmdByte = 0x69
-	case "voice_get":
-		cmdByte = 0x77
+	case "heartbeat", "query_fw", "restart", "query_iccid", "voice_get", "query_status", "unlock_all", "query_server", "query_time", "query_capacity", "query_cycles":
+		// Без payload
 	case "query_power_bank":
-		cmdByte = 0x64
+		// Со слотом - запрос одного слота, поддерживается не всеми прошивками
+		if strings.TrimSpace(slotStr) != "" {
+			if !SupportsSlotQuery(version) {
+				return nil, fmt.Errorf("%w %d: single-slot query_power_bank", ErrUnsupportedVersion, version)
+			}
+			slot, err := ParseSlot(slotStr)
+			if err != nil {
+				return nil, err
+			}
+			payload = []byte{slot}
+		}
 	case "rent":
-		cmdByte = 0x65
-		if slotInt, err := strconv.Atoi(slotStr); err == nil && slotInt >= 1 && slotInt <= 255 {
-			payload = []byte{byte(slotInt)}
-			packLen++
-		} else {
-			log.Printf("Invalid slot for rent: %s", slotStr)
-			return nil
+		slot, err := ParseRentSlot(slotStr, version)
+		if err != nil {
+			return nil, err
 		}
+		payload = encodeSlot(slot)
 	case "eject":
-		cmdByte = 0x80
-		if slotInt, err := strconv.Atoi(slotStr); err == nil && slotInt >= 1 && slotInt <= 255 {
-			payload = []byte{byte(slotInt)}
-			packLen++
-		} else {
-			log.Printf("Invalid slot for eject: %s", slotStr)
-			return nil
+		slot, err := ParseRentSlot(slotStr, version)
+		if err != nil {
+			return nil, err
+		}
+		payload = encodeSlot(slot)
+	case "multi_eject":
+		slots, err := ParseSlotList(slotStr)
+		if err != nil {
+			return nil, err
 		}
+		payload = append([]byte{byte(len(slots))}, slots...)
 	case "voice_set":
-		cmdByte = 0x70
-		if level, err := strconv.Atoi(slotStr); err == nil && level >= 0 && level <= 15 {
-			payload = []byte{byte(level)}
-			packLen++
-		} else {
-			log.Printf("Invalid voice level: %s", slotStr)
-			return nil
+		level, err := parseSlot(slotStr, 0, 15)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidLevel, err)
 		}
+		payload = []byte{level}
+	case "set_brightness":
+		brightness, err := parseSlot(slotStr, 0, 100)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBrightness, err)
+		}
+		payload = []byte{brightness}
 	case "set_server":
-		cmdByte = 0x63
 		// Для простоты используем slotStr как heartbeat interval
-		if interval, err := strconv.Atoi(slotStr); err == nil && interval > 0 {
-			// Пример: устанавливаем тот же сервер с новым интервалом
-			address := "127.0.0.1"
-			port := "9000"
-
-			addressBytes := []byte(address)
-			addressBytes = append(addressBytes, 0x00) // null terminator
-			portBytes := []byte(port)
-			portBytes = append(portBytes, 0x00) // null terminator
-
-			payload = append(payload, byte(len(addressBytes)>>8), byte(len(addressBytes))) // AddressLen
-			payload = append(payload, addressBytes...)
-			payload = append(payload, byte(len(portBytes)>>8), byte(len(portBytes))) // PortLen
-			payload = append(payload, portBytes...)
-			payload = append(payload, byte(interval)) // Heartbeat interval
-
-			packLen += uint16(len(payload))
-		} else {
-			log.Printf("Invalid heartbeat interval: %s", slotStr)
-			return nil
+		interval, err := parseSlot(slotStr, 1, 255)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidInterval, err)
+		}
+		// По умолчанию устанавливаем тот же сервер с новым интервалом
+		address, port := p.Address, p.Port
+		if address == "" {
+			address = "127.0.0.1"
+		}
+		if port == "" {
+			port = "9000"
+		}
+		payload, err = setServerPayload(address, port, interval)
+		if err != nil {
+			return nil, err
+		}
+	case "set_time":
+		// Без времени ставим часы сервера
+		t := time.Now()
+		if strings.TrimSpace(slotStr) != "" {
+			secs, err := strconv.ParseInt(strings.TrimSpace(slotStr), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q is not a Unix timestamp", ErrInvalidTime, slotStr)
+			}
+			t = time.Unix(secs, 0)
+		}
+		payload, err = timePayload(t)
+		if err != nil {
+			return nil, err
 		}
 	default:
-		log.Printf("Unknown command: %s", cmd)
-		return nil
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, cmd)
+	}
+
+	if len(payload) > maxPayloadLen(version) {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d fit in PackLen", ErrPayloadTooLarge, len(payload), maxPayloadLen(version))
 	}
+	if err := ValidateCommandPayload(cmdByte, payload); err != nil {
+		return nil, err
+	}
+	return buildFrame(cmdByte, version, token, payload), nil
+}
 
-	// Записываем пакет
-	binary.Write(buf, binary.BigEndian, packLen)
-	buf.WriteByte(cmdByte)
-	buf.WriteByte(0x01) // Version
+// timePayload: Unix time(4, BE) в пределах MinCabinetTime..MaxCabinetTime
+func timePayload(t time.Time) ([]byte, error) {
+	if t.Before(MinCabinetTime) || !t.Before(MaxCabinetTime) {
+		return nil, fmt.Errorf("%w: %s is outside %d..%d", ErrInvalidTime, t.UTC().Format(time.RFC3339), MinCabinetTime.Year(), MaxCabinetTime.Year())
+	}
+	return binary.BigEndian.AppendUint32(nil, uint32(t.Unix())), nil
+}
 
-	// Вычисляем checksum для payload
-	var checksum byte = 0x00
-	if len(payload) > 0 {
-		checksum = xorChecksum(payload)
+// setServerPayload: AddressLen(2) + Address\0 + PortLen(2) + Port\0 + Interval(1).
+// Длины считаются в байтах UTF-8 вместе с null terminator.
+func setServerPayload(address, port string, interval byte) ([]byte, error) {
+	address = strings.TrimSpace(address)
+	// IPv6 литерал может прийти в скобках, как в URL
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		address = address[1 : len(address)-1]
+	}
+	if err := validateServerAddress(address); err != nil {
+		return nil, err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("%w: must be 1-65535, got %q", ErrInvalidPort, port)
 	}
-	buf.WriteByte(checksum)
 
-	buf.Write(token)
-	if len(payload) > 0 {
-		buf.Write(payload)
+	addressBytes := append([]byte(address), 0x00)
+	portBytes := append([]byte(port), 0x00)
+	if n := 2 + len(addressBytes) + 2 + len(portBytes) + 1; n > MaxSetServerPayload {
+		return nil, fmt.Errorf("%w: address is %d bytes, set_server payload would be %d bytes, limit %d", ErrPayloadTooLarge, len(addressBytes), n, MaxSetServerPayload)
 	}
 
-	return buf.Bytes()
+	payload := make([]byte, 0, 2+len(addressBytes)+2+len(portBytes)+1)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(addressBytes))) // AddressLen
+	payload = append(payload, addressBytes...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(portBytes))) // PortLen
+	payload = append(payload, portBytes...)
+	payload = append(payload, interval) // Heartbeat interval
+	return payload, nil
+}
+
+// validateServerAddress принимает IPv4/IPv6 литерал или DNS имя
+func validateServerAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidAddress)
+	}
+	if net.ParseIP(address) != nil {
+		return nil
+	}
+	if len(address) > 253 {
+		return fmt.Errorf("%w: hostname longer than 253 bytes", ErrInvalidAddress)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(address, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("%w: bad hostname label in %q", ErrInvalidAddress, address)
+		}
+		for _, r := range label {
+			// Не-ASCII допускаем для IDN имен, длина при этом считается в байтах
+			if !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= 0x80) {
+				return fmt.Errorf("%w: unexpected character %q in %q", ErrInvalidAddress, r, address)
+			}
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%w: label %q starts or ends with a hyphen", ErrInvalidAddress, label)
+		}
+	}
+	return nil
 }
 
 func HandleIncoming(data []byte) ([]byte, string) {
 	if len(data) < 7 {
-		log.Printf("Packet too short: %d bytes", len(data))
+		slog.Warn("dropping short frame", "len", len(data))
 		return nil, ""
 	}
 
-	packLen := binary.BigEndian.Uint16(data[0:2])
-	log.Printf("PackLen from header: %d, actual data length: %d", packLen, len(data))
+	framesReceived.Inc(fmt.Sprintf("0x%02x", data[2]))
 
-	// PackLen включает в себя весь пакет, включая поле PackLen
-	if int(packLen) != len(data) {
-		log.Printf("Packet length mismatch: expected %d, got %d", packLen, len(data))
-		// Не возвращаем ошибку, продолжаем обработку
+	if version := data[3]; !AcceptedVersions[version] {
+		versionRejected.Inc(strconv.Itoa(int(version)))
+		slog.Warn("dropping frame with unaccepted protocol version", "cmd", fmt.Sprintf("0x%02x", data[2]), "version", version, "len", len(data))
+		if NackUnknown && len(data) >= headerLen(version) {
+			// Чужую версию разбираем по раскладке v1, только чтобы взять Token
+			token, _ := splitFrame(data)
+			return buildFrame(data[2], version, token, []byte{ResultUnsupported}), ""
+		}
+		return nil, ""
+	}
+
+	if err := ValidateLength(data); err != nil {
+		lengthMismatches.Inc()
+		if StrictPackLen {
+			slog.Warn("dropping frame", "cmd", fmt.Sprintf("0x%02x", data[2]), "len", len(data), "error", err)
+			return nil, ""
+		}
+		slog.Warn("PackLen mismatch, processing anyway", "cmd", fmt.Sprintf("0x%02x", data[2]), "error", err)
 	}
 
 	if !validateChecksum(data) {
-		log.Printf("Invalid checksum")
+		slog.Warn("checksum failure", "cmd", fmt.Sprintf("0x%02x", data[2]), "len", len(data))
+		checksumFailures.Inc()
+		if NackChecksum && len(data) >= headerLen(data[3]) {
+			token, _ := splitFrame(data)
+			return buildFrame(data[2], data[3], token, []byte{ResultRetransmit}), ""
+		}
+		return nil, ""
+	}
+
+	notifyHandlers(data)
+	if data[2] == CmdUnlockAll {
+		// Подтверждение unlock_all 0x81 без payload совпадает с самой командой
+		// байт в байт. Ответ ушел бы станции новой командой, та снова открыла
+		// бы все слоты и снова подтвердила. Собирает его только эмулятор.
+		slog.Debug("unlock_all ack")
 		return nil, ""
 	}
+	return handleFrame(data, DefaultProfile)
+}
 
+// handleFrame разбирает кадр и собирает канонический ответ. Строки в
+// ответах эмулируемой станции берутся из profile.
+func handleFrame(data []byte, profile Profile) ([]byte, string) {
 	cmd := data[2]
 	version := data[3]
-	checksum := data[4]
-	token := data[5:9]
+	token, payload := splitFrame(data)
 	var stationID string
 
-	log.Printf("Handling command 0x%02x, version %d, checksum 0x%02x", cmd, version, checksum)
+	slog.Debug("handling frame", "cmd", fmt.Sprintf("0x%02x", cmd), "version", version, "checksum", fmt.Sprintf("%x", data[4:headerLen(version)-4]))
 
 	switch cmd {
-	case 0x60: // Login
-		log.Println("Received login")
-		log.Printf("Full packet: %x", data)
-
-		if len(data) >= 21 { // Минимальная длина для Login
-			rand := data[9:13]
-			magic := binary.BigEndian.Uint16(data[13:15])
-			boxIDLen := binary.BigEndian.Uint16(data[15:17])
-
-			log.Printf("Login: rand=%x, magic=0x%04x, boxIDLen=%d", rand, magic, boxIDLen)
-
-			if len(data) >= int(17+boxIDLen) {
-				boxIDBytes := data[17 : 17+boxIDLen]
-				// Убираем null terminator если он есть
-				if len(boxIDBytes) > 0 && boxIDBytes[len(boxIDBytes)-1] == 0x00 {
-					stationID = string(boxIDBytes[:len(boxIDBytes)-1])
-				} else {
-					stationID = string(boxIDBytes)
-				}
-				log.Printf("Station ID: %s", stationID)
-
-				// Проверяем есть ли еще данные (ReqDataLen + ReqData)
-				remainingPos := 17 + int(boxIDLen)
-				if len(data) > remainingPos+2 {
-					reqDataLen := binary.BigEndian.Uint16(data[remainingPos : remainingPos+2])
-					log.Printf("ReqDataLen: %d", reqDataLen)
-					if len(data) >= remainingPos+2+int(reqDataLen) {
-						reqData := data[remainingPos+2 : remainingPos+2+int(reqDataLen)]
-						log.Printf("ReqData: %x", reqData)
-					}
-				}
+	case CmdLogin: // Login
+		slog.Debug("received login", "hex", fmt.Sprintf("%x", data))
+
+		login, err := decodeLogin(payload)
+		if login != nil && !verifyLogin(login) {
+			loginAuthFailures.Inc()
+			slog.Warn("login rejected: magic mismatch", "box_id", login.BoxID, "rand", fmt.Sprintf("%x", login.Rand), "magic", fmt.Sprintf("0x%04x", login.Magic))
+			return buildLoginResponse(version, token, loginRejected), ""
+		}
+		if login != nil {
+			stationID = login.BoxID
+			slog.Debug("login", "rand", fmt.Sprintf("%x", login.Rand), "magic", fmt.Sprintf("0x%04x", login.Magic), "box_id", login.BoxID)
+			if len(login.ReqData) > 0 {
+				slog.Debug("login ReqData", "req_data", fmt.Sprintf("%x", login.ReqData), "hardware_rev", login.HardwareRev, "slot_count", login.SlotCount)
 			}
 		}
+		if err != nil {
+			// Битый ReqData не мешает регистрации по BoxID
+			slog.Warn("bad login payload", "error", err)
+		}
+
+		return buildLoginResponse(version, token, loginAccepted), stationID
+
+	case CmdHeartbeat: // Heartbeat
+		slog.Debug("received heartbeat")
+		return heartbeatResponse(data, version, token, time.Now()), ""
 
-		// Создаем ответ на Login
-		resp := bytes.NewBuffer(nil)
-		binary.Write(resp, binary.BigEndian, uint16(8))
-		resp.WriteByte(0x60) // Cmd
-		resp.WriteByte(0x01) // Version
-		resp.WriteByte(0x01) // CheckSum (XOR result of payload)
-		resp.Write(token)    // Token
-		resp.WriteByte(0x01) // Success
-
-		respBytes := resp.Bytes()
-		// Пересчитываем checksum для payload (только Result byte)
-		respBytes[4] = xorChecksum(respBytes[9:])
-		return respBytes, stationID
-
-	case 0x61: // Heartbeat
-		log.Println("Received heartbeat")
-		// Просто возвращаем тот же пакет
-		return data, ""
-
-	case 0x66: // Return Power Bank
-		if len(data) >= 18 {
-			slot := data[9]
-			powerBankID := data[10:18]
-			log.Printf("Received Return Power Bank from slot %d, ID: %x", slot, powerBankID)
-
-			resp := bytes.NewBuffer(nil)
-			binary.Write(resp, binary.BigEndian, uint16(9))
-			resp.WriteByte(0x66) // Cmd
-			resp.WriteByte(0x01) // Version
-			resp.WriteByte(0x00) // CheckSum placeholder
-			resp.Write(token)    // Token
-			resp.WriteByte(slot) // Slot
-			resp.WriteByte(0x01) // Success
-
-			respBytes := resp.Bytes()
-			respBytes[4] = xorChecksum(respBytes[9:])
-			return respBytes, ""
-		}
-
-	case 0x62: // Query Firmware Version
-		log.Println("Received query firmware version")
-		fwVersion := "RL1,H6,08,14"
-		fwVersionBytes := []byte(fwVersion)
-		fwVersionBytes = append(fwVersionBytes, 0x00) // null terminator
-		fwLen := uint16(len(fwVersionBytes))
-
-		resp := bytes.NewBuffer(nil)
-		binary.Write(resp, binary.BigEndian, uint16(7+2+fwLen))
-		resp.WriteByte(0x62) // Cmd
-		resp.WriteByte(0x01) // Version
-		resp.WriteByte(0x00) // CheckSum placeholder
-		resp.Write(token)    // Token
-		binary.Write(resp, binary.BigEndian, fwLen)
-		resp.Write(fwVersionBytes)
-
-		respBytes := resp.Bytes()
-		respBytes[4] = xorChecksum(respBytes[9:])
-		return respBytes, ""
-
-	case 0x65: // Rent Power Bank
-		if len(data) >= 10 {
-			slot := data[9]
-			log.Printf("Received rent power bank request for slot %d", slot)
-
-			powerBankID := []byte("RL1A|00d") // 8 bytes exactly
-			if len(powerBankID) < 8 {
-				// Дополняем до 8 байт
-				for len(powerBankID) < 8 {
-					powerBankID = append(powerBankID, 0x00)
-				}
-			} else if len(powerBankID) > 8 {
-				powerBankID = powerBankID[:8]
+	case CmdReturn: // Return Power Bank
+		return handleReturn(version, token, payload), ""
+
+	case CmdQueryFirmware: // Query Firmware Version
+		if len(payload) > 0 {
+			// Ответ станции на query_fw, разбирает его Decode
+			slog.Debug("query_fw reply", "len", len(payload))
+			return nil, ""
+		}
+		slog.Debug("received query_fw")
+		return buildFrame(CmdQueryFirmware, version, token, lstring(profile.Firmware)), ""
+
+	case CmdRent: // Rent Power Bank
+		if slot, ok := slotField(payload, version); ok {
+			slog.Debug("received rent", "slot", slot)
+			return emulatedSlotResponse(CmdRent, version, token, slot, profile), ""
+		}
+
+	case CmdEject: // Eject Power Bank
+		if slot, ok := slotField(payload, version); ok {
+			slog.Debug("received eject", "slot", slot)
+			return emulatedSlotResponse(CmdEject, version, token, slot, profile), ""
+		}
+
+	case CmdMultiEject: // Eject several slots
+		if len(payload) >= 2 && len(payload) == 1+int(payload[0]) {
+			slog.Debug("received multi_eject", "slots", payload[1:])
+			reply := []byte{payload[0]}
+			for _, slot := range payload[1:] {
+				id, result := emulatedEject(uint16(slot), profile)
+				reply = append(reply, slot, result)
+				reply = append(reply, padPowerBankID(id)...)
 			}
+			return buildFrame(CmdMultiEject, version, token, reply), ""
+		}
+
+	case CmdQueryICCID: // Query ICCID
+		if len(payload) > 0 {
+			// Ответ станции на query_iccid
+			slog.Debug("query_iccid reply", "len", len(payload))
+			return nil, ""
+		}
+		slog.Debug("received query_iccid")
+		return buildFrame(CmdQueryICCID, version, token, lstring(profile.ICCID)), ""
 
-			resp := bytes.NewBuffer(nil)
-			binary.Write(resp, binary.BigEndian, uint16(17))
-			resp.WriteByte(0x65)    // Cmd
-			resp.WriteByte(0x01)    // Version
-			resp.WriteByte(0x00)    // CheckSum placeholder
-			resp.Write(token)       // Token
-			resp.WriteByte(slot)    // Slot
-			resp.WriteByte(0x01)    // Success
-			resp.Write(powerBankID) // PowerBankID (8 bytes)
-
-			respBytes := resp.Bytes()
-			respBytes[4] = xorChecksum(respBytes[9:])
-			return respBytes, ""
-		}
-
-	case 0x80: // Eject Power Bank
-		if len(data) >= 10 {
-			slot := data[9]
-			log.Printf("Received eject power bank request for slot %d", slot)
-
-			powerBankID := []byte("RL1A|00d") // 8 bytes exactly
-			if len(powerBankID) < 8 {
-				for len(powerBankID) < 8 {
-					powerBankID = append(powerBankID, 0x00)
-				}
-			} else if len(powerBankID) > 8 {
-				powerBankID = powerBankID[:8]
+	case CmdGetVoice: // Get Voice Level
+		slog.Debug("received voice_get")
+		return buildFrame(CmdGetVoice, version, token, []byte{0x0e}), "" // Voice level (14)
+
+	case CmdSetVoice: // Set Voice Level
+		if len(payload) >= 1 {
+			slog.Debug("received voice_set", "level", payload[0])
+			return buildFrame(CmdSetVoice, version, token, nil), ""
+		}
+
+	case CmdSetBrightness: // Set LED brightness
+		if len(payload) >= 1 {
+			slog.Debug("received set_brightness", "percent", payload[0])
+			return buildFrame(CmdSetBrightness, version, token, nil), ""
+		}
+
+	case CmdQueryPowerBank: // Query Power Bank Information
+		if !isInventoryQuery(payload) {
+			// Ответ станции с инвентарем, в том числе пустой {0x00}
+			slog.Debug("query_power_bank reply", "len", len(payload))
+			return nil, ""
+		}
+		slog.Debug("received query_power_bank")
+
+		entries := profile.slots().Inventory()
+		if len(payload) == 1 {
+			entries = FilterInventory(entries, payload[0])
+		}
+		return buildFrame(CmdQueryPowerBank, version, token, inventoryPayload(entries)), ""
+
+	case CmdRestart: // Restart
+		slog.Debug("received restart")
+		// Просто возвращаем подтверждение
+		return buildFrame(CmdRestart, version, token, nil), ""
+
+	case CmdUnlockAll: // Unlock all slots
+		slog.Debug("received unlock_all")
+		// Power bank остаются в слотах, подтверждение без payload
+		return buildFrame(CmdUnlockAll, version, token, nil), ""
+
+	case CmdSetServer: // Set server address
+		if len(payload) >= 1 {
+			if err := ValidateCommandPayload(CmdSetServer, payload); err != nil {
+				slog.Warn("rejecting set_server", "error", err)
+				return nil, ""
 			}
+			slog.Debug("received set_server")
+			// Просто возвращаем подтверждение
+			return buildFrame(CmdSetServer, version, token, nil), ""
+		}
 
-			resp := bytes.NewBuffer(nil)
-			binary.Write(resp, binary.BigEndian, uint16(17))
-			resp.WriteByte(0x80)    // Cmd
-			resp.WriteByte(0x01)    // Version
-			resp.WriteByte(0x00)    // CheckSum placeholder
-			resp.Write(token)       // Token
-			resp.WriteByte(slot)    // Slot
-			resp.WriteByte(0x01)    // Success
-			resp.Write(powerBankID) // PowerBankID (8 bytes)
-
-			respBytes := resp.Bytes()
-			respBytes[4] = xorChecksum(respBytes[9:])
-			return respBytes, ""
-		}
-
-	case 0x69: // Query ICCID
-		log.Println("Received query ICCID")
-		iccid := "89860416121880245965"
-		iccidBytes := []byte(iccid)
-		iccidBytes = append(iccidBytes, 0x00) // null terminator
-		iccidLen := uint16(len(iccidBytes))
-
-		resp := bytes.NewBuffer(nil)
-		binary.Write(resp, binary.BigEndian, uint16(7+2+iccidLen))
-		resp.WriteByte(0x69) // Cmd
-		resp.WriteByte(0x01) // Version
-		resp.WriteByte(0x00) // CheckSum placeholder
-		resp.Write(token)    // Token
-		binary.Write(resp, binary.BigEndian, iccidLen)
-		resp.Write(iccidBytes)
-
-		respBytes := resp.Bytes()
-		respBytes[4] = xorChecksum(respBytes[9:])
-		return respBytes, ""
-
-	case 0x77: // Get Voice Level
-		log.Println("Received get voice level")
-		resp := bytes.NewBuffer(nil)
-		binary.Write(resp, binary.BigEndian, uint16(8))
-		resp.WriteByte(0x77) // Cmd
-		resp.WriteByte(0x01) // Version
-		resp.WriteByte(0x00) // CheckSum placeholder
-		resp.Write(token)    // Token
-		resp.WriteByte(0x0e) // Voice level (14)
-
-		respBytes := resp.Bytes()
-		respBytes[4] = xorChecksum(respBytes[9:])
-		return respBytes, ""
-
-	case 0x70: // Set Voice Level
-		if len(data) >= 10 {
-			level := data[9]
-			log.Printf("Received set voice level to %d", level)
-
-			resp := bytes.NewBuffer(nil)
-			binary.Write(resp, binary.BigEndian, uint16(7))
-			resp.WriteByte(0x70) // Cmd
-			resp.WriteByte(0x01) // Version
-			resp.WriteByte(0x00) // CheckSum (no payload)
-			resp.Write(token)    // Token
-
-			return resp.Bytes(), ""
-		}
-
-	case 0x64: // Query Power Bank Information
-		log.Println("Received query power bank information")
-
-		// Пример: 2 power bank в слотах 1 и 3
-		resp := bytes.NewBuffer(nil)
-
-		// Сначала считаем общую длину
-		remainNum := byte(2)
-		slot1Data := []byte{0x01}          // slot 1
-		powerBank1ID := []byte("RL1H|001") // 8 bytes
-		if len(powerBank1ID) < 8 {
-			for len(powerBank1ID) < 8 {
-				powerBank1ID = append(powerBank1ID, 0x00)
+	case CmdQueryServer: // Query server address
+		if len(payload) > 0 {
+			// Ответ станции на query_server
+			server, err := decodeServerConfig(payload)
+			if err != nil {
+				slog.Warn("bad query_server reply", "error", err)
+				return nil, ""
 			}
-		} else if len(powerBank1ID) > 8 {
-			powerBank1ID = powerBank1ID[:8]
+			slog.Debug("query_server reply", "address", server.Address, "port", server.Port, "interval", server.Interval)
+			return nil, ""
 		}
-		level1 := byte(4) // 81-100%
 
-		slot3Data := []byte{0x03}          // slot 3
-		powerBank3ID := []byte("RL1H|003") // 8 bytes
-		if len(powerBank3ID) < 8 {
-			for len(powerBank3ID) < 8 {
-				powerBank3ID = append(powerBank3ID, 0x00)
+		slog.Debug("received query_server")
+		// Тот же формат, что и в set_server
+		reply, _ := setServerPayload("127.0.0.1", "9000", 30)
+		return buildFrame(CmdQueryServer, version, token, reply), ""
+
+	case CmdQueryCycles: // Power bank charge cycles
+		if len(payload) > 0 {
+			// Ответ станции на query_cycles
+			cycles, err := decodeCycles(payload)
+			if err != nil {
+				slog.Warn("bad query_cycles reply", "error", err)
+				return nil, ""
 			}
-		} else if len(powerBank3ID) > 8 {
-			powerBank3ID = powerBank3ID[:8]
-		}
-		level3 := byte(2) // 41-60%
-
-		payloadLen := 1 + (1+8+1)*2 // RemainNum + (Slot+PowerBankID+Level)*2
-		totalLen := uint16(7 + payloadLen)
-
-		binary.Write(resp, binary.BigEndian, totalLen)
-		resp.WriteByte(0x64) // Cmd
-		resp.WriteByte(0x01) // Version
-		resp.WriteByte(0x00) // CheckSum placeholder
-		resp.Write(token)    // Token
-
-		// Payload
-		resp.WriteByte(remainNum)
-		resp.Write(slot1Data)
-		resp.Write(powerBank1ID)
-		resp.WriteByte(level1)
-		resp.Write(slot3Data)
-		resp.Write(powerBank3ID)
-		resp.WriteByte(level3)
-
-		respBytes := resp.Bytes()
-		respBytes[4] = xorChecksum(respBytes[9:])
-		return respBytes, ""
-
-	case 0x67: // Restart
-		log.Println("Received restart command")
-		// Просто возвращаем подтверждение
-		resp := bytes.NewBuffer(nil)
-		binary.Write(resp, binary.BigEndian, uint16(7))
-		resp.WriteByte(0x67) // Cmd
-		resp.WriteByte(0x01) // Version
-		resp.WriteByte(0x00) // CheckSum (no payload)
-		resp.Write(token)    // Token
-
-		return resp.Bytes(), ""
-
-	case 0x63: // Set server address
-		if len(data) >= 10 {
-			log.Println("Received set server address")
-			// Просто возвращаем подтверждение
-			resp := bytes.NewBuffer(nil)
-			binary.Write(resp, binary.BigEndian, uint16(7))
-			resp.WriteByte(0x63) // Cmd
-			resp.WriteByte(0x01) // Version
-			resp.WriteByte(0x00) // CheckSum (no payload)
-			resp.Write(token)    // Token
+			slog.Debug("query_cycles reply", "power_banks", len(cycles))
+			return nil, ""
+		}
+
+		slog.Debug("received query_cycles")
+		var cycles []PowerBankCycles
+		for _, e := range profile.slots().Inventory() {
+			cycles = append(cycles, PowerBankCycles{Slot: e.Slot, PowerBankID: e.PowerBankID, Cycles: emulatedCycles})
+		}
+		return buildFrame(CmdQueryCycles, version, token, cyclesPayload(cycles)), ""
+
+	case CmdQueryCapacity: // Cabinet capacity
+		if len(payload) > 0 {
+			// Ответ станции на query_capacity
+			capacity, err := decodeCapacity(payload)
+			if err != nil {
+				slog.Warn("bad query_capacity reply", "error", err)
+				return nil, ""
+			}
+			slog.Debug("query_capacity reply", "total", capacity.Total, "occupied", capacity.Occupied)
+			return nil, ""
+		}
+
+		slog.Debug("received query_capacity")
+		occupied := len(profile.slots().Inventory())
+		total := max(profile.SlotCount, occupied)
+		reply := binary.BigEndian.AppendUint16(nil, uint16(total))
+		reply = binary.BigEndian.AppendUint16(reply, uint16(occupied))
+		return buildFrame(CmdQueryCapacity, version, token, reply), ""
+
+	case CmdQueryTime: // Cabinet clock
+		if len(payload) > 0 {
+			// Ответ станции на query_time
+			t, err := decodeTime(payload)
+			if err != nil {
+				slog.Warn("bad query_time reply", "error", err)
+				return nil, ""
+			}
+			slog.Debug("query_time reply", "time", t.UTC().Format(time.RFC3339))
+			return nil, ""
+		}
+
+		slog.Debug("received query_time")
+		reply, _ := timePayload(time.Now())
+		return buildFrame(CmdQueryTime, version, token, reply), ""
+
+	case CmdSetTime: // Set cabinet clock
+		if len(payload) > 0 {
+			t, err := decodeTime(payload)
+			if err != nil {
+				slog.Warn("rejecting set_time", "error", err)
+				return nil, ""
+			}
+			slog.Debug("received set_time", "time", t.UTC().Format(time.RFC3339))
+			return buildFrame(CmdSetTime, version, token, nil), ""
+		}
 
-			return resp.Bytes(), ""
+	case CmdQueryStatus: // Cabinet status
+		if len(payload) > 0 {
+			// Ответ станции на query_status
+			status, err := decodeCabinetStatus(payload)
+			if err != nil {
+				slog.Warn("bad query_status reply", "error", err)
+				return nil, ""
+			}
+			slog.Debug("query_status reply", "temperature", status.Temperature, "door_open", status.DoorOpen, "faults", status.Faults)
+			return nil, ""
 		}
 
+		slog.Debug("received query_status")
+		// Temperature 25C, дверь закрыта, неисправностей нет
+		return buildFrame(CmdQueryStatus, version, token, []byte{25, 0x00, 0x00}), ""
+
 	default:
-		log.Printf("Received unhandled command: 0x%02x", cmd)
+		slog.Debug("received unhandled command", "cmd", fmt.Sprintf("0x%02x", cmd))
+		if NackUnknown {
+			return buildFrame(cmd, version, token, []byte{ResultUnsupported}), ""
+		}
 	}
 
 	return nil, ""
 }
+
+// heartbeatResponse собирает ответ на heartbeat по HeartbeatReply
+func heartbeatResponse(data []byte, version byte, token []byte, now time.Time) []byte {
+	switch HeartbeatReply {
+	case HeartbeatAck:
+		return buildFrame(CmdHeartbeat, version, token, nil)
+	case HeartbeatTime:
+		return buildFrame(CmdHeartbeat, version, token, binary.BigEndian.AppendUint32(nil, uint32(now.Unix())))
+	}
+	return data
+}
+
+// Result byte в ответе на Login
+const (
+	loginRejected byte = 0x00
+	loginAccepted byte = 0x01
+)
+
+// buildLoginResponse: payload ответа на Login - один Result byte.
+// PackLen и checksum считает buildFrame.
+func buildLoginResponse(version byte, token []byte, result byte) []byte {
+	return buildFrame(CmdLogin, version, token, []byte{result})
+}
+
+// buildSlotResponse собирает ответ на rent/eject: Slot(1) + Result(1) +
+// PowerBankID(8), для слотов больше 255 Slot занимает 2 байта.
+// ID дополняется нулями или обрезается до 8 байт.
+func buildSlotResponse(cmd, version byte, token []byte, slot uint16, powerBankID []byte, result byte) []byte {
+	payload := append(encodeSlot(slot), result)
+	payload = append(payload, padPowerBankID(powerBankID)...)
+	return buildFrame(cmd, version, token, payload)
+}
+
+func padPowerBankID(id []byte) []byte {
+	padded := make([]byte, 8)
+	copy(padded, id)
+	return padded
+}
+
+// isInventoryQuery отличает запрос query_power_bank от ответа станции:
+// запрос идет без payload или с номером слота 1-255, ответ начинается с
+// RemainNum, и у пустого шкафа это {0x00}
+func isInventoryQuery(payload []byte) bool {
+	return len(payload) == 0 || len(payload) == 1 && payload[0] != 0
+}
+
+// inventoryPayload: RemainNum(1) + (Slot(1) + PowerBankID(8) + Level(1)) * RemainNum
+func inventoryPayload(entries []SlotEntry) []byte {
+	p := make([]byte, 1, 1+len(entries)*10)
+	p[0] = byte(len(entries))
+	for _, e := range entries {
+		p = append(p, e.Slot)
+		p = append(p, padPowerBankID([]byte(e.PowerBankID))...)
+		p = append(p, e.Level)
+	}
+	return p
+}
+
+// Сколько циклов заряда эмулятор сообщает для каждого повербанка
+const emulatedCycles = 150
+
+// cyclesPayload: Count(1) + (Slot(1) + PowerBankID(8) + Cycles(2, BE)) * Count
+func cyclesPayload(entries []PowerBankCycles) []byte {
+	p := make([]byte, 1, 1+len(entries)*11)
+	p[0] = byte(len(entries))
+	for _, e := range entries {
+		p = append(p, e.Slot)
+		p = append(p, padPowerBankID([]byte(e.PowerBankID))...)
+		p = binary.BigEndian.AppendUint16(p, e.Cycles)
+	}
+	return p
+}
+
+// lstring кодирует строку как Len(2) + String\0, длина включает null terminator
+func lstring(s string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(s)+1))
+	b = append(b, s...)
+	return append(b, 0x00)
+}
@@ -0,0 +1,666 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+var testToken = []byte{0x11, 0x22, 0x33, 0x44}
+
+func TestSingleSlotQueryEncoding(t *testing.T) {
+	frame, err := CreateCommandParams("query_power_bank", "11223344", Params{Slot: "3"}, Version2)
+	if err != nil {
+		t.Fatalf("CreateCommandParams: %v", err)
+	}
+	if _, payload := splitFrame(frame); !bytes.Equal(payload, []byte{3}) {
+		t.Errorf("payload = %x, want 03", payload)
+	}
+
+	if _, err := CreateCommandParams("query_power_bank", "11223344", Params{Slot: "3"}, Version1); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("v1 single-slot query: err = %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := CreateCommandParams("query_power_bank", "11223344", Params{Slot: "0"}, Version2); !errors.Is(err, ErrInvalidSlot) {
+		t.Errorf("slot 0: err = %v, want ErrInvalidSlot", err)
+	}
+}
+
+func TestEmulatedSingleSlotReply(t *testing.T) {
+	query, _ := CreateCommandParams("query_power_bank", "11223344", Params{Slot: "3"}, Version2)
+	resp := EmulateResponse(query, DefaultProfile)
+	msg, err := Decode(resp)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(msg.Inventory) != 1 || msg.Inventory[0].Slot != 3 {
+		t.Errorf("inventory = %+v, want slot 3 only", msg.Inventory)
+	}
+}
+
+// Ответ станции с пустым инвентарем - не запрос слота, отвечать на него нечего
+func TestInventoryReplyNotAnswered(t *testing.T) {
+	for _, payload := range [][]byte{{0x00}, inventoryPayload([]SlotEntry{{Slot: 1, PowerBankID: "RL1H|001", Level: 4}})} {
+		frame := buildFrame(CmdQueryPowerBank, Version1, testToken, payload)
+		if resp, _ := HandleIncoming(frame); resp != nil {
+			t.Errorf("HandleIncoming(inventory %x) replied %x, want no reply", payload, resp)
+		}
+	}
+}
+
+func TestParseSlot(t *testing.T) {
+	tests := []struct {
+		in   string
+		want byte
+		ok   bool
+	}{
+		{"1", 1, true},
+		{"255", 255, true},
+		{" 12 ", 12, true},
+		{"0", 0, false},
+		{"256", 0, false},
+		{"-1", 0, false},
+		{"", 0, false},
+		{"one", 0, false},
+		{"1.5", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSlot(tt.in)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("ParseSlot(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidSlot) {
+			t.Errorf("ParseSlot(%q): err = %v, want ErrInvalidSlot", tt.in, err)
+		}
+	}
+}
+
+// Голос и яркость идут через тот же разбор со своими границами
+func TestSlotLikeRanges(t *testing.T) {
+	tests := []struct {
+		cmd, value string
+		ok         bool
+	}{
+		{"voice_set", "0", true},
+		{"voice_set", "15", true},
+		{"voice_set", "16", false},
+		{"voice_set", "loud", false},
+		{"rent", "255", true},
+		{"rent", "0", false},
+		{"eject", "x", false},
+	}
+	for _, tt := range tests {
+		_, err := CreateCommand(tt.cmd, "11223344", tt.value, Version1)
+		if (err == nil) != tt.ok {
+			t.Errorf("CreateCommand(%s, %q): err = %v, want ok=%v", tt.cmd, tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestCreateCommandErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		token   string
+		p       Params
+		version byte
+		want    error
+	}{
+		{"unknown command", "launch", "11223344", Params{}, Version1, ErrUnknownCommand},
+		{"unsupported version", "multi_eject", "11223344", Params{Slot: "1,2"}, Version1, ErrUnsupportedVersion},
+		{"bad token", "heartbeat", "1122", Params{}, Version1, ErrInvalidToken},
+		{"bad slot", "rent", "11223344", Params{Slot: "0"}, Version1, ErrInvalidSlot},
+		{"bad voice level", "voice_set", "11223344", Params{Slot: "20"}, Version1, ErrInvalidLevel},
+		{"bad brightness", "set_brightness", "11223344", Params{Slot: "101"}, Version1, ErrInvalidBrightness},
+		{"bad interval", "set_server", "11223344", Params{Slot: "0"}, Version1, ErrInvalidInterval},
+		{"bad address", "set_server", "11223344", Params{Slot: "30", Address: "bad_host"}, Version1, ErrInvalidAddress},
+		{"bad port", "set_server", "11223344", Params{Slot: "30", Port: "70000"}, Version1, ErrInvalidPort},
+		{"bad time", "set_time", "11223344", Params{Slot: "yesterday"}, Version1, ErrInvalidTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := CreateCommandParams(tt.cmd, tt.token, tt.p, tt.version)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if frame != nil {
+				t.Errorf("frame = %x, want nil with an error", frame)
+			}
+		})
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	tests := []struct {
+		name, token string
+		want        error
+		mention     string
+	}{
+		{"odd length", "1122334", ErrTokenFormat, "odd number"},
+		{"non-hex", "11223g44", ErrTokenFormat, "position 6"},
+		{"too short", "1122", ErrTokenLength, "got 2 bytes"},
+		{"too long", "1122334455", ErrTokenLength, "got 5 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseToken(tt.token)
+			if !errors.Is(err, tt.want) || !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.mention) {
+				t.Errorf("err = %q, want it to mention %q", err, tt.mention)
+			}
+		})
+	}
+	if token, err := ParseToken("11223344"); err != nil || !bytes.Equal(token, testToken) {
+		t.Errorf("ParseToken(11223344) = %x, %v", token, err)
+	}
+}
+
+// Один и тот же токен в любом формате дает одинаковые байты
+func TestParseTokenFormat(t *testing.T) {
+	for _, tt := range []struct{ format, token string }{
+		{"", "11223344"},
+		{TokenHex, "11223344"},
+		{TokenBase64, "ESIzRA=="},
+		{TokenDotted, "17.34.51.68"},
+	} {
+		token, err := ParseTokenFormat(tt.token, tt.format)
+		if err != nil || !bytes.Equal(token, testToken) {
+			t.Errorf("%s %q = %x, %v, want %x", tt.format, tt.token, token, err, testToken)
+		}
+	}
+	for _, tt := range []struct{ format, token string }{
+		{TokenBase64, "ESIz"},
+		{TokenBase64, "not base64"},
+		{TokenDotted, "17.34.51"},
+		{TokenDotted, "17.34.51.256"},
+		{"binary", "11223344"},
+	} {
+		if _, err := ParseTokenFormat(tt.token, tt.format); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s %q: err = %v, want ErrInvalidToken", tt.format, tt.token, err)
+		}
+	}
+}
+
+func TestSetBrightness(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  byte
+	}{{"0", 0}, {"55", 55}, {"100", 100}} {
+		frame, err := CreateCommand("set_brightness", "11223344", tt.value, Version1)
+		if err != nil {
+			t.Fatalf("brightness %s: %v", tt.value, err)
+		}
+		if frame[2] != CmdSetBrightness {
+			t.Errorf("brightness %s: cmd 0x%02x, want 0x%02x", tt.value, frame[2], CmdSetBrightness)
+		}
+		if _, payload := splitFrame(frame); !bytes.Equal(payload, []byte{tt.want}) {
+			t.Errorf("brightness %s: payload %x, want %02x", tt.value, payload, tt.want)
+		}
+	}
+	for _, value := range []string{"", "-1", "101", "bright"} {
+		if _, err := CreateCommand("set_brightness", "11223344", value, Version1); !errors.Is(err, ErrInvalidBrightness) {
+			t.Errorf("brightness %q: err = %v, want ErrInvalidBrightness", value, err)
+		}
+	}
+}
+
+func TestSetServerAddress(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	// 4 метки по 63 байта и точки - 255 байт, срезаем до 253
+	fqdn := strings.Join([]string{label, label, label, label}, ".")[:253]
+
+	tests := []struct {
+		name, address, want string
+	}{
+		{"IPv6", "2001:db8::1", "2001:db8::1"},
+		{"bracketed IPv6", "[2001:db8::1]", "2001:db8::1"},
+		{"IPv4", "10.0.0.1", "10.0.0.1"},
+		{"long FQDN", fqdn, fqdn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := CreateCommandParams("set_server", "11223344", Params{Slot: "30", Address: tt.address, Port: "9000"}, Version1)
+			if err != nil {
+				t.Fatalf("CreateCommandParams: %v", err)
+			}
+			// Payload set_server в том же формате, что ответ query_server
+			_, payload := splitFrame(frame)
+			server, err := decodeServerConfig(payload)
+			if err != nil {
+				t.Fatalf("decodeServerConfig: %v", err)
+			}
+			if server.Address != tt.want || server.Port != "9000" || server.Interval != 30 {
+				t.Errorf("server = %+v, want %s:9000 every 30s", server, tt.want)
+			}
+		})
+	}
+
+	for _, address := range []string{fqdn + "a", strings.Repeat("b", 64) + ".com", "-bad.com", "under_score.com"} {
+		if _, err := CreateCommandParams("set_server", "11223344", Params{Slot: "30", Address: address}, Version1); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("address %.20q...: err = %v, want ErrInvalidAddress", address, err)
+		}
+	}
+}
+
+func testProfile() Profile {
+	return Profile{Firmware: DefaultProfile.Firmware, ICCID: DefaultProfile.ICCID, Slots: DefaultSlots.Copy()}
+}
+
+// Ответы на rent и eject отличаются только Cmd
+func TestRentEjectResponsesMatch(t *testing.T) {
+	for _, version := range []byte{Version1, Version2} {
+		rent, _ := CreateCommand("rent", "11223344", "1", version)
+		eject, _ := CreateCommand("eject", "11223344", "1", version)
+		rentResp := EmulateResponse(rent, testProfile())
+		ejectResp := EmulateResponse(eject, testProfile())
+		if rentResp == nil || ejectResp == nil {
+			t.Fatalf("v%d: no response to rent or eject", version)
+		}
+		if rentResp[2] != CmdRent || ejectResp[2] != CmdEject {
+			t.Errorf("v%d: cmd bytes 0x%02x, 0x%02x", version, rentResp[2], ejectResp[2])
+		}
+		masked := append([]byte(nil), ejectResp...)
+		masked[2] = CmdRent
+		if !bytes.Equal(masked, rentResp) {
+			t.Errorf("v%d: rent %x and eject %x differ beyond Cmd", version, rentResp, ejectResp)
+		}
+
+		msg, err := Decode(rentResp)
+		if err != nil || msg.SlotResult == nil || msg.SlotResult.Slot != 1 || !msg.SlotResult.Success || msg.SlotResult.PowerBankID != "RL1H|001" {
+			t.Errorf("v%d: decoded rent reply = %+v, %v", version, msg.SlotResult, err)
+		}
+	}
+}
+
+// Ответы из buildFrame совпадают с кадрами, собранными вручную по
+// описанию протокола
+func TestResponseBuilderMatchesHandBuilt(t *testing.T) {
+	// Login v1: PackLen 0x0008, Cmd 0x60, Version 0x01, CheckSum = XOR(01),
+	// Token, Result 0x01
+	wantLogin := []byte{0x00, 0x08, 0x60, 0x01, 0x01, 0x11, 0x22, 0x33, 0x44, 0x01}
+	if got := buildLoginResponse(Version1, testToken, loginAccepted); !bytes.Equal(got, wantLogin) {
+		t.Errorf("login response = %x, want %x", got, wantLogin)
+	}
+
+	// Firmware v1: payload Len(2) + "V1\0", checksum XOR 00^03^56^31^00 = 0x64
+	wantFirmware := []byte{0x00, 0x0C, 0x62, 0x01, 0x64, 0x11, 0x22, 0x33, 0x44, 0x00, 0x03, 'V', '1', 0x00}
+	if got := buildFrame(CmdQueryFirmware, Version1, testToken, lstring("V1")); !bytes.Equal(got, wantFirmware) {
+		t.Errorf("firmware response = %x, want %x", got, wantFirmware)
+	}
+
+	// v2: двухбайтовая CheckSum CRC16 по payload
+	crc := crc16([]byte{0x01})
+	wantLoginV2 := []byte{0x00, 0x09, 0x60, 0x02, byte(crc >> 8), byte(crc), 0x11, 0x22, 0x33, 0x44, 0x01}
+	if got := buildLoginResponse(Version2, testToken, loginAccepted); !bytes.Equal(got, wantLoginV2) {
+		t.Errorf("v2 login response = %x, want %x", got, wantLoginV2)
+	}
+}
+
+// Checksum ответа на Login считается по фактическому Result
+func TestLoginResponseChecksumFollowsResult(t *testing.T) {
+	for _, version := range []byte{Version1, Version2} {
+		accepted := buildLoginResponse(version, testToken, loginAccepted)
+		rejected := buildLoginResponse(version, testToken, loginRejected)
+		if !ChecksumValid(accepted) || !ChecksumValid(rejected) {
+			t.Errorf("v%d: accepted %x or rejected %x does not validate", version, accepted, rejected)
+		}
+		if bytes.Equal(accepted[4:headerLen(version)-4], rejected[4:headerLen(version)-4]) {
+			t.Errorf("v%d: checksum did not change with the result byte", version)
+		}
+	}
+	if rejected := buildLoginResponse(Version1, testToken, loginRejected); rejected[4] != 0x00 || rejected[len(rejected)-1] != 0x00 {
+		t.Errorf("v1 rejected login = %x, want result 0x00 with checksum 0x00", rejected)
+	}
+}
+
+// Настроенный результат слота отдается вместо успеха, а повербанк остается
+// в слоте
+func TestSlotResultOverride(t *testing.T) {
+	defer ResetSlotResults()
+	profile := testProfile()
+	SetSlotResult(1, SlotResultFailed)
+
+	rent, _ := CreateCommand("rent", "11223344", "1", Version1)
+	msg, err := Decode(EmulateResponse(rent, profile))
+	if err != nil || msg.SlotResult == nil || msg.SlotResult.Success || msg.SlotResult.Result != SlotResultFailed || msg.SlotResult.PowerBankID != "" {
+		t.Fatalf("overridden rent reply = %+v, %v", msg.SlotResult, err)
+	}
+
+	ResetSlotResults()
+	msg, err = Decode(EmulateResponse(rent, profile))
+	if err != nil || msg.SlotResult == nil || !msg.SlotResult.Success || msg.SlotResult.PowerBankID != "RL1H|001" {
+		t.Errorf("rent after reset = %+v, %v", msg.SlotResult, err)
+	}
+
+	// Пустой слот отвечает неудачей и без настройки
+	empty, _ := CreateCommand("rent", "11223344", "2", Version1)
+	if msg, err := Decode(EmulateResponse(empty, profile)); err != nil || msg.SlotResult == nil || msg.SlotResult.Success {
+		t.Errorf("rent of an empty slot = %+v, %v", msg.SlotResult, err)
+	}
+}
+
+// query_fw и query_iccid отвечают значениями профиля
+func TestEmulatedProfileValues(t *testing.T) {
+	profile := Profile{Firmware: "EMU,H9,01,02", ICCID: "89860000000000000001"}
+	fw, _ := CreateCommand("query_fw", "11223344", "", Version1)
+	msg, err := Decode(EmulateResponse(fw, profile))
+	if err != nil || msg.Cmd != CmdQueryFirmware || msg.Firmware != "EMU,H9,01,02" {
+		t.Errorf("firmware reply = %q, %v", msg.Firmware, err)
+	}
+	iccid, _ := CreateCommand("query_iccid", "11223344", "", Version1)
+	if msg, err := Decode(EmulateResponse(iccid, profile)); err != nil || msg.ICCID != profile.ICCID {
+		t.Errorf("ICCID reply = %q, %v", msg.ICCID, err)
+	}
+}
+
+func TestUnknownCommandNack(t *testing.T) {
+	defer func(prev bool) { NackUnknown = prev }(NackUnknown)
+	token := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+	unknown := buildFrame(0x7E, Version1, token, []byte{0x01, 0x02})
+
+	NackUnknown = false
+	if resp, _ := HandleIncoming(unknown); resp != nil {
+		t.Errorf("NACK sent while disabled: %x", resp)
+	}
+
+	NackUnknown = true
+	resp, _ := HandleIncoming(unknown)
+	if want := buildFrame(0x7E, Version1, token, []byte{ResultUnsupported}); !bytes.Equal(resp, want) {
+		t.Errorf("NACK = %x, want %x", resp, want)
+	}
+}
+
+func TestCommandNamesRoundTrip(t *testing.T) {
+	for b, name := range commandNames {
+		if got, ok := CommandByte(CommandName(b)); !ok || got != b {
+			t.Errorf("CommandByte(CommandName(0x%02x)) = 0x%02x, %v", b, got, ok)
+		}
+		if _, ok := CommandByte(name); !ok {
+			t.Errorf("no cmd byte for %s", name)
+		}
+	}
+	if len(commandBytes) != len(commandNames) {
+		t.Errorf("%d names map to %d cmd bytes: duplicate name", len(commandNames), len(commandBytes))
+	}
+	if CommandName(0x7E) != "unknown" {
+		t.Errorf("CommandName(0x7e) = %s, want unknown", CommandName(0x7E))
+	}
+
+	// Каждая команда /send собирается под своим cmd байтом
+	params := map[string]Params{
+		"rent": {Slot: "1"}, "eject": {Slot: "1"}, "voice_set": {Slot: "5"}, "set_brightness": {Slot: "50"},
+		"set_server": {Slot: "30", Address: "10.0.0.1", Port: "9000"}, "set_time": {Slot: "1767225600"},
+		"multi_eject": {Slot: "1,2"},
+	}
+	for _, name := range KnownCommands() {
+		frame, err := CreateCommandParams(name, "11223344", params[name], Version2)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if b, ok := CommandByte(name); !ok || frame[2] != b {
+			t.Errorf("%s: frame cmd 0x%02x, mapped 0x%02x (%v)", name, frame[2], b, ok)
+		}
+	}
+}
+
+func TestTwoByteSlot(t *testing.T) {
+	frame, err := CreateCommand("rent", "11223344", "300", Version2)
+	if err != nil {
+		t.Fatalf("v2 rent 300: %v", err)
+	}
+	if _, payload := splitFrame(frame); !bytes.Equal(payload, []byte{0x01, 0x2C}) {
+		t.Errorf("v2 rent 300 payload = %x, want 012c", payload)
+	}
+	msg, err := Decode(EmulateResponse(frame, testProfile()))
+	if err != nil || msg.SlotResult == nil || msg.SlotResult.Slot != 300 {
+		t.Errorf("v2 reply for slot 300 = %+v, %v", msg.SlotResult, err)
+	}
+
+	_, err = CreateCommand("rent", "11223344", "300", Version1)
+	if !errors.Is(err, ErrInvalidSlot) || !strings.Contains(err.Error(), "two-byte") {
+		t.Errorf("v1 rent 300: err = %v, want ErrInvalidSlot about the two-byte field", err)
+	}
+	if frame, err := CreateCommand("eject", "11223344", "255", Version1); err != nil || len(frame) != 10 {
+		t.Errorf("v1 eject 255 = %x, %v, want a one-byte slot", frame, err)
+	}
+}
+
+func TestUnlockAll(t *testing.T) {
+	frame, err := CreateCommand("unlock_all", "11223344", "", Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x00, 0x07, CmdUnlockAll, Version1, 0x00, 0x11, 0x22, 0x33, 0x44}; !bytes.Equal(frame, want) {
+		t.Errorf("unlock_all = %x, want %x", frame, want)
+	}
+
+	// Станция подтверждает кадром без payload, повербанки остаются в слотах
+	profile := testProfile()
+	ack := EmulateResponse(frame, profile)
+	msg, err := Decode(ack)
+	if err != nil || msg.Cmd != CmdUnlockAll || len(msg.Payload) != 0 {
+		t.Errorf("unlock_all ack = %x, %v", ack, err)
+	}
+	if inv := profile.Slots.Inventory(); len(inv) != 2 {
+		t.Errorf("inventory after unlock_all = %+v", inv)
+	}
+
+	// Ack станции сервер не отвечает: ответ был бы новой командой unlock_all
+	if resp, _ := HandleIncoming(ack); resp != nil {
+		t.Errorf("unlock_all ack answered with %x", resp)
+	}
+}
+
+func TestHeartbeatReplyModes(t *testing.T) {
+	defer func(prev HeartbeatMode) { HeartbeatReply = prev }(HeartbeatReply)
+	hb := buildFrame(CmdHeartbeat, Version1, testToken, []byte{0x05})
+	now := time.Unix(0x69A1B2C3, 0)
+
+	HeartbeatReply = HeartbeatEcho
+	if got := heartbeatResponse(hb, Version1, testToken, now); !bytes.Equal(got, hb) {
+		t.Errorf("echo = %x, want %x", got, hb)
+	}
+	HeartbeatReply = HeartbeatAck
+	if got, want := heartbeatResponse(hb, Version1, testToken, now), buildFrame(CmdHeartbeat, Version1, testToken, nil); !bytes.Equal(got, want) {
+		t.Errorf("ack = %x, want %x", got, want)
+	}
+	HeartbeatReply = HeartbeatTime
+	if got, want := heartbeatResponse(hb, Version1, testToken, now), buildFrame(CmdHeartbeat, Version1, testToken, []byte{0x69, 0xA1, 0xB2, 0xC3}); !bytes.Equal(got, want) {
+		t.Errorf("time = %x, want %x", got, want)
+	}
+
+	for _, s := range []string{"echo", "ack", "time"} {
+		if _, err := ParseHeartbeatMode(s); err != nil {
+			t.Errorf("ParseHeartbeatMode(%s): %v", s, err)
+		}
+	}
+	if _, err := ParseHeartbeatMode("pong"); err == nil {
+		t.Errorf("ParseHeartbeatMode(pong) accepted")
+	}
+}
+
+func TestValidateCommandPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     byte
+		payload []byte
+		want    error
+	}{
+		{"rent one-byte slot", CmdRent, []byte{1}, nil},
+		{"rent two-byte slot", CmdRent, []byte{0, 1}, nil},
+		{"rent without slot", CmdRent, nil, ErrBadPayload},
+		{"rent too long", CmdRent, []byte{0, 0, 1}, ErrPayloadTooLarge},
+		{"set_server too long", CmdSetServer, make([]byte, MaxSetServerPayload+1), ErrPayloadTooLarge},
+		{"set_server too short", CmdSetServer, make([]byte, MinSetServerPayload-1), ErrBadPayload},
+		{"heartbeat with payload", CmdHeartbeat, []byte{0}, ErrPayloadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCommandPayload(tt.cmd, tt.payload); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Адрес на границе лимита проходит, на байт длиннее - нет
+	address := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 61)
+	if _, err := CreateCommandParams("set_server", "11223344", Params{Slot: "30", Address: address, Port: "65535"}, Version1); err != nil {
+		t.Errorf("set_server with a 253-byte address: %v", err)
+	}
+	if _, err := CreateCommandParams("set_server", "11223344", Params{Slot: "30", Address: address + "d", Port: "65535"}, Version1); err == nil {
+		t.Errorf("set_server with a 254-byte address accepted")
+	}
+}
+
+func TestAcceptedVersions(t *testing.T) {
+	defer func(prev bool) { NackUnknown = prev }(NackUnknown)
+	defer func(prev map[byte]bool) { AcceptedVersions = prev }(AcceptedVersions)
+	AcceptedVersions = map[byte]bool{Version1: true}
+	NackUnknown = false
+
+	if resp, _ := HandleIncoming(buildFrame(CmdHeartbeat, Version1, testToken, nil)); resp == nil || resp[3] != Version1 {
+		t.Errorf("v1 heartbeat reply = %x", resp)
+	}
+	v2 := buildFrame(CmdHeartbeat, Version2, testToken, nil)
+	if resp, _ := HandleIncoming(v2); resp != nil {
+		t.Errorf("v2 heartbeat answered with %x while only v1 is accepted", resp)
+	}
+
+	NackUnknown = true
+	resp, _ := HandleIncoming(v2)
+	if want := buildFrame(CmdHeartbeat, Version2, testToken, []byte{ResultUnsupported}); !bytes.Equal(resp, want) {
+		t.Errorf("NACK for v2 = %x, want %x", resp, want)
+	}
+}
+
+// emulatedInventory спрашивает инвентарь у эмулятора с профилем profile
+func emulatedInventory(t *testing.T, profile Profile) []SlotEntry {
+	t.Helper()
+	query, _ := CreateCommand("query_power_bank", "11223344", "", Version1)
+	msg, err := Decode(EmulateResponse(query, profile))
+	if err != nil {
+		t.Fatalf("inventory reply: %v", err)
+	}
+	return msg.Inventory
+}
+
+// rent выдает повербанк, который лежит в слоте модели, и слот пустеет
+func TestEmulatedRentFromModel(t *testing.T) {
+	profile := Profile{Slots: NewSlotModel([]SlotEntry{
+		{Slot: 1, PowerBankID: "CUST|001", Level: 4}, {Slot: 2, PowerBankID: "CUST|002", Level: 3},
+	})}
+
+	rent, _ := CreateCommand("rent", "11223344", "1", Version1)
+	msg, err := Decode(EmulateResponse(rent, profile))
+	if err != nil || msg.SlotResult == nil || !msg.SlotResult.Success || msg.SlotResult.PowerBankID != "CUST|001" {
+		t.Fatalf("rent reply = %+v, %v", msg.SlotResult, err)
+	}
+	if inv := emulatedInventory(t, profile); len(inv) != 1 || inv[0].Slot != 2 || inv[0].PowerBankID != "CUST|002" {
+		t.Errorf("inventory after rent = %+v, want only slot 2", inv)
+	}
+}
+
+// Полный цикл: rent вынимает повербанк, возврат кладет его обратно, eject
+// опустошает слот; инвентарь каждый раз совпадает с моделью
+func TestEmulatedRentReturnCycle(t *testing.T) {
+	profile := testProfile()
+	rent, _ := CreateCommand("rent", "11223344", "1", Version1)
+	msg, err := Decode(EmulateResponse(rent, profile))
+	if err != nil || msg.SlotResult == nil || !msg.SlotResult.Success {
+		t.Fatalf("rent reply = %+v, %v", msg.SlotResult, err)
+	}
+	rented := SlotEntry{Slot: 1, PowerBankID: msg.SlotResult.PowerBankID, Level: 4}
+	if inv := emulatedInventory(t, profile); len(inv) != 1 || inv[0].Slot == 1 {
+		t.Errorf("inventory after rent = %+v", inv)
+	}
+	if msg, _ := Decode(EmulateResponse(rent, profile)); msg.SlotResult == nil || msg.SlotResult.Success {
+		t.Errorf("second rent of an empty slot = %+v", msg.SlotResult)
+	}
+
+	frame, err := EmulateReturn(profile, rented, testToken, Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := HandleIncoming(frame)
+	EmulateResponse(resp, profile)
+	if _, err := EmulateReturn(profile, rented, testToken, Version1); !errors.Is(err, ErrSlotOccupied) {
+		t.Errorf("return into an occupied slot: err = %v, want ErrSlotOccupied", err)
+	}
+	inv := emulatedInventory(t, profile)
+	if len(inv) != 2 || inv[0] != rented {
+		t.Errorf("inventory after return = %+v, want %+v back in slot 1", inv, rented)
+	}
+
+	eject, _ := CreateCommand("eject", "11223344", strconv.Itoa(int(inv[1].Slot)), Version1)
+	EmulateResponse(eject, profile)
+	if inv := emulatedInventory(t, profile); len(inv) != 1 || inv[0] != rented {
+		t.Errorf("inventory after eject = %+v, want only slot 1", inv)
+	}
+}
+
+// Одновременные rent одного слота: повербанк достается только одному
+func TestEmulatedConcurrentRent(t *testing.T) {
+	profile := testProfile()
+	rent, _ := CreateCommand("rent", "11223344", "1", Version1)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	released := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if msg, _ := Decode(EmulateResponse(rent, profile)); msg.SlotResult != nil && msg.SlotResult.Success {
+				mu.Lock()
+				released++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if released != 1 {
+		t.Errorf("power bank released %d times, want once", released)
+	}
+}
+
+func TestMultiEject(t *testing.T) {
+	frame, err := CreateCommand("multi_eject", "11223344", "1, 2", Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, payload := splitFrame(frame); !bytes.Equal(payload, []byte{2, 1, 2}) {
+		t.Errorf("multi_eject payload = %x, want 020102", payload)
+	}
+	for _, bad := range []string{"", "1,1", "0,2", "1,x"} {
+		if _, err := CreateCommand("multi_eject", "11223344", bad, Version2); !errors.Is(err, ErrInvalidSlot) {
+			t.Errorf("slots %q: err = %v, want ErrInvalidSlot", bad, err)
+		}
+	}
+
+	// Слот 1 занят, слот 2 пуст: один результат успешный, другой нет
+	msg, err := Decode(EmulateResponse(frame, testProfile()))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	want := []SlotResult{
+		{Slot: 1, Result: SlotResultSuccess, Success: true, Meaning: SlotResultMeaning(SlotResultSuccess), PowerBankID: "RL1H|001"},
+		{Slot: 2, Result: SlotResultFailed, Meaning: SlotResultMeaning(SlotResultFailed)},
+	}
+	if !reflect.DeepEqual(msg.SlotResults, want) {
+		t.Errorf("results = %+v, want %+v", msg.SlotResults, want)
+	}
+}
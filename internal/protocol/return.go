@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// PowerBankReturn - станция сообщает о возврате повербанка (0x66):
+// Slot(1) + PowerBankID(8) + [Status(1)]. Status шлют не все прошивки,
+// ненулевой значит, что повербанк не сел в слот.
+type PowerBankReturn struct {
+	Slot        byte   `json:"slot"`
+	PowerBankID string `json:"powerBankID"`
+	Status      byte   `json:"status,omitempty"`
+}
+
+// Result byte в ответе сервера на возврат. На ReturnFailed станция
+// выталкивает повербанк, чтобы пользователь вставил его заново.
+const (
+	ReturnFailed   byte = 0x00
+	ReturnAccepted byte = 0x01
+)
+
+// ReturnPolicy решает, что ответить на возврат; nil - DefaultReturnPolicy
+var ReturnPolicy func(PowerBankReturn) byte
+
+// DefaultReturnPolicy отклоняет возврат, если станция сообщила о проблеме
+// посадки или не смогла прочитать ID повербанка
+func DefaultReturnPolicy(r PowerBankReturn) byte {
+	if r.Status != 0 || r.PowerBankID == "" {
+		return ReturnFailed
+	}
+	return ReturnAccepted
+}
+
+// ReturnResult - result byte, который сервер отвечает на возврат
+func ReturnResult(r PowerBankReturn) byte {
+	if ReturnPolicy != nil {
+		return ReturnPolicy(r)
+	}
+	return DefaultReturnPolicy(r)
+}
+
+func decodeReturn(p []byte) (*PowerBankReturn, error) {
+	if len(p) < 9 {
+		return nil, fmt.Errorf("%w: return payload is %d bytes, want at least 9", ErrBadPayload, len(p))
+	}
+	r := &PowerBankReturn{Slot: p[0], PowerBankID: trimNull(p[1:9])}
+	if len(p) >= 10 {
+		r.Status = p[9]
+	}
+	return r, nil
+}
+
+func handleReturn(version byte, token, payload []byte) []byte {
+	r, err := decodeReturn(payload)
+	if err != nil {
+		slog.Warn("malformed power bank return", "error", err)
+		return nil
+	}
+	result := ReturnResult(*r)
+	slog.Info("power bank returned", "slot", r.Slot, "power_bank_id", r.PowerBankID, "status", r.Status, "result", result)
+	return buildFrame(CmdReturn, version, token, []byte{r.Slot, result})
+}
@@ -0,0 +1,8 @@
+package store
+
+// database/sql драйверы, которые Open принимает по имени: sqlite (чистый
+// Go, без cgo) и postgres
+import (
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File - Memory с сохранением снимка станций в JSON файл после каждого
+// изменения. Журнал команд дописывается построчно в path + ".audit".
+type File struct {
+	*Memory
+	path string
+	// flush пишет снимок и переименовывает файл под одним локом: иначе
+	// параллельные SaveStation могут оставить на диске более старый снимок
+	flushMu sync.Mutex
+
+	auditMu   sync.Mutex
+	auditFile *os.File
+}
+
+type fileSnapshot struct {
+	Stations []StationRecord `json:"stations"`
+}
+
+func OpenFile(path string) (*File, error) {
+	if path == "" {
+		return nil, errors.New("file store requires a path")
+	}
+	f := &File{Memory: NewMemory(), path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read store file: %w", err)
+	}
+	if err == nil {
+		var snap fileSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("parse store file %s: %w", path, err)
+		}
+		for _, rec := range snap.Stations {
+			f.Memory.stations[rec.StationID] = rec
+		}
+	}
+
+	if err := f.loadAudit(); err != nil {
+		return nil, err
+	}
+	auditFile, err := os.OpenFile(path+".audit", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open audit file: %w", err)
+	}
+	f.auditFile = auditFile
+	return f, nil
+}
+
+func (f *File) loadAudit() error {
+	af, err := os.Open(f.path + ".audit")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read audit file: %w", err)
+	}
+	defer af.Close()
+
+	sc := bufio.NewScanner(af)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// Оборванная последняя строка после падения не должна мешать старту
+			continue
+		}
+		f.Memory.AppendAudit(e)
+	}
+	return sc.Err()
+}
+
+func (f *File) AppendAudit(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f.auditMu.Lock()
+	_, err = f.auditFile.Write(append(line, '\n'))
+	f.auditMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.Memory.AppendAudit(e)
+}
+
+func (f *File) Close() error {
+	return f.auditFile.Close()
+}
+
+func (f *File) SaveStation(rec StationRecord) error {
+	f.Memory.SaveStation(rec)
+	return f.flush()
+}
+
+// flush пишет снимок во временный файл и переименовывает его, чтобы
+// при падении не остаться с обрезанным JSON
+func (f *File) flush() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	f.Memory.mu.RLock()
+	var snap fileSnapshot
+	for _, rec := range f.Memory.stations {
+		snap.Stations = append(snap.Stations, rec)
+	}
+	f.Memory.mu.RUnlock()
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
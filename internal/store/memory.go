@@ -0,0 +1,77 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// Сколько записей журнала держать в памяти на станцию
+const memoryAuditLimit = 1000
+
+type Memory struct {
+	mu       sync.RWMutex
+	stations map[string]StationRecord
+	audit    map[string][]AuditEntry
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		stations: make(map[string]StationRecord),
+		audit:    make(map[string][]AuditEntry),
+	}
+}
+
+func (m *Memory) SaveStation(rec StationRecord) error {
+	m.mu.Lock()
+	m.stations[rec.StationID] = rec
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) GetStation(id string) (StationRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rec, ok := m.stations[id]
+	if !ok {
+		return StationRecord{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+func (m *Memory) ListStations() ([]StationRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	recs := make([]StationRecord, 0, len(m.stations))
+	for _, rec := range m.stations {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].StationID < recs[j].StationID })
+	return recs, nil
+}
+
+func (m *Memory) AppendAudit(e AuditEntry) error {
+	m.mu.Lock()
+	entries := append(m.audit[e.StationID], e)
+	if len(entries) > memoryAuditLimit {
+		entries = entries[len(entries)-memoryAuditLimit:]
+	}
+	m.audit[e.StationID] = entries
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) ListAudit(stationID string, limit int) ([]AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := m.audit[stationID]
+	if limit <= 0 || limit > len(entries) {
+		limit = len(entries)
+	}
+	out := make([]AuditEntry, 0, limit)
+	for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, entries[i])
+	}
+	return out, nil
+}
+
+func (m *Memory) Close() error { return nil }
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SQL работает поверх database/sql. Запросы используют $N плейсхолдеры и
+// ON CONFLICT, которые понимают и SQLite, и Postgres.
+type SQL struct {
+	db *sql.DB
+}
+
+const createStationsTable = `CREATE TABLE IF NOT EXISTS stations (
+	station_id TEXT PRIMARY KEY,
+	last_seen  TEXT NOT NULL,
+	firmware   TEXT NOT NULL DEFAULT '',
+	iccid      TEXT NOT NULL DEFAULT '',
+	inventory  TEXT NOT NULL DEFAULT '[]'
+)`
+
+const createAuditTable = `CREATE TABLE IF NOT EXISTS audit_log (
+	ts         TEXT NOT NULL,
+	station_id TEXT NOT NULL,
+	command    TEXT NOT NULL,
+	slot       TEXT NOT NULL DEFAULT '',
+	caller     TEXT NOT NULL DEFAULT '',
+	payload    TEXT NOT NULL DEFAULT '',
+	result     TEXT NOT NULL DEFAULT '',
+	error      TEXT NOT NULL DEFAULT ''
+)`
+
+const createAuditIndex = `CREATE INDEX IF NOT EXISTS audit_log_station_ts ON audit_log (station_id, ts)`
+
+func NewSQL(db *sql.DB) (*SQL, error) {
+	for _, stmt := range []string{createStationsTable, createAuditTable, createAuditIndex} {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+	return &SQL{db: db}, nil
+}
+
+func (s *SQL) SaveStation(rec StationRecord) error {
+	inv, err := json.Marshal(rec.Inventory)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO stations (station_id, last_seen, firmware, iccid, inventory)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (station_id) DO UPDATE SET
+			last_seen = excluded.last_seen,
+			firmware = excluded.firmware,
+			iccid = excluded.iccid,
+			inventory = excluded.inventory`,
+		rec.StationID, rec.LastSeen.UTC().Format(time.RFC3339Nano), rec.Firmware, rec.ICCID, string(inv))
+	return err
+}
+
+func (s *SQL) GetStation(id string) (StationRecord, error) {
+	row := s.db.QueryRow(`SELECT station_id, last_seen, firmware, iccid, inventory FROM stations WHERE station_id = $1`, id)
+	rec, err := scanStation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StationRecord{}, ErrNotFound
+	}
+	return rec, err
+}
+
+func (s *SQL) ListStations() ([]StationRecord, error) {
+	rows, err := s.db.Query(`SELECT station_id, last_seen, firmware, iccid, inventory FROM stations ORDER BY station_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []StationRecord
+	for rows.Next() {
+		rec, err := scanStation(rows)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func (s *SQL) AppendAudit(e AuditEntry) error {
+	_, err := s.db.Exec(`INSERT INTO audit_log (ts, station_id, command, slot, caller, payload, result, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.Time.UTC().Format(time.RFC3339Nano), e.StationID, e.Command, e.Slot, e.Caller, e.Payload, e.Result, e.Error)
+	return err
+}
+
+func (s *SQL) ListAudit(stationID string, limit int) ([]AuditEntry, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.db.Query(`SELECT ts, station_id, command, slot, caller, payload, result, error
+		FROM audit_log WHERE station_id = $1 ORDER BY ts DESC LIMIT $2`, stationID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var ts string
+		if err := rows.Scan(&ts, &e.StationID, &e.Command, &e.Slot, &e.Caller, &e.Payload, &e.Result, &e.Error); err != nil {
+			return nil, err
+		}
+		if e.Time, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return nil, fmt.Errorf("audit entry: bad ts %q: %w", ts, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQL) Close() error { return s.db.Close() }
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanStation(row scanner) (StationRecord, error) {
+	var rec StationRecord
+	var lastSeen, inv string
+	if err := row.Scan(&rec.StationID, &lastSeen, &rec.Firmware, &rec.ICCID, &inv); err != nil {
+		return rec, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, lastSeen)
+	if err != nil {
+		return rec, fmt.Errorf("station %s: bad last_seen %q: %w", rec.StationID, lastSeen, err)
+	}
+	rec.LastSeen = t
+	if err := json.Unmarshal([]byte(inv), &rec.Inventory); err != nil {
+		return rec, fmt.Errorf("station %s: bad inventory: %w", rec.StationID, err)
+	}
+	return rec, nil
+}
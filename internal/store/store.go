@@ -0,0 +1,75 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"server/internal/protocol"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// StationRecord - сохраняемые метаданные станции. Живые TCP соединения
+// сюда не попадают.
+type StationRecord struct {
+	StationID string               `json:"stationID"`
+	LastSeen  time.Time            `json:"lastSeen"`
+	Firmware  string               `json:"firmware,omitempty"`
+	ICCID     string               `json:"iccid,omitempty"`
+	Inventory []protocol.SlotEntry `json:"inventory,omitempty"`
+}
+
+// AuditEntry - запись журнала команд. Записи только добавляются.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	StationID string    `json:"stationID"`
+	Command   string    `json:"command"`
+	Slot      string    `json:"slot,omitempty"`
+	Caller    string    `json:"caller"`
+	Payload   string    `json:"payload"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Store interface {
+	SaveStation(rec StationRecord) error
+	GetStation(id string) (StationRecord, error)
+	ListStations() ([]StationRecord, error)
+
+	AppendAudit(e AuditEntry) error
+	// ListAudit возвращает последние записи станции, новые первыми
+	ListAudit(stationID string, limit int) ([]AuditEntry, error)
+
+	Close() error
+}
+
+// Open выбирает реализацию по имени драйвера:
+//
+//	memory - без сохранения, по умолчанию
+//	file   - JSON файл по пути dsn
+//	любое другое имя - database/sql драйвер; sqlite и postgres
+//	зарегистрированы в drivers.go
+func Open(driver, dsn string) (Store, error) {
+	switch driver {
+	case "", "memory":
+		return NewMemory(), nil
+	case "file":
+		return OpenFile(dsn)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s store: %w", driver, err)
+	}
+	if driver == "sqlite" {
+		// SQLite все равно пишет по одному, а у :memory: базы каждое новое
+		// соединение пула было бы отдельной пустой базой
+		db.SetMaxOpenConns(1)
+	}
+	s, err := NewSQL(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
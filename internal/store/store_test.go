@@ -0,0 +1,157 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"server/internal/protocol"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openStores - все реализации Store, на которых гоняются общие тесты
+func openStores(t *testing.T) map[string]Store {
+	t.Helper()
+	file, err := OpenFile(filepath.Join(t.TempDir(), "stations.json"))
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	sqlite, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Open(sqlite): %v", err)
+	}
+	stores := map[string]Store{"memory": NewMemory(), "file": file, "sqlite": sqlite}
+	t.Cleanup(func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	})
+	return stores
+}
+
+func TestStationRoundTrip(t *testing.T) {
+	seen := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for name, s := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.GetStation("BOX1"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("GetStation before save: err = %v, want ErrNotFound", err)
+			}
+
+			rec := StationRecord{
+				StationID: "BOX1",
+				LastSeen:  seen,
+				Firmware:  "1.0",
+				ICCID:     "8986001",
+				Inventory: []protocol.SlotEntry{{Slot: 1, PowerBankID: "RL1H|001", Level: 4}},
+			}
+			if err := s.SaveStation(rec); err != nil {
+				t.Fatalf("SaveStation: %v", err)
+			}
+			rec.Firmware = "1.1"
+			if err := s.SaveStation(rec); err != nil {
+				t.Fatalf("SaveStation update: %v", err)
+			}
+			if err := s.SaveStation(StationRecord{StationID: "BOX0", LastSeen: seen}); err != nil {
+				t.Fatalf("SaveStation: %v", err)
+			}
+
+			got, err := s.GetStation("BOX1")
+			if err != nil {
+				t.Fatalf("GetStation: %v", err)
+			}
+			if got.Firmware != "1.1" || got.ICCID != "8986001" || !got.LastSeen.Equal(seen) {
+				t.Errorf("GetStation = %+v, want updated record", got)
+			}
+			if len(got.Inventory) != 1 || got.Inventory[0].PowerBankID != "RL1H|001" {
+				t.Errorf("inventory = %+v", got.Inventory)
+			}
+
+			list, err := s.ListStations()
+			if err != nil {
+				t.Fatalf("ListStations: %v", err)
+			}
+			if len(list) != 2 || list[0].StationID != "BOX0" || list[1].StationID != "BOX1" {
+				t.Errorf("ListStations = %+v, want BOX0, BOX1", list)
+			}
+		})
+	}
+}
+
+func TestAuditNewestFirst(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for name, s := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				e := AuditEntry{Time: start.Add(time.Duration(i) * time.Second), StationID: "BOX1", Command: fmt.Sprintf("cmd%d", i), Result: "sent"}
+				if err := s.AppendAudit(e); err != nil {
+					t.Fatalf("AppendAudit: %v", err)
+				}
+			}
+			s.AppendAudit(AuditEntry{Time: start, StationID: "BOX2", Command: "rent"})
+
+			entries, err := s.ListAudit("BOX1", 2)
+			if err != nil {
+				t.Fatalf("ListAudit: %v", err)
+			}
+			if len(entries) != 2 || entries[0].Command != "cmd2" || entries[1].Command != "cmd1" {
+				t.Errorf("ListAudit = %+v, want cmd2, cmd1", entries)
+			}
+		})
+	}
+}
+
+func TestFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stations.json")
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SaveStation(StationRecord{StationID: "BOX1", Firmware: "1.0"})
+	f.AppendAudit(AuditEntry{StationID: "BOX1", Command: "rent"})
+	f.Close()
+
+	f, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if rec, err := f.GetStation("BOX1"); err != nil || rec.Firmware != "1.0" {
+		t.Errorf("GetStation after reopen = %+v, %v", rec, err)
+	}
+	if entries, _ := f.ListAudit("BOX1", 0); len(entries) != 1 {
+		t.Errorf("audit after reopen = %+v, want one entry", entries)
+	}
+}
+
+// Параллельные SaveStation не должны оставлять на диске старый снимок
+func TestFileConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stations.json")
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := f.SaveStation(StationRecord{StationID: fmt.Sprintf("BOX%02d", i)}); err != nil {
+				t.Errorf("SaveStation: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	f.Close()
+
+	f, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if list, _ := f.ListStations(); len(list) != n {
+		t.Errorf("stations on disk = %d, want %d", len(list), n)
+	}
+}
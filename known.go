@@ -0,0 +1,59 @@
+package main
+
+import (
+	"server/internal/store"
+	"sort"
+	"sync"
+)
+
+// Станции, известные по прошлым подключениям: загружаются из store при
+// старте и обновляются persistStation, поэтому детали и
+// /stations?status=offline работают до переподключения станции.
+var (
+	knownMu       sync.Mutex
+	knownStations = make(map[string]store.StationRecord)
+)
+
+func loadKnownStations(recs []store.StationRecord) {
+	knownMu.Lock()
+	defer knownMu.Unlock()
+	for _, rec := range recs {
+		knownStations[rec.StationID] = rec
+	}
+}
+
+func rememberStation(rec store.StationRecord) {
+	knownMu.Lock()
+	defer knownMu.Unlock()
+	knownStations[rec.StationID] = rec
+}
+
+func knownStation(id string) (store.StationRecord, bool) {
+	knownMu.Lock()
+	defer knownMu.Unlock()
+	rec, ok := knownStations[id]
+	return rec, ok
+}
+
+// offlineStations - известные станции, которых сейчас нет в connections
+func offlineStations() []StationInfo {
+	knownMu.Lock()
+	recs := make([]store.StationRecord, 0, len(knownStations))
+	for _, rec := range knownStations {
+		recs = append(recs, rec)
+	}
+	knownMu.Unlock()
+
+	mu.RLock()
+	defer mu.RUnlock()
+	var out []StationInfo
+	for _, rec := range recs {
+		if _, online := connections[rec.StationID]; online {
+			continue
+		}
+		lastSeen := rec.LastSeen
+		out = append(out, StationInfo{StationID: rec.StationID, Status: "offline", LastSeen: &lastSeen})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StationID < out[j].StationID })
+	return out
+}
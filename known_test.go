@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"testing"
+)
+
+// Станция из SQLite store после рестарта сервера видна как offline и в
+// деталях отдается lastKnown
+func TestKnownStationsFromSQLite(t *testing.T) {
+	st, err := store.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, st)
+
+	p := newTestPeer(t)
+	p.login(t, "KNOWN1", protocol.Version1)
+	p.conn.Close()
+	p.waitClosed(t)
+
+	// Как при старте: реестр в памяти пуст, known станции грузятся из store
+	knownMu.Lock()
+	knownStations = make(map[string]store.StationRecord)
+	knownMu.Unlock()
+	recs, err := stationStore.ListStations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadKnownStations(recs)
+
+	rec := serve(handleListStations, http.MethodGet, "/stations?status=offline", "")
+	stations, _ := decodeJSON(t, rec)["stations"].([]interface{})
+	found := false
+	for _, s := range stations {
+		if s.(map[string]interface{})["stationID"] == "KNOWN1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("offline stations = %v, want KNOWN1", stations)
+	}
+
+	rec = serve(handleStation, http.MethodGet, "/stations/KNOWN1", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("detail status %d, want 404", rec.Code)
+	}
+	if _, ok := decodeJSON(t, rec)["lastKnown"]; !ok {
+		t.Errorf("detail of an offline station has no lastKnown: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+// listenStations открывает TCP listener станций с SO_REUSEADDR, чтобы
+// быстрый перезапуск при деплое не упирался в соединения в TIME_WAIT, и с
+// очередью accept на cfg.ListenBacklog соединений
+func listenStations(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reuseAddrControl}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ListenBacklog > 0 {
+		if err := setListenBacklog(listener, cfg.ListenBacklog); err != nil {
+			slog.Warn("failed to set listen backlog, using the system default", "addr", addr, "backlog", cfg.ListenBacklog, "error", err)
+		}
+	}
+	return listener, nil
+}
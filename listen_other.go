@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// На Windows SO_REUSEADDR позволяет занять порт, который слушает другой
+// процесс, поэтому его не ставим
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setListenBacklog(listener net.Listener, backlog int) error {
+	return errors.New("listen backlog is only supported on unix")
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"server/internal/protocol"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeListener отдает Accept соединения и ошибки из очереди; Close
+// разблокирует Accept с net.ErrClosed
+type fakeListener struct {
+	accepts chan acceptResult
+	closed  chan struct{}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{accepts: make(chan acceptResult, 16), closed: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepts:
+		return r.conn, r.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr { return fakeAddr("fake:9000") }
+
+// dial ставит в очередь Accept новое соединение с адресом станции remote и
+// возвращает сторону станции
+func (l *fakeListener) dial(remote string) net.Conn {
+	client, server := net.Pipe()
+	l.accepts <- acceptResult{conn: addrConn{Conn: server, remote: fakeAddr(remote)}}
+	return client
+}
+
+// addrConn подменяет RemoteAddr соединения net.Pipe
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// serveFake запускает serveTCP на listener до конца теста
+func serveFake(t *testing.T, l *fakeListener, slots chan struct{}) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- serveTCP(l, slots) }()
+	t.Cleanup(func() {
+		select {
+		case <-l.closed:
+		default:
+			l.Close()
+		}
+		<-done
+	})
+	return done
+}
+
+// closedByServer проверяет, закрыл ли сервер соединение в течение wait
+func closedByServer(c net.Conn, wait time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+// Соединения сверх лимита закрываются сразу после accept
+func TestConnectionLimit(t *testing.T) {
+	l := newFakeListener()
+	serveFake(t, l, make(chan struct{}, 2))
+
+	first, second := l.dial("10.0.0.1:1000"), l.dial("10.0.0.2:1000")
+	defer first.Close()
+	defer second.Close()
+	third := l.dial("10.0.0.3:1000")
+	if !closedByServer(third, testTimeout) {
+		t.Errorf("connection over the limit was not closed")
+	}
+	for _, c := range []net.Conn{first, second} {
+		if closedByServer(c, 50*time.Millisecond) {
+			t.Errorf("connection within the limit was closed")
+		}
+	}
+
+	// Освободившееся место снова доступно
+	first.Close()
+	eventually(t, "slot released", func() bool { return openConnections.Load() == 1 })
+	fourth := l.dial("10.0.0.4:1000")
+	defer fourth.Close()
+	if closedByServer(fourth, 50*time.Millisecond) {
+		t.Errorf("connection after a slot was released was closed")
+	}
+}
+
+// Соединения с адресов вне allowlist закрываются сразу после accept
+func TestAllowlist(t *testing.T) {
+	nets, err := parseAllowlist("10.0.0.0/8, 192.168.1.15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := allowedNets
+	allowedNets = nets
+	t.Cleanup(func() { allowedNets = prev })
+
+	l := newFakeListener()
+	serveFake(t, l, nil)
+
+	for _, remote := range []string{"10.1.2.3:5000", "192.168.1.15:5000"} {
+		c := l.dial(remote)
+		defer c.Close()
+		if closedByServer(c, 50*time.Millisecond) {
+			t.Errorf("connection from %s was closed", remote)
+		}
+	}
+	for _, remote := range []string{"192.168.1.16:5000", "172.16.0.1:5000"} {
+		c := l.dial(remote)
+		if !closedByServer(c, testTimeout) {
+			t.Errorf("connection from %s was not closed", remote)
+		}
+		c.Close()
+	}
+}
+
+// Временные ошибки Accept не останавливают сервер, постоянная - возвращается
+// из serveTCP, чтобы listener пересоздали
+func TestAcceptErrorsRecover(t *testing.T) {
+	l := newFakeListener()
+	for i := 0; i < 3; i++ {
+		l.accepts <- acceptResult{err: syscall.EMFILE}
+	}
+	done := make(chan error, 1)
+	go func() { done <- serveTCP(l, nil) }()
+
+	c := l.dial("10.0.0.1:1000")
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := c.Write(heartbeatFrame(t, protocol.Version1)); err != nil {
+		t.Fatalf("write after accept errors: %v", err)
+	}
+	reply := make([]byte, 64)
+	if n, err := c.Read(reply); err != nil || protocol.FrameLen(reply[:n]) == 0 || reply[2] != protocol.CmdHeartbeat {
+		t.Fatalf("no heartbeat reply after accept errors: %x, %v", reply[:n], err)
+	}
+
+	broken := errors.New("listener broken")
+	l.accepts <- acceptResult{err: broken}
+	select {
+	case err := <-done:
+		if !errors.Is(err, broken) {
+			t.Errorf("serveTCP = %v, want %v", err, broken)
+		}
+	case <-time.After(testTimeout):
+		l.Close()
+		t.Fatalf("serveTCP kept running after a permanent accept error")
+	}
+}
+
+// keepaliveConn запоминает настройки TCP keepalive
+type keepaliveConn struct {
+	addrConn
+	mu      sync.Mutex
+	enabled bool
+	period  time.Duration
+}
+
+func (c *keepaliveConn) SetKeepAlive(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = on
+	return nil
+}
+
+func (c *keepaliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.period = d
+	return nil
+}
+
+func (c *keepaliveConn) settings() (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enabled, c.period
+}
+
+func TestKeepAliveOnAccept(t *testing.T) {
+	keepConfig(t)
+	cfg.KeepAlive = 30 * time.Second
+	l := newFakeListener()
+	serveFake(t, l, nil)
+	// cfg восстанавливается только после того, как соединения закрылись
+	t.Cleanup(func() {
+		eventually(t, "connections closed", func() bool { return openConnections.Load() == 0 })
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &keepaliveConn{addrConn: addrConn{Conn: server, remote: fakeAddr("10.0.0.1:1000")}}
+	l.accepts <- acceptResult{conn: conn}
+	eventually(t, "keepalive enabled", func() bool {
+		on, period := conn.settings()
+		return on && period == 30*time.Second
+	})
+
+	cfg.KeepAlive = 0
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	off := &keepaliveConn{addrConn: addrConn{Conn: server2, remote: fakeAddr("10.0.0.2:1000")}, enabled: true}
+	l.accepts <- acceptResult{conn: off}
+	eventually(t, "keepalive disabled", func() bool {
+		on, _ := off.settings()
+		return !on
+	})
+}
+
+// Listener можно сразу открыть заново на том же порту, даже когда
+// соединение, закрытое сервером, еще держит порт в TIME_WAIT
+func TestListenerRestartSamePort(t *testing.T) {
+	backlog := cfg.ListenBacklog
+	t.Cleanup(func() { cfg.ListenBacklog = backlog })
+	cfg.ListenBacklog = 16
+
+	l, err := listenStations("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Сервер закрывает первым: TIME_WAIT остается на его стороне
+	server.Close()
+	l.Close()
+
+	l, err = listenStations(addr)
+	if err != nil {
+		t.Fatalf("listen again on %s: %v", addr, err)
+	}
+	defer l.Close()
+	again, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial restarted listener: %v", err)
+	}
+	again.Close()
+}
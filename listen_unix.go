@@ -0,0 +1,39 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setListenBacklog повторяет listen(2) на уже слушающем сокете: ядро
+// принимает новую длину очереди, а net.Listen свою не дает задать
+func setListenBacklog(listener net.Listener, backlog int) error {
+	tl, ok := listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("unexpected listener type %T", listener)
+	}
+	raw, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := raw.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return lerr
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+)
+
+// После slog.SetDefault оставшиеся вызовы log.Printf тоже проходят через
+// выбранный handler, поэтому формат вывода единый.
+// Разбор кадров пишется на уровне debug и без -log-level debug не выводится.
+func setupLogging(w io.Writer) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		log.Fatalf("Invalid -log-level %q: %v", cfg.LogLevel, err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch cfg.LogFormat {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"server/internal/protocol"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer - bytes.Buffer, в который можно писать из соединений
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records разбирает JSON строки лога
+func (b *syncBuffer) records(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]interface{}
+	sc := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for sc.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("log line is not JSON: %v: %s", err, sc.Text())
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// captureLogs направляет slog в JSON буфер до конца теста
+func captureLogs(t *testing.T, level string) *syncBuffer {
+	t.Helper()
+	prevFormat, prevLevel := cfg.LogFormat, cfg.LogLevel
+	cfg.LogFormat, cfg.LogLevel = "json", level
+	buf := &syncBuffer{}
+	setupLogging(buf)
+	t.Cleanup(func() {
+		cfg.LogFormat, cfg.LogLevel = prevFormat, prevLevel
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	})
+	return buf
+}
+
+func TestRegistrationLogHasStationID(t *testing.T) {
+	logs := captureLogs(t, "info")
+	p := newTestPeer(t)
+	p.login(t, "LOGJSON1", protocol.Version1)
+
+	for _, rec := range logs.records(t) {
+		if rec["msg"] == "station registered" {
+			if rec["station_id"] != "LOGJSON1" {
+				t.Errorf("station_id = %v, want LOGJSON1", rec["station_id"])
+			}
+			return
+		}
+	}
+	t.Fatalf("no station registered record in the log")
+}
+
+// Разбор кадров пишется на debug и на уровне info не выводится
+func TestFrameTracingAtDebug(t *testing.T) {
+	for _, level := range []string{"info", "debug"} {
+		logs := captureLogs(t, level)
+		protocol.HandleIncoming(heartbeatFrame(t, protocol.Version1))
+		traced := false
+		for _, rec := range logs.records(t) {
+			if rec["level"] == "DEBUG" {
+				traced = true
+			}
+		}
+		if traced != (level == "debug") {
+			t.Errorf("level %s: debug records written = %v", level, traced)
+		}
+	}
+}
+
+// Токен команды на info в лог не попадает: запрос /send пишется на debug
+// и без токена
+func TestSendLogOmitsToken(t *testing.T) {
+	logs := captureLogs(t, "info")
+	fakeStation(t, "LOGTOKEN1", protocol.Version1)
+
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=LOGTOKEN1&cmd=query_iccid&token=a1b2c3d4", ""); rec.Code != http.StatusOK {
+		t.Fatalf("send: status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, rec := range logs.records(t) {
+		if line := fmt.Sprint(rec); strings.Contains(line, "a1b2c3d4") {
+			t.Errorf("token in the log: %s", line)
+		}
+	}
+}
+
+// Кадры на info пишутся без hex: в них токены и ID повербанков
+func TestFrameHexAtDebug(t *testing.T) {
+	logs := captureLogs(t, "info")
+	p := newTestPeer(t)
+	p.login(t, "LOGHEX1", protocol.Version1)
+	// Ответ пишется в лог после записи в сокет, то есть после чтения пиром
+	eventually(t, "sent response logged", func() bool {
+		for _, rec := range logs.records(t) {
+			if rec["msg"] == "sent response" {
+				return true
+			}
+		}
+		return false
+	})
+
+	seen := map[string]bool{}
+	for _, rec := range logs.records(t) {
+		msg, _ := rec["msg"].(string)
+		if msg == "frame received" || msg == "sent response" {
+			seen[msg] = true
+			if rec["hex"] != nil || rec["cmd"] == nil || rec["len"] == nil {
+				t.Errorf("%s record = %v, want cmd and len without hex", msg, rec)
+			}
+		}
+	}
+	if !seen["frame received"] || !seen["sent response"] {
+		t.Errorf("records seen = %v, want both frame received and sent response", seen)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"time"
+)
+
+// Ограничение на длину макроса, чтобы один запрос не занимал станцию надолго
+const maxMacroSteps = 32
+
+type MacroRequest struct {
+	StationID    string      `json:"station_id"`
+	Token        string      `json:"token"`
+	ConnID       string      `json:"conn_id,omitempty"`
+	AbortOnError bool        `json:"abort_on_error,omitempty"`
+	Steps        []MacroStep `json:"steps"`
+}
+
+// MacroStep - одна команда макроса. DelayMs - пауза перед шагом, Token
+// переопределяет общий токен макроса. Без обоих берется токен сессии.
+type MacroStep struct {
+	Cmd     string `json:"cmd"`
+	Token   string `json:"token,omitempty"`
+	Slot    string `json:"slot,omitempty"`
+	Address string `json:"address,omitempty"`
+	Port    string `json:"port,omitempty"`
+	DelayMs int    `json:"delay_ms,omitempty"`
+}
+
+type MacroStepResult struct {
+	Step       int             `json:"step"`
+	Cmd        string          `json:"cmd"`
+	Status     string          `json:"status"`
+	HTTPStatus int             `json:"httpStatus,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+}
+
+// handleMacro выполняет шаги по порядку на одной станции. Каждый шаг идет
+// через тот же путь, что /send с wait=true: лимиты, журнал и ожидание
+// ответа станции.
+func handleMacro(w http.ResponseWriter, r *http.Request) {
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST with a JSON body")
+		return
+	}
+
+	var req MacroRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Error parsing JSON: %v", err))
+		return
+	}
+	if req.StationID == "" || len(req.Steps) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Missing required parameters: station_id, steps")
+		return
+	}
+	if len(req.Steps) > maxMacroSteps {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Too many steps: %d, limit %d", len(req.Steps), maxMacroSteps))
+		return
+	}
+	// Проверяем все шаги до первой отправки, чтобы не выполнить половину
+	for i, step := range req.Steps {
+		if !isKnownCommand(step.Cmd) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":   fmt.Sprintf("Step %d: unknown command: %s", i+1, step.Cmd),
+				"allowed": knownCommandNames(),
+			})
+			return
+		}
+		if !sendPolicy.allowed(step.Cmd) {
+			commandsDenied.Inc(step.Cmd)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":  fmt.Sprintf("Step %d: command %s is not allowed by policy %s", i+1, step.Cmd, sendPolicy.name),
+				"policy": sendPolicy.name,
+			})
+			return
+		}
+		if step.DelayMs < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Step %d: delay_ms must not be negative", i+1))
+			return
+		}
+	}
+
+	station, exists := lookupStation(req.StationID, req.ConnID)
+	if !exists {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("No station connected with ID: %s", req.StationID))
+		return
+	}
+
+	if req.Token == "" && station.tokenHex() == "" {
+		for i, step := range req.Steps {
+			if step.Token == "" {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Step %d: missing token and station %s has no stored session token", i+1, station.ID))
+				return
+			}
+		}
+	}
+
+	results := make([]MacroStepResult, 0, len(req.Steps))
+	status := "success"
+	for i, step := range req.Steps {
+		if status == "aborted" {
+			results = append(results, MacroStepResult{Step: i + 1, Cmd: step.Cmd, Status: "skipped"})
+			continue
+		}
+		if step.DelayMs > 0 {
+			select {
+			case <-time.After(time.Duration(step.DelayMs) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		token := step.Token
+		if token == "" {
+			token = req.Token
+		}
+		if token == "" {
+			token = station.tokenHex()
+		}
+		params := protocol.Params{Slot: step.Slot, Address: step.Address, Port: step.Port}
+		rec := &responseRecorder{header: make(http.Header)}
+		dispatchCommand(r.Context(), rec, station, step.Cmd, token, step.Slot, params, caller, true, true)
+
+		res := MacroStepResult{
+			Step:       i + 1,
+			Cmd:        step.Cmd,
+			Status:     stepStatus(rec),
+			HTTPStatus: rec.status,
+			Response:   json.RawMessage(bytes.TrimSpace(rec.body.Bytes())),
+		}
+		results = append(results, res)
+		if res.Status != "success" {
+			status = "failed"
+			if req.AbortOnError {
+				status = "aborted"
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    status,
+		"stationID": station.ID,
+		"steps":     results,
+	})
+}
+
+// stepStatus: "error" для не-2xx ответа, иначе status из тела ответа
+// ("failed", если станция вернула неуспешный result byte)
+func stepStatus(rec *responseRecorder) string {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status < 200 || rec.status > 299 {
+		return "error"
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(rec.body.Bytes(), &body) == nil && body.Status != "" {
+		return body.Status
+	}
+	return "success"
+}
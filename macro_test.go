@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+type macroResponse struct {
+	Status string            `json:"status"`
+	Steps  []MacroStepResult `json:"steps"`
+}
+
+func runMacro(t *testing.T, body string) macroResponse {
+	t.Helper()
+	rec := serve(handleMacro, http.MethodPost, "/macro", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp macroResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// Шаги уходят станции по порядку, каждый после ответа на предыдущий
+func TestMacroSteps(t *testing.T) {
+	p := newTestPeer(t)
+	p.login(t, "MACRO1", protocol.Version1)
+	received := p.emulate(testProfile())
+
+	resp := runMacro(t, `{"station_id":"MACRO1","steps":[{"cmd":"query_fw"},{"cmd":"eject","slot":"1"}]}`)
+	if resp.Status != "success" || len(resp.Steps) != 2 {
+		t.Fatalf("macro = %+v", resp)
+	}
+	for i, cmd := range []string{"query_fw", "eject"} {
+		if step := resp.Steps[i]; step.Step != i+1 || step.Cmd != cmd || step.Status != "success" {
+			t.Errorf("step %d = %+v, want %s success", i+1, step, cmd)
+		}
+	}
+	frames := received()
+	if len(frames) != 2 || frames[0][2] != protocol.CmdQueryFirmware || frames[1][2] != protocol.CmdEject {
+		t.Errorf("station received %x, want query_fw then eject", frames)
+	}
+
+	// Пустой слот 2: шаг не удался, остальные пропускаются
+	resp = runMacro(t, `{"station_id":"MACRO1","abort_on_error":true,"steps":[{"cmd":"eject","slot":"2"},{"cmd":"query_fw"}]}`)
+	if resp.Status != "aborted" || resp.Steps[0].Status != "failed" || resp.Steps[1].Status != "skipped" {
+		t.Errorf("aborted macro = %+v", resp)
+	}
+	if n := len(received()); n != 3 {
+		t.Errorf("station received %d frames, want the skipped step not sent", n)
+	}
+}
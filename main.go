@@ -1,138 +1,656 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"server/internal/metrics"
 	"server/internal/protocol"
+	"server/internal/store"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var (
-	connections = make(map[string]net.Conn) // Хранит соединения по StationID
+	connections = make(map[string]*Station) // Хранит станции по StationID
 	mu          sync.RWMutex
+
+	// Сохраненные метаданные станций, живут дольше TCP соединений
+	stationStore store.Store = store.NewMemory()
 )
 
 type SendCommandRequest struct {
 	StationID string `json:"station_id"`
 	Cmd       string `json:"cmd"`
 	Token     string `json:"token"`
-	Slot      string `json:"slot,omitempty"`
+	// Формат token: hex (по умолчанию), base64 или dotted
+	TokenFormat string `json:"token_format,omitempty"`
+	Slot        string `json:"slot,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Port        string `json:"port,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	Wait        bool   `json:"wait,omitempty"`
+	Sync        bool   `json:"sync,omitempty"`
+	ConnID      string `json:"conn_id,omitempty"`
+	Version     byte   `json:"version,omitempty"`
+	// eject: дождаться, что слот опустел, см. dispatchConfirmedEject
+	Confirm bool `json:"confirm,omitempty"`
 }
 
 type StationInfo struct {
-	StationID string `json:"stationID"`
-	Status    string `json:"status"`
-	Token     string `json:"token"`
+	StationID      string    `json:"stationID"`
+	Status         string    `json:"status"`
+	Token          string    `json:"token"`
+	ConnectedSince time.Time `json:"connected_since"`
+	Uptime         float64   `json:"uptime"`
+	// Только у offline станций: когда станция последний раз была на связи
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
 }
 
 type StationsResponse struct {
 	Count    int           `json:"count"`
+	Total    int           `json:"total"`
+	Offset   int           `json:"offset"`
+	Limit    int           `json:"limit"`
 	Stations []StationInfo `json:"stations"`
 }
 
 func main() {
+	parseFlags()
+	setupLogging(os.Stderr)
+
+	if cfg.MaxFrameSize < protocol.MinPackLen+2 {
+		log.Fatalf("Invalid -max-frame-size %d: must be at least %d", cfg.MaxFrameSize, protocol.MinPackLen+2)
+	}
+
+	switch cfg.StationIDCase {
+	case "preserve", "upper", "lower":
+	default:
+		log.Fatalf("Invalid -station-id-case %q: use preserve, upper or lower", cfg.StationIDCase)
+	}
+
+	if cfg.EventDropPolicy != dropNewest && cfg.EventDropPolicy != dropOldest {
+		log.Fatalf("Invalid -event-drop-policy %q: use %s or %s", cfg.EventDropPolicy, dropNewest, dropOldest)
+	}
+
+	keys, err := parseAPIKeys(cfg.APIKeys)
+	if err != nil {
+		log.Fatalf("Invalid -api-keys: %v", err)
+	}
+	apiKeys = keys
+
+	policy, err := parseCommandPolicy(cfg.CommandPolicy, cfg.AllowCommands, cfg.DenyCommands)
+	if err != nil {
+		log.Fatalf("Invalid -command-policy: %v", err)
+	}
+	sendPolicy = policy
+
+	nets, err := parseAllowlist(cfg.AllowCIDRs)
+	if err != nil {
+		log.Fatalf("Invalid -allow-cidrs: %v", err)
+	}
+	allowedNets = nets
+
+	coverage, err := parseChecksumCoverage(cfg.ChecksumCoverage)
+	if err != nil {
+		log.Fatalf("Invalid -checksum-coverage: %v", err)
+	}
+	for version, c := range coverage {
+		protocol.Coverage[version] = c
+	}
+
+	versions, err := parseVersions(cfg.AcceptVersions)
+	if err != nil {
+		log.Fatalf("Invalid -accept-versions: %v", err)
+	}
+	protocol.AcceptedVersions = versions
+
+	heartbeatReply, err := protocol.ParseHeartbeatMode(cfg.HeartbeatReply)
+	if err != nil {
+		log.Fatalf("Invalid -heartbeat-reply: %v", err)
+	}
+	protocol.HeartbeatReply = heartbeatReply
+
+	slotResults, err := parseSlotResults(cfg.EmulateSlotResults)
+	if err != nil {
+		log.Fatalf("Invalid -emulate-slot-results: %v", err)
+	}
+	applySlotResults(slotResults)
+
+	if cfg.EmulateInventory != "" {
+		inventory, err := parseInventory(cfg.EmulateInventory)
+		if err != nil {
+			log.Fatalf("Invalid -emulate-inventory: %v", err)
+		}
+		protocol.DefaultSlots.Set(inventory)
+	}
+
+	if cfg.Replay != "" {
+		if err := runReplay(cfg.Replay); err != nil {
+			log.Fatalf("Replay %s: %v", cfg.Replay, err)
+		}
+		return
+	}
+
+	if cfg.Emulate {
+		runEmulator()
+		return
+	}
+
+	if cfg.CaptureDir != "" {
+		if err := os.MkdirAll(cfg.CaptureDir, 0o755); err != nil {
+			log.Fatalf("Invalid -capture-dir: %v", err)
+		}
+	}
+
+	hardwareLimiter = newRateLimiter(cfg.HardwareRate, cfg.HardwareBurst)
+	queryLimiter = newRateLimiter(cfg.QueryRate, cfg.QueryBurst)
+
+	st, err := store.Open(cfg.StoreDriver, cfg.StoreDSN)
+	if err != nil {
+		log.Fatalf("Failed to open station store: %v", err)
+	}
+	stationStore = st
+	defer stationStore.Close()
+	if known, err := stationStore.ListStations(); err != nil {
+		slog.Warn("failed to load known stations", "store", cfg.StoreDriver, "error", err)
+	} else {
+		loadKnownStations(known)
+		slog.Info("loaded known stations", "count", len(known), "store", cfg.StoreDriver)
+	}
+
+	if cfg.FakeStations > 0 {
+		injectFakeStations(cfg.FakeStations)
+	}
+
 	go startTCPServer()
+	if cfg.WebhookURL != "" {
+		go runWebhook()
+		flushWebhookOnSignal()
+	}
 
 	http.HandleFunc("/send", handleSendCommand)
+	http.HandleFunc("/send/bulk", handleBulkSend)
+	http.HandleFunc("/macro", handleMacro)
+	http.HandleFunc("/decode", handleDecode)
+	http.HandleFunc("/encode", handleEncode)
 	http.HandleFunc("/stations", handleListStations)
+	http.HandleFunc("/stations/", handleStation)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/ws/events", handleEventsWS)
+	http.HandleFunc("/ws/errors", handleErrorsWS)
 	http.HandleFunc("/ping", handlePong)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/server/info", handleServerInfo)
+	http.Handle("/metrics", metrics.Handler())
 
-	log.Println("HTTP server listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	httpListener, err := net.Listen("tcp", cfg.HTTPAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.HTTPAddr, err)
+	}
+	setBoundAddr(&boundHTTP, httpListener.Addr())
+	slog.Info("HTTP server listening", "addr", httpListener.Addr().String())
+	log.Fatal(http.Serve(httpListener, nil))
 }
 
+// Задержка после временной ошибки Accept растет от минимальной до
+// максимальной; после acceptMaxFailures ошибок подряд listener считается
+// сломанным и пересоздается
+const (
+	acceptMinBackoff  = 5 * time.Millisecond
+	acceptMaxBackoff  = time.Second
+	acceptMaxFailures = 50
+)
+
 func startTCPServer() {
-	listener, err := net.Listen("tcp", ":9000")
-	if err != nil {
-		log.Fatalf("Failed to listen on TCP port: %v", err)
+	// Семафор на открытые соединения, nil - без ограничения. Переживает
+	// пересоздание listener: соединения продолжают работать.
+	var slots chan struct{}
+	if cfg.MaxConnections > 0 {
+		slots = make(chan struct{}, cfg.MaxConnections)
 	}
-	defer listener.Close()
-	log.Println("TCP server listening on :9000")
 
+	for {
+		listener, err := listenStations(cfg.TCPAddr)
+		if err != nil {
+			// HTTP остается поднятым, чтобы /healthz мог сообщить о проблеме
+			setListenerState(false, err)
+			slog.Error("failed to listen on TCP port", "addr", cfg.TCPAddr, "error", err, "retry_in", cfg.ListenRetry)
+		} else {
+			setListenerState(true, nil)
+			setBoundAddr(&boundTCP, listener.Addr())
+			slog.Info("TCP server listening", "addr", listener.Addr().String())
+			err = serveTCP(listener, slots)
+			listener.Close()
+			setListenerState(false, err)
+			setBoundAddr(&boundTCP, nil)
+			slog.Error("TCP listener failed", "addr", cfg.TCPAddr, "error", err, "retry_in", cfg.ListenRetry)
+		}
+		if cfg.ListenRetry <= 0 {
+			return
+		}
+		time.Sleep(cfg.ListenRetry)
+	}
+}
+
+// temporaryAcceptError - ошибки Accept, после которых listener еще жив:
+// кончились дескрипторы или память, клиент оборвал соединение до accept
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM)
+}
+
+// serveTCP принимает соединения, пока listener работает. Возвращает
+// ошибку, если listener сломан и его нужно пересоздать.
+func serveTCP(listener net.Listener, slots chan struct{}) error {
+	var backoff time.Duration
+	failures := 0
 	for {
 		c, err := listener.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			acceptErrors.Inc()
+			if !temporaryAcceptError(err) {
+				return err
+			}
+			failures++
+			if failures >= acceptMaxFailures {
+				return fmt.Errorf("%d accept failures in a row, last: %w", failures, err)
+			}
+			backoff *= 2
+			if backoff == 0 {
+				backoff = acceptMinBackoff
+			}
+			if backoff > acceptMaxBackoff {
+				backoff = acceptMaxBackoff
+			}
+			slog.Warn("accept error, backing off", "error", err, "delay", backoff, "failures", failures)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff, failures = 0, 0
+
+		if !remoteAllowed(allowedNets, c.RemoteAddr()) {
+			connectionsBlocked.Inc()
+			slog.Warn("connection from address outside allowlist, refusing", "remote_addr", c.RemoteAddr().String())
+			c.Close()
 			continue
 		}
-		log.Println("New station connected")
-		go handleConnection(c)
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				connectionsRefused.Inc()
+				slog.Warn("connection limit reached, refusing", "remote_addr", c.RemoteAddr().String(), "max", cfg.MaxConnections)
+				c.Close()
+				continue
+			}
+		}
+		slog.Info("new station connection", "remote_addr", c.RemoteAddr().String())
+		openConnections.Add(1)
+		go func() {
+			defer func() {
+				openConnections.Add(-1)
+				if slots != nil {
+					<-slots
+				}
+			}()
+			handleConnection(c)
+		}()
 	}
 }
 
+// keepAliveConn - часть *net.TCPConn для настройки TCP keepalive
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive включает TCP keepalive с периодом period, 0 выключает его.
+// Дополняет idle timeout: мертвый пир за NAT иначе висит до таймаута ОС.
+func setKeepAlive(c net.Conn, period time.Duration) {
+	kc, ok := c.(keepAliveConn)
+	if !ok {
+		return
+	}
+	if period <= 0 {
+		kc.SetKeepAlive(false)
+		return
+	}
+	if err := kc.SetKeepAlive(true); err != nil {
+		slog.Warn("failed to enable TCP keepalive", "remote_addr", c.RemoteAddr().String(), "error", err)
+		return
+	}
+	kc.SetKeepAlivePeriod(period)
+}
+
 func handleConnection(c net.Conn) {
+	acceptedAt := time.Now()
+	// До логина ID станции неизвестен, а переподключения одной станции
+	// иначе не различить: все строки лога соединения несут session_id
+	sessionID := newSessionID()
+	logger := slog.With("session_id", sessionID)
+	setKeepAlive(c, cfg.KeepAlive)
+	var capture *captureConn
+	if cfg.CaptureDir != "" {
+		capture = newCaptureConn(c)
+		c = capture
+	}
+
+	var station *Station
 	defer func() {
 		c.Close()
+		if station == nil {
+			return
+		}
+		persistStation(station)
+		station.failWaiters()
+		// Удаляем по ID и только свою запись: при повторном логине запись
+		// уже принадлежит новому соединению
 		mu.Lock()
-		for id, conn := range connections {
-			if conn == c {
-				delete(connections, id)
-				log.Printf("Station %s disconnected", id)
-				break
-			}
+		if dropStation(station) {
+			logger.Info("station disconnected", "station_id", station.ID, "conn_id", station.ConnID)
 		}
 		mu.Unlock()
 	}()
 
-	buf := make([]byte, 1024)
+	// Чтение может принести несколько кадров или часть кадра: копим байты в
+	// buf и режем по PackLen. Недочитанный кадр меньше cfg.MaxFrameSize
+	// (иначе CheckPackLen закрыл бы соединение), поэтому buf не растет.
+	buf := make([]byte, 0, 2*cfg.MaxFrameSize)
+	chunk := make([]byte, cfg.MaxFrameSize)
 	var stationID string
+	// Паника при разборе кадра одной станции не должна ронять весь сервер:
+	// пишем ее в лог и закрываем только это соединение, запись о станции
+	// убирает defer выше
+	defer func() {
+		if r := recover(); r != nil {
+			connectionPanics.Inc()
+			logger.Error("panic in station connection, closing it", "station_id", stationID, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	loggedIn := false
+	var retransmits retransmitBudget
 
 	for {
-		n, err := c.Read(buf)
+		// Idle timeout: дедлайн сдвигается после каждого успешного чтения
+		if cfg.IdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(cfg.IdleTimeout))
+		}
+		n, err := c.Read(chunk)
 		if err != nil {
-			log.Printf("Connection error: %v", err)
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				logger.Warn("station idle timeout, closing connection", "station_id", stationID, "idle_timeout", cfg.IdleTimeout)
+				return
+			}
+			logger.Info("connection error", "station_id", stationID, "error", err)
 			return
 		}
-		log.Printf("Received from station: %x", buf[:n])
+		buf = append(buf, chunk[:n]...)
 
-		resp, id := protocol.HandleIncoming(buf[:n])
-		if id != "" && stationID == "" {
-			stationID = id
-			mu.Lock()
-			connections[stationID] = c
-			mu.Unlock()
-			log.Printf("Station registered with ID: %s", stationID)
-		}
+		off := 0
+		for len(buf)-off >= 2 {
+			// PackLen меньше заголовка или больше лимита - станция не в себе,
+			// дальше кадры не разобрать
+			if err := protocol.CheckPackLen(buf[off:], cfg.MaxFrameSize); err != nil {
+				framesRejected.Inc()
+				logger.Warn("invalid PackLen, closing connection", "station_id", stationID, "len", len(buf)-off, "error", err)
+				publishAnomaly(stationID, sessionID, anomalyPackLen, buf[off:], err)
+				return
+			}
+			size := protocol.FrameLen(buf[off:])
+			if size == 0 {
+				// Остаток кадра придет следующим чтением
+				break
+			}
+			// Кадр уходит ждущим ответа и в события, а буфер перезаписывается
+			// следующим чтением - отдаем копию
+			frame := append([]byte(nil), buf[off:off+size]...)
+			off += size
+			// CheckPackLen гарантирует полный заголовок, Cmd на месте
+			cmdHex := fmt.Sprintf("0x%02x", frame[2])
+			logger.Info("frame received", "station_id", stationID, "cmd", cmdHex, "len", len(frame))
+			logger.Debug("frame received hex", "station_id", stationID, "hex", fmt.Sprintf("%x", frame))
 
-		if resp != nil {
-			_, err := c.Write(resp)
-			if err != nil {
-				log.Printf("Write error: %v", err)
+			if !protocol.IsHandledCommand(frame[2]) {
+				unknownCommands.Inc(stationID)
+				logger.Warn("unknown command from station", "station_id", stationID, "cmd", cmdHex)
+				publishAnomaly(stationID, sessionID, anomalyUnknown, frame, nil)
+			}
+			if !protocol.ChecksumValid(frame) {
+				publishAnomaly(stationID, sessionID, anomalyChecksum, frame, protocol.ErrBadChecksum)
+			}
+
+			resp, id := protocol.HandleIncoming(frame)
+			// Без ID на Login при включенной проверке Magic - станция не прошла
+			// аутентификацию: отдаем отказ и закрываем соединение
+			if protocol.LoginAuthEnabled() && id == "" && stationID == "" && frame[2] == protocol.CmdLogin {
+				if resp != nil {
+					writeFrame(c, resp, cfg.WriteTimeout)
+				}
+				logger.Warn("closing connection after rejected login", "remote_addr", c.RemoteAddr().String())
+				publishAnomaly("", sessionID, anomalyLoginRejected, frame, nil)
 				return
 			}
-			log.Printf("Sent response to %s: %x", stationID, resp)
+			if id != "" && stationID == "" {
+				stationID = normalizeStationID(id)
+				if stationID != id {
+					logger.Info("normalized station ID from login", "box_id", id, "station_id", stationID)
+				}
+				msg, _ := protocol.Decode(frame)
+				station = newStation(stationID, c, acceptedAt, msg.Token, msg.Version)
+				station.SessionID = sessionID
+				if capture != nil {
+					capture.bind(stationID)
+				}
+				mu.Lock()
+				prev, exists := registerStation(station)
+				mu.Unlock()
+				// Старое соединение могло еще не отвалиться: закрываем его, чтобы
+				// /send не писал в мертвый сокет. В -multi-conn оба остаются.
+				if exists && cfg.MultiConn {
+					logger.Info("additional connection for station", "station_id", stationID, "conn_id", station.ConnID, "remote_addr", c.RemoteAddr().String())
+				} else if exists {
+					prev.Conn.Close()
+					logger.Warn("station re-login, closed previous connection", "station_id", stationID,
+						"old_remote_addr", prev.Conn.RemoteAddr().String(), "remote_addr", c.RemoteAddr().String())
+				}
+				logger.Info("station registered", "station_id", stationID, "conn_id", station.ConnID, "remote_addr", c.RemoteAddr().String())
+				restartCompleted(stationID)
+				loggedIn = true
+			}
+
+			// Кадр неразрешенной версии HandleIncoming отбросил, в запись
+			// станции он тоже не попадает
+			if station != nil && protocol.AcceptedVersions[frame[3]] {
+				station.receive(frame)
+			}
+			valid := protocol.ChecksumValid(frame)
+			if nack := retransmits.allow(valid); resp != nil && cfg.NackChecksum && !valid {
+				if !nack {
+					logger.Warn("retransmit limit reached, dropping bad-checksum frame", "station_id", stationID, "cmd", cmdHex)
+					resp = nil
+				} else if station != nil {
+					station.retransmitRequested()
+				}
+			}
+
+			if resp != nil {
+				var err error
+				if station != nil {
+					_, err = station.write(resp, cfg.WriteTimeout)
+				} else {
+					// До логина станции нет в connections, писать больше некому
+					_, err = writeFrame(c, resp, cfg.WriteTimeout)
+				}
+				if err != nil {
+					logger.Warn("write error", "station_id", stationID, "error", err)
+					return
+				}
+				logger.Info("sent response", "station_id", stationID, "cmd", fmt.Sprintf("0x%02x", resp[2]), "len", len(resp))
+				logger.Debug("sent response hex", "station_id", stationID, "hex", fmt.Sprintf("%x", resp))
+			}
+			// Инвентарь запрашиваем только после ответа на логин
+			if loggedIn {
+				loggedIn = false
+				refreshInventory(station)
+			}
+		}
+		// Хвост недочитанного кадра переносим в начало буфера
+		buf = buf[:copy(buf, buf[off:])]
+	}
+}
+
+// Команды, которые сервер сам разворачивает в последовательность фреймов
+var serverCommands = []string{"eject_all"}
+
+func isKnownCommand(cmd string) bool {
+	for _, name := range serverCommands {
+		if name == cmd {
+			return true
+		}
+	}
+	return protocol.IsKnownCommand(cmd)
+}
+
+func knownCommandNames() []string {
+	names := append(protocol.KnownCommands(), serverCommands...)
+	sort.Strings(names)
+	return names
+}
+
+// writeFrame пишет кадр целиком. Write может вернуть меньше байт, чем
+// передано, поэтому дописываем остаток; запись без прогресса и без ошибки
+// считается io.ErrShortWrite. Возвращает, сколько байт ушло в сокет.
+func writeFrame(c StationConn, frame []byte, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	written := 0
+	for written < len(frame) {
+		n, err := c.Write(frame[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Повторять имеет смысл только таймаут, при котором в сокет ничего не
+// ушло: иначе повтор порвет фрейм. Остальные ошибки значат, что
+// соединение мертво.
+func retryableWrite(n int, err error) bool {
+	var ne net.Error
+	return n == 0 && errors.As(err, &ne) && ne.Timeout()
+}
+
+// sendToStation - общий путь записи команды в станцию для /send и /send/bulk.
+// Отмененный ctx прекращает повторы, дедлайн ctx ограничивает таймаут записи.
+func sendToStation(ctx context.Context, station *Station, cmd string, payload []byte, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	slog.Debug("sending command", "station_id", station.ID, "cmd", cmd, "hex", fmt.Sprintf("%x", payload))
+	start := time.Now()
+	var err error
+	for attempt := 0; ; attempt++ {
+		var n int
+		n, err = station.write(payload, timeout)
+		if err == nil || !retryableWrite(n, err) || attempt >= cfg.WriteRetries {
+			break
+		}
+		backoff := cfg.WriteRetryBackoff << attempt
+		slog.Warn("write to station timed out, retrying", "station_id", station.ID, "cmd", cmd, "attempt", attempt+1, "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			// Последняя запись не прошла по таймауту, соединение живо
+			sendDuration.Observe(time.Since(start).Seconds())
+			return ctx.Err()
 		}
 	}
+	sendDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		slog.Warn("failed to send command", "station_id", station.ID, "cmd", cmd, "error", err)
+		if !retryableWrite(0, err) {
+			// Соединение мертво, убираем станцию, чтобы /stations не врал
+			removeStation(station)
+		}
+		return err
+	}
+	commandsSent.Inc(cmd)
+	noteCommandWritten(station, cmd)
+	slog.Info("command sent", "station_id", station.ID, "cmd", cmd, "len", len(payload))
+	return nil
 }
 
 func handleSendCommand(w http.ResponseWriter, r *http.Request) {
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
 	var req SendCommandRequest
 	var stationID, cmd, token, slot string
+	var address, port, connID, tokenFormat string
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	wait := r.URL.Query().Get("wait") == "true"
+	blocking := r.URL.Query().Get("sync") == "true"
+	confirm := r.URL.Query().Get("confirm") == "true"
+	var version byte
 
 	// Поддерживаем как JSON, так и URL параметры
 	if r.Header.Get("Content-Type") == "application/json" || strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		if err := json.Unmarshal(body, &req); err != nil {
-			http.Error(w, fmt.Sprintf("Error parsing JSON: %v", err), http.StatusBadRequest)
+		if field, err := decodeStrict(r.Body, &req); err != nil {
+			resp := map[string]interface{}{"error": fmt.Sprintf("Error parsing JSON: %v", err)}
+			if field != "" {
+				resp["field"] = field
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(resp)
 			return
 		}
 
 		stationID = req.StationID
 		cmd = req.Cmd
 		token = req.Token
+		tokenFormat = req.TokenFormat
 		slot = req.Slot
+		address = req.Address
+		port = req.Port
+		dryRun = dryRun || req.DryRun
+		wait = wait || req.Wait
+		blocking = blocking || req.Sync
+		confirm = confirm || req.Confirm
+		connID = req.ConnID
+		version = req.Version
 	} else {
 		// URL параметры (поддерживаем оба варианта названий)
 		stationID = r.URL.Query().Get("stationID")
@@ -141,39 +659,253 @@ func handleSendCommand(w http.ResponseWriter, r *http.Request) {
 		}
 		cmd = r.URL.Query().Get("cmd")
 		token = r.URL.Query().Get("token")
+		tokenFormat = r.URL.Query().Get("tokenFormat")
 		slot = r.URL.Query().Get("slot")
+		address = r.URL.Query().Get("address")
+		port = r.URL.Query().Get("port")
+		connID = r.URL.Query().Get("connID")
+		if v, err := strconv.Atoi(r.URL.Query().Get("version")); err == nil {
+			version = byte(v)
+		}
+	}
+	params := protocol.Params{Slot: slot, Address: address, Port: port}
+
+	// Дальше токен идет в hex: его же берут eject_all и токен сессии
+	if token != "" && tokenFormat != "" {
+		b, err := protocol.ParseTokenFormat(token, tokenFormat)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		token = hex.EncodeToString(b)
 	}
 
-	log.Printf("Send command request: stationID=%s, cmd=%s, token=%s, slot=%s", stationID, cmd, token, slot)
+	slog.Debug("send command request", "station_id", stationID, "cmd", cmd, "slot", slot)
 
-	if stationID == "" || cmd == "" || token == "" {
-		http.Error(w, "Missing required parameters: station_id/stationID, cmd, token", http.StatusBadRequest)
+	if dryRun {
+		handleDryRun(w, cmd, token, params, version)
 		return
 	}
 
-	mu.RLock()
-	conn, exists := connections[stationID]
-	mu.RUnlock()
+	if stationID == "" || cmd == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing required parameters: station_id/stationID, cmd")
+		return
+	}
 
+	if !isKnownCommand(cmd) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   fmt.Sprintf("Unknown command: %s", cmd),
+			"allowed": knownCommandNames(),
+		})
+		return
+	}
+	if !checkCommandPolicy(w, cmd) {
+		return
+	}
+	if confirm && cmd != "eject" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("confirm is only supported for eject, got %s", cmd))
+		return
+	}
+
+	station, exists := lookupStation(stationID, connID)
+	if !exists && connID != "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("No connection %s for station %s", connID, stationID))
+		return
+	}
 	if !exists {
-		log.Printf("Station %s not found in connections. Available stations: %v", stationID, getConnectedStationIDs())
-		http.Error(w, fmt.Sprintf("No station connected with ID: %s", stationID), http.StatusBadRequest)
+		slog.Debug("station not found in connections", "station_id", stationID, "available", getConnectedStationIDs())
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("No station connected with ID: %s", stationID))
+		return
+	}
+
+	// Без token берем токен сессии, с которым станция залогинилась
+	if token == "" {
+		token = station.tokenHex()
+	}
+	if token == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Missing token: station %s has no stored session token", stationID))
+		return
+	}
+
+	withIdempotency(w, r.Header.Get("Idempotency-Key"), stationID, func(w http.ResponseWriter) {
+		if confirm {
+			dispatchConfirmedEject(r.Context(), w, station, token, slot, caller)
+			return
+		}
+		dispatchCommand(r.Context(), w, station, cmd, token, slot, params, caller, wait, blocking)
+	})
+}
+
+// decodeStrict разбирает одно JSON значение из body в v. Неизвестные поля,
+// поля не того типа и данные после значения - ошибка; field называет
+// поле, к которому она относится, если это известно.
+func decodeStrict(body io.Reader, v interface{}) (field string, err error) {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr):
+			return typeErr.Field, fmt.Errorf("field %q must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind()), typeErr.Value)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			// У encoding/json нет отдельного типа для этой ошибки
+			field = strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return field, fmt.Errorf("unknown field %q", field)
+		}
+		return "", err
+	}
+	if dec.More() {
+		return "", errors.New("unexpected data after the JSON object")
+	}
+	return "", nil
+}
+
+// jsonTypeName - тип поля запроса в терминах JSON
+func jsonTypeName(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Uint8:
+		return "a number between 0 and 255"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float64:
+		return "a number"
+	}
+	return k.String()
+}
+
+// checkSlotInCabinet разбирает слот rent/eject и отвечает 400, если он
+// битый или за пределами шкафа: такой слот станция все равно отклонит
+func checkSlotInCabinet(w http.ResponseWriter, station *Station, slot string) bool {
+	n, err := protocol.ParseRentSlot(slot, station.Version())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if count := station.SlotCount(); count > 0 && int(n) > count {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%v: slot %d exceeds station %s slot count %d", protocol.ErrInvalidSlot, n, station.ID, count))
+		return false
+	}
+	return true
+}
+
+// dispatchCommand проверяет лимит и версию, собирает кадр и пишет его станции.
+// С wait ждет ответ станции и возвращает результат по слоту. Аппаратные
+// команды идут через очередь станции, см. dispatchQueued: wait или
+// blocking (?sync) ждут их выполнения. Отмена ctx (клиент ушел) прекращает
+// запись и ожидание ответа.
+func dispatchCommand(ctx context.Context, w http.ResponseWriter, station *Station, cmd, token, slot string, params protocol.Params, caller string, wait, blocking bool) {
+	stationID := station.ID
+	if !checkRebooting(w, station) {
+		return
+	}
+	if !checkRateLimit(w, stationID, cmd) {
 		return
 	}
 
-	payload := protocol.CreateCommand(cmd, token, slot)
-	if payload == nil {
-		http.Error(w, "Invalid command or parameters", http.StatusBadRequest)
+	if cmd == "eject_all" || cmd == "multi_eject" {
+		// eject_all и multi_eject сами ждут выдачи, поэтому в очереди всегда
+		// синхронные
+		err := station.queue.run(ctx, station.queue.enqueue(), func() {
+			if cmd == "multi_eject" {
+				handleMultiEject(ctx, w, station, token, params.Slot, caller)
+				return
+			}
+			handleEjectAll(ctx, w, station, token, caller)
+		})
+		if err != nil {
+			writeJSONError(w, canceledStatus(err), fmt.Sprintf("Request canceled: %v", err))
+		}
+		return
+	}
+
+	version := station.Version()
+	if !protocol.CommandSupported(cmd, version) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Command %s is not supported by station %s (protocol version %d)", cmd, stationID, version))
+		return
+	}
+
+	// Запрос одного слота: если прошивка не умеет, спрашиваем весь шкаф и
+	// фильтруем ответ на сервере
+	var slotFilter byte
+	singleSlot := false
+	if cmd == "query_power_bank" && strings.TrimSpace(params.Slot) != "" {
+		n, err := protocol.ParseSlot(params.Slot)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slotFilter = n
+		singleSlot = protocol.SupportsSlotQuery(version)
+		if !singleSlot {
+			params.Slot = ""
+		}
+	}
+
+	if (cmd == "rent" || cmd == "eject") && !checkSlotInCabinet(w, station, params.Slot) {
 		return
 	}
+	// Одна аппаратная операция на слот: второй запрос к занятому слоту - 409
+	release := func() {}
+	if cmd == "rent" || cmd == "eject" {
+		var ok bool
+		if release, ok = lockSlot(stationID, params.Slot); !ok {
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("Slot %s of station %s is busy with another rent/eject", strings.TrimSpace(params.Slot), stationID))
+			return
+		}
+	}
 
-	log.Printf("Sending command to station %s: %x", stationID, payload)
-	_, err := conn.Write(payload)
+	payload, err := protocol.CreateCommandParams(cmd, token, params, version)
 	if err != nil {
-		log.Printf("Failed to send command to station %s: %v", stationID, err)
-		http.Error(w, fmt.Sprintf("Failed to send command: %v", err), http.StatusInternalServerError)
+		release()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if singleSlot {
+		// Ответ на запрос одного слота не должен затереть весь инвентарь
+		station.beginSlotQuery(protocol.FrameToken(payload), slotFilter)
+	}
+
+	audit := store.AuditEntry{
+		StationID: stationID,
+		Command:   cmd,
+		Slot:      slot,
+		Caller:    caller,
+		Payload:   fmt.Sprintf("%x", payload),
+		Result:    "sent",
+	}
+	if hardwareCommands[cmd] {
+		dispatchQueued(ctx, w, station, cmd, payload, params, audit, wait || blocking, release)
+		return
+	}
+	// Ждать ответа на команду без ответа бессмысленно: это всегда таймаут
+	if wait && protocol.ExpectsReply(cmd) {
+		if sendCommandAndWait(ctx, w, station, cmd, slotFilter, payload, audit) {
+			noteCommandSent(station, cmd, params)
+		} else if singleSlot {
+			station.cancelSlotQuery(protocol.FrameToken(payload), slotFilter)
+		}
+		return
+	}
+	if err := sendToStation(ctx, station, cmd, payload, cfg.WriteTimeout); err != nil {
+		if singleSlot {
+			station.cancelSlotQuery(protocol.FrameToken(payload), slotFilter)
+		}
+		if status := canceledStatus(err); status != 0 {
+			audit.Result, audit.Error = "canceled", err.Error()
+			recordAudit(audit)
+			writeJSONError(w, status, fmt.Sprintf("Request canceled before the command was sent: %v", err))
+			return
+		}
+		audit.Result, audit.Error = "write_failed", err.Error()
+		recordAudit(audit)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to send command: %v", err))
 		return
 	}
+	recordAudit(audit)
+	noteCommandSent(station, cmd, params)
 
 	response := map[string]interface{}{
 		"status":    "success",
@@ -181,31 +913,212 @@ func handleSendCommand(w http.ResponseWriter, r *http.Request) {
 		"stationID": stationID,
 		"command":   cmd,
 		"payload":   fmt.Sprintf("%x", payload),
+		"delivery":  deliveryWithoutWait(cmd),
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleDryRun собирает фрейм без поиска станции и без записи в сокет
+func handleDryRun(w http.ResponseWriter, cmd, token string, params protocol.Params, version byte) {
+	if cmd == "" || token == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing required parameters: cmd, token")
+		return
+	}
+	if !protocol.IsKnownCommand(cmd) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   fmt.Sprintf("Command %s cannot be dry-run", cmd),
+			"allowed": protocol.KnownCommands(),
+		})
+		return
+	}
+	if version == 0 {
+		version = protocol.Version1
+	}
+
+	payload, err := protocol.CreateCommandParams(cmd, token, params, version)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"dryRun":    true,
+		"command":   cmd,
+		"payload":   fmt.Sprintf("%x", payload),
+		"breakdown": protocol.Breakdown(payload),
+	})
+}
+
+// handleListStations отдает станции по ID по возрастанию. Параметры:
+// ?status=connected|stale|restarting, ?limit (по умолчанию 100), ?offset.
+// В ответе токен сессии, поэтому нужен ключ.
 func handleListStations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
+	q := r.URL.Query()
+	status := q.Get("status")
+	if status != "" && status != "connected" && status != "stale" && status != "restarting" && status != "offline" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid status: %s (use connected, stale, restarting or offline)", status))
+		return
+	}
+	limit, offset := 100, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit: %s", v))
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid offset: %s", v))
+			return
+		}
+		offset = n
+	}
+
 	mu.RLock()
-	stations := make([]StationInfo, 0, len(connections))
-	for stationID := range connections {
-		stations = append(stations, StationInfo{
-			StationID: stationID,
-			Status:    "connected",
-			Token:     "11223344", // Можно хранить реальные токены если нужно
-		})
+	all := make([]*Station, 0, len(connections))
+	for _, st := range connections {
+		all = append(all, st)
 	}
 	mu.RUnlock()
 
-	response := StationsResponse{
-		Count:    len(stations),
-		Stations: stations,
+	now := time.Now()
+	stations := make([]StationInfo, 0, len(all))
+	for _, st := range all {
+		info := StationInfo{
+			StationID:      st.ID,
+			Status:         st.connStatus(now),
+			Token:          st.tokenHex(),
+			ConnectedSince: st.ConnectedSince,
+			Uptime:         st.uptime(now),
+		}
+		if status == "" || info.Status == status {
+			stations = append(stations, info)
+		}
+	}
+	sort.Slice(stations, func(i, j int) bool { return stations[i].StationID < stations[j].StationID })
+	// Отключенные станции из store - только по явному запросу
+	if status == "offline" {
+		stations = offlineStations()
 	}
 
-	json.NewEncoder(w).Encode(response)
+	total := len(stations)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	page := stations[offset:end]
+
+	json.NewEncoder(w).Encode(StationsResponse{
+		Count:    len(page),
+		Total:    total,
+		Offset:   offset,
+		Limit:    limit,
+		Stations: page,
+	})
+}
+
+// handleStation разбирает пути вида /stations/{id}[/action]
+func handleStation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stationID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/stations/"), "/")
+
+	switch action {
+	case "":
+		handleStationDetail(w, r, stationID)
+	case "disconnect":
+		handleStationDisconnect(w, r, stationID)
+	case "history":
+		handleStationHistory(w, r, stationID)
+	case "trace":
+		handleStationTrace(w, r, stationID)
+	case "return":
+		handleStationReturn(w, r, stationID)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown station action: %s", action))
+	}
+}
+
+func handleStationDetail(w http.ResponseWriter, r *http.Request, stationID string) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	station, exists := lookupStation(stationID, r.URL.Query().Get("connID"))
+
+	if !exists {
+		resp := map[string]interface{}{
+			"error": fmt.Sprintf("No station connected with ID: %s", stationID),
+		}
+		// Станция может быть известна по прошлым подключениям
+		if rec, ok := knownStation(stationID); ok {
+			resp["lastKnown"] = rec
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	detail := station.detail()
+	if cfg.MultiConn {
+		detail.Connections = sessionIDs(stationID)
+	}
+	json.NewEncoder(w).Encode(detail)
+}
+
+func handleStationDisconnect(w http.ResponseWriter, r *http.Request, stationID string) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST to disconnect a station")
+		return
+	}
+
+	// Удаляем запись под локом до закрытия сокета: отложенная очистка в
+	// handleConnection увидит, что ее записи в реестре уже нет
+	station, exists := lookupStation(stationID, r.URL.Query().Get("connID"))
+	if exists {
+		mu.Lock()
+		dropStation(station)
+		mu.Unlock()
+	}
+
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No station connected with ID: %s", stationID))
+		return
+	}
+
+	station.Conn.Close()
+	slog.Info("station force-disconnected", "station_id", stationID, "conn_id", station.ConnID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"message":   fmt.Sprintf("Station %s disconnected", stationID),
+		"stationID": stationID,
+		"connID":    station.ConnID,
+	})
+}
+
+// writeJSONError отвечает {"error": msg} с заданным статусом
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
 func handlePong(w http.ResponseWriter, r *http.Request) {
@@ -213,6 +1126,16 @@ func handlePong(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("pong"))
 }
 
+// removeStation удаляет станцию из реестра, если запись все еще указывает
+// на нее, и закрывает соединение
+func removeStation(station *Station) {
+	mu.Lock()
+	dropStation(station)
+	mu.Unlock()
+	station.Conn.Close()
+	station.failWaiters()
+}
+
 func getConnectedStationIDs() []string {
 	mu.RLock()
 	defer mu.RUnlock()
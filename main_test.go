@@ -0,0 +1,921 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"server/internal/protocol"
+	"server/internal/store"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	log.SetOutput(io.Discard)
+
+	// Как в main, но без флагов: тесты сами меняют cfg там, где нужно.
+	// Лимитеры не заданы (nil не ограничивает), тесты лимита ставят свои.
+	cfg.RefreshOnLogin = false
+	policy, err := parseCommandPolicy(cfg.CommandPolicy, cfg.AllowCommands, cfg.DenyCommands)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sendPolicy = policy
+
+	os.Exit(m.Run())
+}
+
+var testToken = []byte{0x11, 0x22, 0x33, 0x44}
+
+const testTimeout = 2 * time.Second
+
+// testPeer - сторона станции в net.Pipe, на другом конце которого
+// работает handleConnection
+type testPeer struct {
+	conn   net.Conn
+	frames chan []byte
+	// закрывается, когда handleConnection вернулся
+	done chan struct{}
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	t.Helper()
+	client, server := net.Pipe()
+	p := &testPeer{conn: client, frames: make(chan []byte, 64), done: make(chan struct{})}
+	go func() {
+		handleConnection(server)
+		close(p.done)
+	}()
+	go p.readFrames()
+	t.Cleanup(func() {
+		client.Close()
+		select {
+		case <-p.done:
+		case <-time.After(testTimeout):
+			t.Errorf("handleConnection did not return after the peer closed")
+		}
+	})
+	return p
+}
+
+func (p *testPeer) readFrames() {
+	defer close(p.frames)
+	var buf []byte
+	chunk := make([]byte, 1024)
+	for {
+		n, err := p.conn.Read(chunk)
+		if err != nil {
+			return
+		}
+		buf = append(buf, chunk[:n]...)
+		for {
+			size := protocol.FrameLen(buf)
+			if size == 0 {
+				break
+			}
+			p.frames <- append([]byte(nil), buf[:size]...)
+			buf = buf[size:]
+		}
+	}
+}
+
+func (p *testPeer) send(t *testing.T, data []byte) {
+	t.Helper()
+	p.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := p.conn.Write(data); err != nil {
+		t.Fatalf("write to server: %v", err)
+	}
+}
+
+// next ждет следующий кадр от сервера
+func (p *testPeer) next(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case frame, ok := <-p.frames:
+		if !ok {
+			t.Fatalf("connection closed while waiting for a frame")
+		}
+		return frame
+	case <-time.After(testTimeout):
+		t.Fatalf("no frame from server within %v", testTimeout)
+	}
+	return nil
+}
+
+// waitClosed проверяет, что сервер сам закрыл соединение
+func (p *testPeer) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-p.done:
+	case <-time.After(testTimeout):
+		t.Fatalf("server did not close the connection")
+	}
+}
+
+func loginFrame(boxID string, version byte) []byte {
+	return protocol.LoginFrame(protocol.LoginPayload{Rand: []byte{1, 2, 3, 4}, Magic: 0x1234, BoxID: boxID}, testToken, version)
+}
+
+// login логинит станцию и ждет ответ на Login и запись в реестре
+func (p *testPeer) login(t *testing.T, boxID string, version byte) *Station {
+	t.Helper()
+	p.send(t, loginFrame(boxID, version))
+	if resp := p.next(t); resp[2] != protocol.CmdLogin {
+		t.Fatalf("login response cmd = 0x%02x", resp[2])
+	}
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if st, ok := lookupStation(boxID, ""); ok {
+			return st
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("station %s not registered", boxID)
+	return nil
+}
+
+// emulate отвечает на команды сервера эмулятором станции с профилем
+// profile. Возвращает функцию, отдающую кадры, полученные от сервера.
+func (p *testPeer) emulate(profile protocol.Profile) func() [][]byte {
+	var mu sync.Mutex
+	var received [][]byte
+	go func() {
+		for frame := range p.frames {
+			mu.Lock()
+			received = append(received, frame)
+			mu.Unlock()
+			if resp := protocol.EmulateResponse(frame, profile); resp != nil {
+				p.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+				if _, err := p.conn.Write(resp); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]byte(nil), received...)
+	}
+}
+
+// testProfile - профиль эмулятора со своей копией слотов по умолчанию
+func testProfile() protocol.Profile {
+	return protocol.Profile{Firmware: protocol.DefaultProfile.Firmware, ICCID: protocol.DefaultProfile.ICCID, SlotCount: 12, Slots: protocol.DefaultSlots.Copy()}
+}
+
+// eventually ждет, пока cond не станет true
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func heartbeatFrame(t *testing.T, version byte) []byte {
+	t.Helper()
+	frame, err := protocol.CreateCommand("heartbeat", "11223344", "", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// fakeStation регистрирует станцию в памяти, которой отвечает эмулятор, и
+// убирает ее из реестра после теста
+func fakeStation(t *testing.T, id string, version byte) (*Station, *fakeConn) {
+	t.Helper()
+	profile := protocol.Profile{Firmware: protocol.DefaultProfile.Firmware, ICCID: protocol.DefaultProfile.ICCID, SlotCount: 12}
+	station, conn := injectFakeStation(id, testToken, version, profile)
+	t.Cleanup(func() {
+		mu.Lock()
+		dropStation(station)
+		mu.Unlock()
+	})
+	return station, conn
+}
+
+// keepConfig восстанавливает cfg после теста, который его меняет
+func keepConfig(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+}
+
+// useStore подменяет stationStore до конца теста
+func useStore(t *testing.T, st store.Store) {
+	prev := stationStore
+	stationStore = st
+	t.Cleanup(func() {
+		stationStore = prev
+		st.Close()
+	})
+}
+
+// serve вызывает handler с запросом method target и JSON body
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// useAPIKeys включает проверку X-API-Key до конца теста
+func useAPIKeys(t *testing.T, keys map[string]string) {
+	prev := apiKeys
+	apiKeys = keys
+	t.Cleanup(func() { apiKeys = prev })
+}
+
+// serveWithKey - serve с заголовком X-API-Key
+func serveWithKey(handler http.HandlerFunc, method, target, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, rec.Body.String())
+	}
+	return v
+}
+
+func TestPackLenRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		packLen uint16
+	}{
+		{"zero", 0},
+		{"below header", 3},
+		{"enormous", 0xFFFF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPeer(t)
+			// Заголовок без тела: сервер не должен ждать остаток кадра
+			frame := binary.BigEndian.AppendUint16(nil, tt.packLen)
+			frame = append(frame, protocol.CmdHeartbeat, protocol.Version1, 0x00)
+			p.send(t, frame)
+			p.waitClosed(t)
+		})
+	}
+}
+
+// Два кадра в одном чтении и кадр, разрезанный на два чтения
+func TestFramesSplitByPackLen(t *testing.T) {
+	p := newTestPeer(t)
+	login := loginFrame("FRAMING1", protocol.Version1)
+	heartbeat := heartbeatFrame(t, protocol.Version1)
+
+	p.send(t, append(append([]byte(nil), login...), heartbeat...))
+	if resp := p.next(t); resp[2] != protocol.CmdLogin {
+		t.Fatalf("first reply cmd = 0x%02x, want login", resp[2])
+	}
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Fatalf("second reply cmd = 0x%02x, want heartbeat", resp[2])
+	}
+
+	p.send(t, heartbeat[:3])
+	p.send(t, heartbeat[3:])
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Fatalf("reply to split frame cmd = 0x%02x, want heartbeat", resp[2])
+	}
+}
+
+// Запрос одного слота: v2 спрашивает слот у станции, v1 - весь шкаф, и
+// сервер сам оставляет в ответе нужный слот
+func TestSingleSlotQueryFallback(t *testing.T) {
+	for _, version := range []byte{protocol.Version1, protocol.Version2} {
+		id := fmt.Sprintf("SLOTQ%d", version)
+		fakeStation(t, id, version)
+		rec := serve(handleSendCommand, http.MethodGet, "/send?stationID="+id+"&cmd=query_power_bank&slot=3&wait=true", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("v%d: status %d: %s", version, rec.Code, rec.Body.String())
+		}
+		inventory, _ := decodeJSON(t, rec)["inventory"].([]interface{})
+		if len(inventory) != 1 || inventory[0].(map[string]interface{})["slot"] != float64(3) {
+			t.Errorf("v%d: inventory = %v, want slot 3 only", version, inventory)
+		}
+	}
+}
+
+func authLoginFrame(boxID string, magic uint16) []byte {
+	return protocol.LoginFrame(protocol.LoginPayload{Rand: []byte{1, 2, 3, 4}, Magic: magic, BoxID: boxID}, testToken, protocol.Version1)
+}
+
+// С общим ключом логин с неверным Magic получает отказ и закрытие, с верным -
+// регистрируется; без ключа кадры до логина проверку не проходят вовсе
+func TestLoginRejection(t *testing.T) {
+	protocol.LoginSecret = []byte("secret")
+	defer func() { protocol.LoginSecret = nil }()
+
+	p := newTestPeer(t)
+	p.send(t, authLoginFrame("AUTHBAD", protocol.ExpectedMagic([]byte{1, 2, 3, 4})^0xFFFF))
+	p.waitClosed(t)
+	if _, ok := lookupStation("AUTHBAD", ""); ok {
+		t.Errorf("station registered despite a wrong Magic")
+	}
+
+	p = newTestPeer(t)
+	p.send(t, authLoginFrame("AUTHOK", protocol.ExpectedMagic([]byte{1, 2, 3, 4})))
+	if resp := p.next(t); resp[2] != protocol.CmdLogin {
+		t.Fatalf("login response cmd = 0x%02x", resp[2])
+	}
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Fatalf("reply cmd = 0x%02x, want heartbeat", resp[2])
+	}
+
+	protocol.LoginSecret = nil
+	p = newTestPeer(t)
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Fatalf("heartbeat before login without a secret: reply cmd = 0x%02x", resp[2])
+	}
+}
+
+// restart помечает станцию сразу после записи: станция может оборвать
+// соединение, не ответив, а следующие команды должны получить 409
+func TestRestartRebootingWithoutReply(t *testing.T) {
+	useStore(t, store.NewMemory())
+	p := newTestPeer(t)
+	p.login(t, "REBOOT1", protocol.Version1)
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- serve(handleSendCommand, http.MethodGet, "/send?stationID=REBOOT1&cmd=restart&wait=true", "")
+	}()
+	if frame := p.next(t); frame[2] != protocol.CmdRestart {
+		t.Fatalf("frame cmd = 0x%02x, want restart", frame[2])
+	}
+	// Запись в net.Pipe завершается вместе с чтением, отметка - чуть позже
+	eventually(t, "station marked restarting", func() bool { return restarting("REBOOT1") })
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=REBOOT1&cmd=heartbeat", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("command during reboot: status %d, want 409", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("409 without Retry-After")
+	}
+
+	// Станция уходит в перезагрузку: ожидание ответа снимается сразу, а
+	// кадр записан - это успех
+	p.conn.Close()
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK {
+			t.Fatalf("restart after disconnect: status %d, want 200: %s", rec.Code, rec.Body.String())
+		}
+		if resp := decodeJSON(t, rec); resp["status"] != "success" || resp["delivery"] != deliveryWritten {
+			t.Errorf("restart after disconnect = %v", resp)
+		}
+		if entries := auditEntries(t, "REBOOT1"); len(entries) != 1 || entries[0].(map[string]interface{})["result"] != "sent" {
+			t.Errorf("restart audit = %v, want one sent entry", entries)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("restart request still waiting after the connection closed")
+	}
+}
+
+func TestRejectedVersionNotApplied(t *testing.T) {
+	protocol.AcceptedVersions = map[byte]bool{protocol.Version1: true}
+	defer func() { protocol.AcceptedVersions = map[byte]bool{protocol.Version1: true, protocol.Version2: true} }()
+
+	p := newTestPeer(t)
+	station := p.login(t, "VERSION1", protocol.Version1)
+
+	query, err := protocol.CreateCommand("query_power_bank", "11223344", "", protocol.Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(t, protocol.EmulateResponse(query, protocol.DefaultProfile))
+	// Ответ на heartbeat означает, что кадр перед ним уже обработан
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Fatalf("reply cmd = 0x%02x, want heartbeat", resp[2])
+	}
+	if inv := station.cachedInventory(); inv != nil {
+		t.Errorf("inventory from a v2 frame applied: %+v", inv)
+	}
+}
+
+// Лимит NACK на кадры с неверной checksum действует и до логина
+func TestRetransmitCapBeforeLogin(t *testing.T) {
+	cfg.NackChecksum, protocol.NackChecksum = true, true
+	cfg.MaxRetransmits = 2
+	defer func() {
+		cfg.NackChecksum, protocol.NackChecksum = false, false
+		cfg.MaxRetransmits = 3
+	}()
+
+	p := newTestPeer(t)
+	bad := heartbeatFrame(t, protocol.Version1)
+	bad[4] ^= 0xFF
+	for i := 0; i < 3; i++ {
+		p.send(t, bad)
+	}
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+
+	for i := 0; i < 2; i++ {
+		if resp := p.next(t); resp[len(resp)-1] != protocol.ResultRetransmit {
+			t.Fatalf("reply %d = %x, want NACK", i, resp)
+		}
+	}
+	// Третий плохой кадр отброшен молча, следующим приходит ответ на верный
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat || resp[len(resp)-1] == protocol.ResultRetransmit {
+		t.Fatalf("reply after the cap = %x, want heartbeat reply", resp)
+	}
+}
+
+// Станция, которая молчит, отключается по cfg.IdleTimeout
+func TestIdleTimeout(t *testing.T) {
+	cfg.IdleTimeout = 50 * time.Millisecond
+	defer func() { cfg.IdleTimeout = 5 * time.Minute }()
+
+	start := time.Now()
+	p := newTestPeer(t)
+	p.waitClosed(t)
+	if elapsed := time.Since(start); elapsed < cfg.IdleTimeout {
+		t.Errorf("connection closed after %v, before the idle timeout", elapsed)
+	}
+}
+
+// Запись в сокет, который никто не читает, не висит дольше таймаута
+func TestWriteFrameTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	n, err := writeFrame(server, heartbeatFrame(t, protocol.Version1), 50*time.Millisecond)
+	if !retryableWrite(n, err) {
+		t.Fatalf("writeFrame = %d, %v, want a timeout with nothing written", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > testTimeout {
+		t.Errorf("write blocked for %v", elapsed)
+	}
+}
+
+func TestStationDetail(t *testing.T) {
+	fakeStation(t, "DETAIL1", protocol.Version2)
+
+	rec := serve(handleStation, http.MethodGet, "/stations/DETAIL1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	detail := decodeJSON(t, rec)
+	if detail["stationID"] != "DETAIL1" || detail["protocolVersion"] != float64(protocol.Version2) || detail["status"] != "connected" {
+		t.Errorf("detail = %v", detail)
+	}
+
+	rec = serve(handleStation, http.MethodGet, "/stations/MISSING1", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown station: status %d, want 404", rec.Code)
+	}
+	if msg, _ := decodeJSON(t, rec)["error"].(string); !strings.Contains(msg, "MISSING1") {
+		t.Errorf("error = %q, want it to name the station", msg)
+	}
+}
+
+// Отключение станции, пока ее цикл чтения разбирает кадры
+func TestForceDisconnectDuringReads(t *testing.T) {
+	p := newTestPeer(t)
+	p.login(t, "KICK1", protocol.Version1)
+
+	heartbeat := heartbeatFrame(t, protocol.Version1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+			if _, err := p.conn.Write(heartbeat); err != nil {
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	rec := serve(handleStation, http.MethodPost, "/stations/KICK1/disconnect", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	p.waitClosed(t)
+	if _, ok := lookupStation("KICK1", ""); ok {
+		t.Errorf("station still registered after disconnect")
+	}
+
+	rec = serve(handleStation, http.MethodPost, "/stations/KICK1/disconnect", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("second disconnect: status %d, want 404", rec.Code)
+	}
+}
+
+func TestUnknownCommandListsAllowed(t *testing.T) {
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=ANY1&cmd=launch", "")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", rec.Code)
+	}
+	allowed, _ := decodeJSON(t, rec)["allowed"].([]interface{})
+	names := make(map[string]bool)
+	for _, name := range allowed {
+		names[name.(string)] = true
+	}
+	for _, want := range []string{"rent", "eject", "heartbeat"} {
+		if !names[want] {
+			t.Errorf("allowed = %v, missing %q", allowed, want)
+		}
+	}
+}
+
+// Повторный логин закрывает старое соединение, в реестре остается новое
+func TestReloginReplacesConnection(t *testing.T) {
+	first := newTestPeer(t)
+	old := first.login(t, "RELOGIN1", protocol.Version1)
+
+	second := newTestPeer(t)
+	second.send(t, loginFrame("RELOGIN1", protocol.Version1))
+	second.next(t)
+	first.waitClosed(t)
+
+	eventually(t, "new connection registered", func() bool {
+		st, ok := lookupStation("RELOGIN1", "")
+		return ok && st != old
+	})
+	// Отложенная очистка старого соединения не трогает новую запись
+	second.send(t, heartbeatFrame(t, protocol.Version1))
+	second.next(t)
+	if _, ok := lookupStation("RELOGIN1", ""); !ok {
+		t.Errorf("station dropped after the old connection closed")
+	}
+}
+
+// Отключение убирает из реестра свою станцию, а не последнюю подключенную
+func TestDisconnectRemovesOwnStation(t *testing.T) {
+	first := newTestPeer(t)
+	first.login(t, "IDENT1", protocol.Version1)
+	second := newTestPeer(t)
+	other := second.login(t, "IDENT2", protocol.Version1)
+
+	first.conn.Close()
+	eventually(t, "first station removed", func() bool {
+		_, ok := lookupStation("IDENT1", "")
+		return !ok
+	})
+	if st, ok := lookupStation("IDENT2", ""); !ok || st != other {
+		t.Errorf("second station lost after the first disconnected")
+	}
+}
+
+// Список и карточка станции отдают токен сессии и закрыты ключом
+func TestStationsRequireKey(t *testing.T) {
+	fakeStation(t, "KEYED1", protocol.Version1)
+	useAPIKeys(t, map[string]string{"secretkey": "alice"})
+
+	if rec := serve(handleListStations, http.MethodGet, "/stations", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("list without a key: status %d, want 401", rec.Code)
+	}
+	if rec := serve(handleStation, http.MethodGet, "/stations/KEYED1", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("detail without a key: status %d, want 401", rec.Code)
+	}
+	if rec := serveWithKey(handleStation, http.MethodGet, "/stations/KEYED1", "secretkey"); rec.Code != http.StatusOK {
+		t.Errorf("detail with a key: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListStationsPaging(t *testing.T) {
+	for _, id := range []string{"PAGE1", "PAGE2", "PAGE3", "PAGE4"} {
+		fakeStation(t, id, protocol.Version1)
+	}
+	stale, _ := fakeStation(t, "PAGE5", protocol.Version1)
+	stale.mu.Lock()
+	stale.lastSeen = time.Now().Add(-2 * cfg.StaleAfter)
+	stale.mu.Unlock()
+
+	list := func(query string) StationsResponse {
+		t.Helper()
+		rec := serve(handleListStations, http.MethodGet, "/stations?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body.String())
+		}
+		var resp StationsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	ids := func(resp StationsResponse) []string {
+		var out []string
+		for _, st := range resp.Stations {
+			out = append(out, st.StationID)
+		}
+		return out
+	}
+
+	if resp := list("status=stale"); resp.Total != 1 || resp.Stations[0].StationID != "PAGE5" {
+		t.Errorf("stale = %v, want PAGE5", ids(resp))
+	}
+	resp := list("status=connected&limit=2&offset=1")
+	if resp.Total != 4 || resp.Count != 2 || fmt.Sprint(ids(resp)) != "[PAGE2 PAGE3]" {
+		t.Errorf("connected page = total %d, %v, want 4, [PAGE2 PAGE3]", resp.Total, ids(resp))
+	}
+	if resp := list("offset=10"); resp.Total != 5 || resp.Count != 0 {
+		t.Errorf("offset past the end = total %d, count %d", resp.Total, resp.Count)
+	}
+	if rec := serve(handleListStations, http.MethodGet, "/stations?status=bogus", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("bogus status: %d, want 400", rec.Code)
+	}
+}
+
+// Станция v2 получает ответы и команды в v2
+func TestVersion2Station(t *testing.T) {
+	p := newTestPeer(t)
+	p.send(t, loginFrame("V2BOX1", protocol.Version2))
+	if resp := p.next(t); resp[3] != protocol.Version2 || !protocol.ChecksumValid(resp) {
+		t.Fatalf("login reply = %x, want a valid v2 frame", resp)
+	}
+	eventually(t, "station registered", func() bool {
+		st, ok := lookupStation("V2BOX1", "")
+		return ok && st.Version() == protocol.Version2
+	})
+
+	p.send(t, heartbeatFrame(t, protocol.Version2))
+	if resp := p.next(t); resp[3] != protocol.Version2 {
+		t.Errorf("heartbeat reply version = %d, want 2", resp[3])
+	}
+
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=V2BOX1&cmd=query_iccid", ""); rec.Code != http.StatusOK {
+		t.Fatalf("send: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if frame := p.next(t); frame[2] != protocol.CmdQueryICCID || frame[3] != protocol.Version2 {
+		t.Errorf("command frame = %x, want v2 query_iccid", frame)
+	}
+}
+
+// scriptConn - StationConn, который проваливает первые failures записей
+// с ошибкой err и пишет не больше chunk байт за раз (0 - без ограничения).
+// После каждой записи выжидает pause, давая вклиниться другим писателям.
+type scriptConn struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	chunk    int
+	pause    time.Duration
+	writes   int
+	buf      bytes.Buffer
+	closed   bool
+}
+
+func (c *scriptConn) Write(b []byte) (int, error) {
+	defer time.Sleep(c.pause)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.failures > 0 {
+		c.failures--
+		err := c.err
+		if err == nil {
+			err = os.ErrDeadlineExceeded
+		}
+		return 0, err
+	}
+	if c.chunk > 0 && len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	return c.buf.Write(b)
+}
+
+func (c *scriptConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+func (c *scriptConn) attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+func (c *scriptConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *scriptConn) RemoteAddr() net.Addr             { return fakeAddr("script") }
+func (c *scriptConn) SetWriteDeadline(time.Time) error { return nil }
+
+// scriptStation регистрирует станцию поверх conn
+func scriptStation(t *testing.T, id string, conn StationConn) *Station {
+	t.Helper()
+	station := newStation(id, conn, time.Now(), testToken, protocol.Version1)
+	mu.Lock()
+	registerStation(station)
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		dropStation(station)
+		mu.Unlock()
+	})
+	return station
+}
+
+func TestSendRetriesTimedOutWrite(t *testing.T) {
+	keepConfig(t)
+	cfg.WriteRetryBackoff = time.Millisecond
+
+	conn := &scriptConn{failures: 1}
+	station := scriptStation(t, "RETRY1", conn)
+	frame := heartbeatFrame(t, protocol.Version1)
+	if err := sendToStation(context.Background(), station, "heartbeat", frame, time.Second); err != nil {
+		t.Fatalf("sendToStation: %v", err)
+	}
+	if conn.attempts() != 2 || !bytes.Equal(conn.written(), frame) {
+		t.Errorf("attempts = %d, written = %x, want one retry and the whole frame", conn.attempts(), conn.written())
+	}
+
+	// Соединение мертво: повтора нет, станция убирается из реестра
+	dead := &scriptConn{failures: 1, err: net.ErrClosed}
+	station = scriptStation(t, "RETRY2", dead)
+	if err := sendToStation(context.Background(), station, "heartbeat", frame, time.Second); err == nil {
+		t.Fatalf("write to a closed connection succeeded")
+	}
+	if dead.attempts() != 1 {
+		t.Errorf("attempts on a closed connection = %d, want 1", dead.attempts())
+	}
+	if _, ok := lookupStation("RETRY2", ""); ok {
+		t.Errorf("station with a dead connection still registered")
+	}
+}
+
+// Короткие записи дописываются, пока кадр не уйдет целиком
+func TestSendCompletesPartialWrites(t *testing.T) {
+	conn := &scriptConn{chunk: 2}
+	station := scriptStation(t, "PARTIAL1", conn)
+	frame, err := protocol.CreateCommand("rent", "11223344", "5", protocol.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendToStation(context.Background(), station, "rent", frame, time.Second); err != nil {
+		t.Fatalf("sendToStation: %v", err)
+	}
+	if !bytes.Equal(conn.written(), frame) {
+		t.Errorf("written = %x, want %x", conn.written(), frame)
+	}
+	if want := (len(frame) + 1) / 2; conn.attempts() != want {
+		t.Errorf("attempts = %d, want %d writes of 2 bytes", conn.attempts(), want)
+	}
+}
+
+// Параллельные отправки не перемешивают кадры в сокете, даже когда
+// соединение принимает по несколько байт за раз
+func TestConcurrentSendsNotInterleaved(t *testing.T) {
+	conn := &scriptConn{chunk: 3, pause: 100 * time.Microsecond}
+	station := scriptStation(t, "SERIAL1", conn)
+
+	const n = 50
+	sent := make(map[string]bool)
+	frames := make([][]byte, n)
+	for i := range frames {
+		token := fmt.Sprintf("%08x", i)
+		frame, err := protocol.CreateCommand("eject", token, fmt.Sprint(i%12+1), protocol.Version1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames[i] = frame
+		sent[string(frame)] = true
+	}
+	var wg sync.WaitGroup
+	for _, frame := range frames {
+		wg.Add(1)
+		go func(frame []byte) {
+			defer wg.Done()
+			if err := sendToStation(context.Background(), station, "eject", frame, time.Second); err != nil {
+				t.Errorf("sendToStation: %v", err)
+			}
+		}(frame)
+	}
+	wg.Wait()
+
+	wire := conn.written()
+	for count := 0; count < n; count++ {
+		size := protocol.FrameLen(wire)
+		if size == 0 || !sent[string(wire[:size])] {
+			t.Fatalf("frame %d on the wire is not one of the sent frames: %x", count, wire)
+		}
+		delete(sent, string(wire[:size]))
+		wire = wire[size:]
+	}
+	if len(wire) != 0 {
+		t.Errorf("%d stray bytes after %d frames", len(wire), n)
+	}
+}
+
+// Без token команда уходит с токеном сессии; без сессионного токена - 400
+func TestSendDefaultToken(t *testing.T) {
+	conn := &scriptConn{}
+	scriptStation(t, "TOKEN1", conn)
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=TOKEN1&cmd=query_fw", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := protocol.FrameToken(conn.written()); !bytes.Equal(got, testToken) {
+		t.Errorf("frame token = %x, want session token %x", got, testToken)
+	}
+
+	station := newStation("TOKEN2", &scriptConn{}, time.Now(), nil, protocol.Version1)
+	mu.Lock()
+	registerStation(station)
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		dropStation(station)
+		mu.Unlock()
+	}()
+	rec = serve(handleSendCommand, http.MethodGet, "/send?stationID=TOKEN2&cmd=query_fw", "")
+	if msg, _ := decodeJSON(t, rec)["error"].(string); rec.Code != http.StatusBadRequest || !strings.Contains(msg, "Missing token") {
+		t.Errorf("without a session token: %d %s, want 400 Missing token", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUnlockAllAcknowledged(t *testing.T) {
+	fakeStation(t, "UNLOCK1", protocol.Version1)
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=UNLOCK1&cmd=unlock_all&wait=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeJSON(t, rec); resp["status"] != "success" || resp["delivery"] != deliveryAcknowledged || resp["payload"] != "000781010011223344" {
+		t.Errorf("response = %v", resp)
+	}
+}
+
+// Ack unlock_all по TCP не вызывает ответный unlock_all
+func TestUnlockAllAckNotEchoed(t *testing.T) {
+	p := newTestPeer(t)
+	p.login(t, "UNLOCK2", protocol.Version1)
+	ack, err := protocol.CreateCommand("unlock_all", "11223344", "", protocol.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(t, ack)
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+	if resp := p.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Errorf("reply after unlock_all ack = %x, want heartbeat", resp)
+	}
+}
+
+// Dry-run собирает кадр, но ничего не пишет станции и не трогает реестр
+func TestDryRunRent(t *testing.T) {
+	useStore(t, store.NewMemory())
+	conn := &scriptConn{}
+	scriptStation(t, "DRYRUN1", conn)
+	before := getConnectedStationIDs()
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=DRYRUN1&cmd=rent&slot=2&token=11223344&dryRun=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeJSON(t, rec)
+	breakdown, _ := resp["breakdown"].(map[string]interface{})
+	if resp["dryRun"] != true || breakdown["cmd"] != "0x65" || breakdown["token"] != "11223344" || breakdown["payload"] != "02" {
+		t.Errorf("response = %v", resp)
+	}
+	if conn.attempts() != 0 {
+		t.Errorf("dry-run wrote %d times to the station", conn.attempts())
+	}
+	if after := getConnectedStationIDs(); len(after) != len(before) {
+		t.Errorf("registry changed: %v -> %v", before, after)
+	}
+	if entries, _ := stationStore.ListAudit("DRYRUN1", 0); len(entries) != 0 {
+		t.Errorf("dry-run audited: %+v", entries)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"server/internal/metrics"
+	"sync/atomic"
+)
+
+// Открытые TCP соединения, включая еще не залогинившиеся
+var openConnections atomic.Int64
+
+var (
+	commandsSent = metrics.NewCounterVec("station_commands_sent_total", "Commands written to stations, by command name.", "cmd")
+	sendDuration = metrics.NewHistogram("station_send_duration_seconds", "Time spent writing a command frame to a station.", metrics.DefBuckets)
+
+	commandsDenied = metrics.NewCounterVec("station_commands_denied_total", "Commands rejected with 403 by -command-policy, by command name.", "cmd")
+
+	rateLimited = metrics.NewCounterVec("station_commands_rate_limited_total", "Commands rejected with 429 by the per-station rate limiter, by command name.", "cmd")
+
+	retransmitRequests      = metrics.NewCounterVec("station_retransmit_requests_total", "NACKs sent asking a station to resend a bad-checksum frame, by station.", "station_id")
+	stationChecksumFailures = metrics.NewCounterVec("station_checksum_failures_by_station_total", "Frames from a logged-in station dropped because of an invalid checksum, by station.", "station_id")
+
+	unknownCommands = metrics.NewCounterVec("station_unknown_commands_total", "Incoming frames with a command byte the server does not handle, by station.", "station_id")
+
+	eventsDropped = metrics.NewCounterVec("events_dropped_total", "Events dropped because a subscriber's buffer was full, by subscriber (webhook, ws).", "subscriber")
+
+	replyTokenMismatches  = metrics.NewCounter("station_reply_token_mismatches_total", "Station replies whose token matched none of the commands waiting for that cmd; the waiters keep waiting.")
+	slotConflicts         = metrics.NewCounter("station_slot_conflicts_total", "rent/eject requests refused with 409 because another operation on the same slot was still in progress.")
+	inventoryPartsDropped = metrics.NewCounter("station_inventory_parts_dropped_total", "Incomplete multi-frame inventories discarded because the continuation did not arrive within -inventory-part-timeout.")
+
+	framesRejected = metrics.NewCounter("station_frames_rejected_total", "Frames with a PackLen below the header size or above -max-frame-size; the connection is closed.")
+
+	connectionPanics   = metrics.NewCounter("tcp_connection_panics_total", "Station connections closed after a panic while handling their frames.")
+	connectionsRefused = metrics.NewCounter("tcp_connections_refused_total", "TCP connections closed right after accept because the connection limit was reached.")
+	acceptErrors       = metrics.NewCounter("tcp_accept_errors_total", "Errors returned by Accept on the TCP listener.")
+	connectionsBlocked = metrics.NewCounter("tcp_connections_blocked_total", "TCP connections closed right after accept because the remote address is outside -allow-cidrs.")
+
+	_ = metrics.NewGaugeFunc("station_connections", "Number of registered station connections.", func() float64 {
+		mu.RLock()
+		defer mu.RUnlock()
+		return float64(len(connections))
+	})
+	_ = metrics.NewGaugeFunc("tcp_connections_open", "Number of open TCP connections, including ones that have not logged in.", func() float64 {
+		return float64(openConnections.Load())
+	})
+	_ = metrics.NewGaugeFunc("tcp_connections_max", "Configured TCP connection limit (0 is unlimited).", func() float64 {
+		return float64(cfg.MaxConnections)
+	})
+)
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"server/internal/metrics"
+	"server/internal/protocol"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric возвращает значение метрики без меток из /metrics
+func scrapeMetric(t *testing.T, name string) string {
+	t.Helper()
+	rec := serve(metrics.Handler().ServeHTTP, http.MethodGet, "/metrics", "")
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		if value, ok := strings.CutPrefix(sc.Text(), name+" "); ok {
+			return value
+		}
+	}
+	t.Fatalf("metric %s not found in /metrics", name)
+	return ""
+}
+
+func TestMetricsStationGauge(t *testing.T) {
+	if got := scrapeMetric(t, "station_connections"); got != "0" {
+		t.Fatalf("station_connections before login = %s, want 0", got)
+	}
+	fakeStation(t, "METRICS1", protocol.Version1)
+	if got := scrapeMetric(t, "station_connections"); got != "1" {
+		t.Errorf("station_connections = %s, want 1", got)
+	}
+}
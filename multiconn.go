@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Номер соединения, уникальный в пределах процесса
+var connSeq atomic.Uint64
+
+func nextConnID() string {
+	return strconv.FormatUint(connSeq.Add(1), 10)
+}
+
+// newSessionID - короткий случайный ID соединения для логов. В отличие от
+// ConnID не повторяется между перезапусками сервера.
+func newSessionID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "c" + nextConnID()
+	}
+	return hex.EncodeToString(b)
+}
+
+// sessions - все соединения станции в режиме -multi-conn: stationID ->
+// connID -> запись. connections при этом указывает на последнее
+// залогинившееся соединение. Защищено mu.
+var sessions = make(map[string]map[string]*Station)
+
+// registerStation кладет станцию в реестр, вызывается под mu. Возвращает
+// предыдущую запись, которую в обычном режиме нужно закрыть.
+func registerStation(station *Station) (prev *Station, exists bool) {
+	prev, exists = connections[station.ID]
+	connections[station.ID] = station
+	if cfg.MultiConn {
+		if sessions[station.ID] == nil {
+			sessions[station.ID] = make(map[string]*Station)
+		}
+		sessions[station.ID][station.ConnID] = station
+	}
+	return prev, exists
+}
+
+// dropStation убирает запись станции из реестра, вызывается под mu.
+// Если у станции остались другие соединения, основным становится самое
+// новое из них.
+func dropStation(station *Station) bool {
+	if cfg.MultiConn {
+		if conns := sessions[station.ID]; conns != nil {
+			delete(conns, station.ConnID)
+			if len(conns) == 0 {
+				delete(sessions, station.ID)
+			}
+		}
+	}
+	if connections[station.ID] != station {
+		return false
+	}
+	if next := latestSession(station.ID); next != nil {
+		connections[station.ID] = next
+	} else {
+		delete(connections, station.ID)
+	}
+	return true
+}
+
+func latestSession(stationID string) *Station {
+	var latest *Station
+	for _, st := range sessions[stationID] {
+		if latest == nil || connIDLess(latest.ConnID, st.ConnID) {
+			latest = st
+		}
+	}
+	return latest
+}
+
+func connIDLess(a, b string) bool {
+	na, _ := strconv.ParseUint(a, 10, 64)
+	nb, _ := strconv.ParseUint(b, 10, 64)
+	return na < nb
+}
+
+// lookupStation находит станцию по ID, а с connID - конкретное соединение
+// в режиме -multi-conn
+func lookupStation(stationID, connID string) (*Station, bool) {
+	if norm := normalizeStationID(stationID); norm != stationID {
+		slog.Debug("normalized station ID for lookup", "station_id", stationID, "normalized", norm)
+		stationID = norm
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if connID == "" {
+		st, ok := connections[stationID]
+		return st, ok
+	}
+	st, ok := sessions[stationID][connID]
+	if !ok {
+		// Без -multi-conn у станции одно соединение
+		if primary, exists := connections[stationID]; exists && primary.ConnID == connID {
+			return primary, true
+		}
+	}
+	return st, ok
+}
+
+// sessionIDs - номера всех соединений станции по возрастанию
+func sessionIDs(stationID string) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	ids := make([]string, 0, len(sessions[stationID]))
+	for id := range sessions[stationID] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return connIDLess(ids[i], ids[j]) })
+	return ids
+}
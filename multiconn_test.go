@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+// В -multi-conn повторный логин не закрывает первое соединение, а connID
+// выбирает, в какое из них уйдет команда
+func TestMultiConnTargetedSend(t *testing.T) {
+	keepConfig(t)
+	cfg.MultiConn = true
+
+	first := newTestPeer(t)
+	older := first.login(t, "MULTI1", protocol.Version1)
+	second := newTestPeer(t)
+	second.send(t, loginFrame("MULTI1", protocol.Version1))
+	second.next(t)
+	var newer *Station
+	eventually(t, "second connection registered", func() bool {
+		var ok bool
+		newer, ok = lookupStation("MULTI1", "")
+		return ok && newer != older
+	})
+
+	detail := decodeJSON(t, serve(handleStation, http.MethodGet, "/stations/MULTI1", ""))
+	if got, want := fmt.Sprint(detail["connections"]), fmt.Sprintf("[%s %s]", older.ConnID, newer.ConnID); got != want {
+		t.Errorf("connections = %s, want %s", got, want)
+	}
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=MULTI1&cmd=query_fw&connID="+older.ConnID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("targeted send: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if frame := first.next(t); frame[2] != protocol.CmdQueryFirmware {
+		t.Errorf("first connection got cmd 0x%02x, want query_fw", frame[2])
+	}
+	select {
+	case frame := <-second.frames:
+		t.Errorf("untargeted connection got %x", frame)
+	default:
+	}
+
+	// Закрылось новое соединение - основным снова становится первое
+	second.conn.Close()
+	eventually(t, "first connection primary again", func() bool {
+		st, ok := lookupStation("MULTI1", "")
+		return ok && st == older
+	})
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=MULTI1&cmd=query_fw&connID="+newer.ConnID, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("send to a closed connection: status %d, want 400", rec.Code)
+	}
+}
+
+// Каждое соединение станции получает свой session ID, и перелогин тоже
+func TestSessionIDsDistinct(t *testing.T) {
+	first := newTestPeer(t)
+	older := first.login(t, "SESSION1", protocol.Version1)
+	second := newTestPeer(t)
+	second.send(t, loginFrame("SESSION1", protocol.Version1))
+	second.next(t)
+	var newer *Station
+	eventually(t, "second connection registered", func() bool {
+		var ok bool
+		newer, ok = lookupStation("SESSION1", "")
+		return ok && newer != older
+	})
+
+	if older.SessionID == "" || newer.SessionID == "" || older.SessionID == newer.SessionID {
+		t.Errorf("session IDs = %q and %q, want two distinct IDs", older.SessionID, newer.SessionID)
+	}
+}
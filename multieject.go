@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"strconv"
+	"time"
+)
+
+// handleMultiEject выдает слоты из списка "1,3,5". Станция v2 получает их
+// одним кадром multi_eject, более старая - по одному eject, как eject_all.
+func handleMultiEject(ctx context.Context, w http.ResponseWriter, station *Station, token, slotList, caller string) {
+	slots, err := protocol.ParseSlotList(slotList)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Слоты проверяем до блокировок: несуществующий слот не должен
+	// занимать остальные
+	for _, slot := range slots {
+		if !checkSlotInCabinet(w, station, strconv.Itoa(int(slot))) {
+			return
+		}
+	}
+
+	var results []EjectResult
+	mode := "batched"
+	if protocol.CommandSupported("multi_eject", station.Version()) {
+		results, err = multiEjectFrame(ctx, station, token, slotList, slots, caller)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrReplyTimeout) {
+				status = http.StatusGatewayTimeout
+			} else if s := canceledStatus(err); s != 0 {
+				status = s
+			} else if errors.Is(err, errSlotBusy) {
+				status = http.StatusConflict
+			}
+			writeJSONError(w, status, fmt.Sprintf("multi_eject failed: %v", err))
+			return
+		}
+	} else {
+		mode = "sequential"
+		for i, slot := range slots {
+			if i > 0 {
+				// Даем мотору закончить предыдущую выдачу
+				select {
+				case <-time.After(cfg.EjectAllDelay):
+				case <-ctx.Done():
+				}
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			results = append(results, ejectSlot(ctx, station, token, caller, protocol.SlotEntry{Slot: slot}))
+		}
+	}
+
+	ejected := 0
+	for _, res := range results {
+		if res.Status == "ejected" {
+			ejected++
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"stationID": station.ID,
+		"command":   "multi_eject",
+		"total":     len(results),
+		"ejected":   ejected,
+		"results":   results,
+		"mode":      mode,
+	})
+}
+
+var errSlotBusy = errors.New("slot busy with another rent/eject")
+
+// multiEjectFrame пишет один кадр multi_eject и разбирает результаты по
+// слотам. Все слоты заняты под операцию до ответа.
+func multiEjectFrame(ctx context.Context, station *Station, token, slotList string, slots []byte, caller string) ([]EjectResult, error) {
+	for _, slot := range slots {
+		release, ok := lockSlot(station.ID, strconv.Itoa(int(slot)))
+		if !ok {
+			return nil, fmt.Errorf("%w: slot %d", errSlotBusy, slot)
+		}
+		defer release()
+	}
+
+	payload, err := protocol.CreateCommand("multi_eject", token, slotList, station.Version())
+	if err != nil {
+		return nil, err
+	}
+	audit := store.AuditEntry{
+		StationID: station.ID,
+		Command:   "multi_eject",
+		Slot:      slotList,
+		Caller:    caller,
+		Payload:   fmt.Sprintf("%x", payload),
+	}
+
+	msg, err := sendAndWait(ctx, station, "multi_eject", payload, cfg.ReplyTimeout)
+	if err != nil {
+		audit.Result, audit.Error = "error", err.Error()
+		recordAudit(audit)
+		return nil, err
+	}
+
+	results := make([]EjectResult, 0, len(msg.SlotResults))
+	for _, r := range msg.SlotResults {
+		res := EjectResult{Slot: int(r.Slot), PowerBankID: r.PowerBankID, Status: "failed"}
+		if r.Success {
+			res.Status = "ejected"
+		}
+		results = append(results, res)
+	}
+	audit.Result = "sent"
+	recordAudit(audit)
+	return results, nil
+}
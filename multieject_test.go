@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+// Слот за пределами шкафа отклоняется до выдачи и до блокировки слотов
+func TestMultiEjectSlotOutOfCabinet(t *testing.T) {
+	station, conn := fakeStation(t, "MULTI1", protocol.Version2)
+	// Станция в памяти не логинится, число слотов задаем как из логина
+	station.mu.Lock()
+	station.slotCount = 12
+	station.mu.Unlock()
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=MULTI1&cmd=multi_eject&slot=1,13&sync=true", "")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body.String())
+	}
+	release, ok := lockSlot("MULTI1", "1")
+	if !ok {
+		t.Fatalf("slot 1 still locked after the rejected multi_eject")
+	}
+	release()
+	for _, e := range conn.profile.Slots.Inventory() {
+		if e.Slot == 1 {
+			return
+		}
+	}
+	t.Errorf("slot 1 ejected by the rejected multi_eject")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"server/internal/protocol"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Кадр с этим Token обработчик из registerPanicHandler превращает в панику
+var (
+	panicToken      = []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	panicHandlerReg sync.Once
+)
+
+func registerPanicHandler() {
+	panicHandlerReg.Do(func() {
+		protocol.RegisterHandler(protocol.CmdHeartbeat, func(msg protocol.DecodedMessage) {
+			if bytes.Equal(msg.Token, panicToken) {
+				panic("decoder exploded")
+			}
+		})
+	})
+}
+
+// Паника при разборе кадра закрывает только это соединение, сервер и
+// остальные станции работают дальше
+func TestConnectionPanicRecovered(t *testing.T) {
+	registerPanicHandler()
+	before, _ := strconv.Atoi(scrapeMetric(t, "tcp_connection_panics_total"))
+
+	other := newTestPeer(t)
+	other.login(t, "PANIC2", protocol.Version1)
+	p := newTestPeer(t)
+	p.login(t, "PANIC1", protocol.Version1)
+	poison, err := protocol.CreateCommand("heartbeat", "deadbeef", "", protocol.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(t, poison)
+	p.waitClosed(t)
+
+	if after, _ := strconv.Atoi(scrapeMetric(t, "tcp_connection_panics_total")); after != before+1 {
+		t.Errorf("panics metric = %d, want %d", after, before+1)
+	}
+	eventually(t, "panicked station dropped", func() bool {
+		_, ok := lookupStation("PANIC1", "")
+		return !ok
+	})
+	other.send(t, heartbeatFrame(t, protocol.Version1))
+	if resp := other.next(t); resp[2] != protocol.CmdHeartbeat {
+		t.Errorf("other station reply = %x, want heartbeat", resp)
+	}
+}
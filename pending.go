@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"time"
+)
+
+var ErrReplyTimeout = errors.New("timed out waiting for station reply")
+
+// ErrStationDisconnected - соединение закрылось, пока команда ждала ответа
+var ErrStationDisconnected = errors.New("station disconnected before replying")
+
+// Нестандартный код (как у nginx): клиент закрыл соединение, не дождавшись ответа
+const statusClientClosedRequest = 499
+
+// canceledStatus - HTTP статус для ошибки отмены контекста запроса или 0,
+// если err не про отмену
+func canceledStatus(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusRequestTimeout
+	}
+	return 0
+}
+
+// Значения delivery в ответе /send
+const (
+	// Станция ответила на команду
+	deliveryAcknowledged = "acknowledged"
+	// Ответ ожидался, но не пришел за cfg.ReplyTimeout
+	deliveryTimeout = "timeout"
+	// Ответ ожидается, но клиент не просил его ждать (wait=false)
+	deliveryPending = "pending"
+	// Команда записана, ответа на нее не бывает
+	deliveryWritten = "written"
+)
+
+// deliveryWithoutWait - delivery для команды, записанной без ожидания ответа
+func deliveryWithoutWait(cmd string) string {
+	if protocol.ExpectsReply(cmd) {
+		return deliveryPending
+	}
+	return deliveryWritten
+}
+
+// replyWaiter - команда, ждущая ответа. Станция повторяет в ответе Token
+// команды, поэтому ответ с чужим токеном этой команде не достается.
+type replyWaiter struct {
+	token []byte
+	ch    chan protocol.DecodedMessage
+}
+
+// expect регистрирует ожидание ответа с данным cmd и token. Ответы
+// раздаются ожидающим с тем же токеном в порядке регистрации. cancel нужно
+// вызвать, если ответ больше не нужен.
+func (s *Station) expect(cmd byte, token []byte) (<-chan protocol.DecodedMessage, func()) {
+	ch := make(chan protocol.DecodedMessage, 1)
+
+	s.mu.Lock()
+	if s.waitersClosed {
+		s.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if s.waiters == nil {
+		s.waiters = make(map[byte][]replyWaiter)
+	}
+	s.waiters[cmd] = append(s.waiters[cmd], replyWaiter{token: token, ch: ch})
+	s.mu.Unlock()
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		list := s.waiters[cmd]
+		for i, w := range list {
+			if w.ch == ch {
+				s.waiters[cmd] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(s.waiters[cmd]) == 0 {
+			delete(s.waiters, cmd)
+		}
+	}
+	return ch, cancel
+}
+
+// failWaiters вызывается при закрытии соединения: все ожидающие ответа
+// команды сразу получают ErrStationDisconnected, а не ждут таймаута
+func (s *Station) failWaiters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitersClosed = true
+	for _, list := range s.waiters {
+		for _, w := range list {
+			close(w.ch)
+		}
+	}
+	s.waiters = nil
+}
+
+// deliver отдает ответ первому ожидающему с тем же токеном. Возвращает
+// false, если такой ответ никто не ждал.
+func (s *Station) deliver(msg protocol.DecodedMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := s.waiters[msg.Cmd]
+	if len(list) == 0 {
+		return false
+	}
+	for i, w := range list {
+		if !bytes.Equal(w.token, msg.Token) {
+			continue
+		}
+		if len(list) == 1 {
+			delete(s.waiters, msg.Cmd)
+		} else {
+			s.waiters[msg.Cmd] = append(list[:i:i], list[i+1:]...)
+		}
+		w.ch <- msg
+		return true
+	}
+	replyTokenMismatches.Inc()
+	slog.Warn("station reply token matches no pending command", "station_id", s.ID,
+		"cmd", fmt.Sprintf("0x%02x", msg.Cmd), "token", fmt.Sprintf("%x", msg.Token), "waiting", len(list))
+	return false
+}
+
+// sendAndWait пишет команду и ждет ответ с тем же cmd. При отмене ctx
+// ожидание сразу снимается и возвращается ошибка ctx.
+func sendAndWait(ctx context.Context, station *Station, cmd string, payload []byte, timeout time.Duration) (protocol.DecodedMessage, error) {
+	reply, cancel := station.expect(payload[2], protocol.FrameToken(payload))
+	defer cancel()
+
+	if err := sendToStation(ctx, station, cmd, payload, cfg.WriteTimeout); err != nil {
+		return protocol.DecodedMessage{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return protocol.DecodedMessage{}, fmt.Errorf("%w (%s)", ErrStationDisconnected, cmd)
+		}
+		return msg, nil
+	case <-timer.C:
+		return protocol.DecodedMessage{}, fmt.Errorf("%w after %s (%s)", ErrReplyTimeout, timeout, cmd)
+	case <-ctx.Done():
+		return protocol.DecodedMessage{}, fmt.Errorf("waiting for station reply (%s): %w", cmd, ctx.Err())
+	}
+}
+
+// rebootedWithoutReply - станция ушла в перезагрузку по restart, не ответив.
+// ErrStationDisconnected приходит только после записи кадра, так что
+// команда доставлена.
+func rebootedWithoutReply(cmd string, err error) bool {
+	return cmd == "restart" && errors.Is(err, ErrStationDisconnected)
+}
+
+// decodedReply - разобранные поля ответа станции для JSON ответа /send.
+// Сырой hex остается в reply для отладки.
+func decodedReply(msg protocol.DecodedMessage) map[string]interface{} {
+	d := map[string]interface{}{"command": protocol.CommandName(msg.Cmd)}
+	switch {
+	case msg.SlotResult != nil:
+		d["slot"] = msg.SlotResult.Slot
+		d["powerBankID"] = msg.SlotResult.PowerBankID
+		d["result"] = msg.SlotResult.Result
+		d["success"] = msg.SlotResult.Success
+		d["meaning"] = msg.SlotResult.Meaning
+	case msg.FirmwareVersion != nil:
+		d["firmware"] = msg.Firmware
+		d["firmwareVersion"] = msg.FirmwareVersion
+	case msg.ICCID != "":
+		d["iccid"] = msg.ICCID
+	case msg.Inventory != nil:
+		d["inventory"] = msg.Inventory
+	case msg.Status != nil:
+		d["cabinetStatus"] = msg.Status
+	case msg.Capacity != nil:
+		d["capacity"] = msg.Capacity
+	case msg.Cycles != nil:
+		d["cycles"] = msg.Cycles
+	case msg.Server != nil:
+		d["server"] = msg.Server
+	case msg.Time != nil:
+		d["time"] = msg.Time
+		d["offset"] = time.Until(*msg.Time).Seconds()
+	}
+	return d
+}
+
+// sendCommandAndWait - синхронный вариант /send: пишет кадр, ждет ответ
+// станции и отдает результат. Ненулевой slotFilter оставляет в ответе
+// инвентарь только этого слота. Возвращает true, если станция ответила.
+func sendCommandAndWait(ctx context.Context, w http.ResponseWriter, station *Station, cmd string, slotFilter byte, payload []byte, audit store.AuditEntry) bool {
+	msg, err := sendAndWait(ctx, station, cmd, payload, cfg.ReplyTimeout)
+	return writeReply(w, station, cmd, slotFilter, payload, audit, msg, err)
+}
+
+// writeReply отдает результат sendAndWait и пишет его в журнал. Неуспешный
+// result byte не считается ошибкой HTTP, но попадает в status и журнал.
+// Возвращает true, если станция ответила или ушла в перезагрузку по restart.
+func writeReply(w http.ResponseWriter, station *Station, cmd string, slotFilter byte, payload []byte, audit store.AuditEntry, msg protocol.DecodedMessage, err error) bool {
+	if rebootedWithoutReply(cmd, err) {
+		recordAudit(audit)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "success",
+			"stationID": station.ID,
+			"command":   cmd,
+			"payload":   fmt.Sprintf("%x", payload),
+			"delivery":  deliveryWritten,
+		})
+		return true
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		audit.Result, audit.Error = "write_failed", err.Error()
+		if s := canceledStatus(err); s != 0 {
+			audit.Result = "canceled"
+			recordAudit(audit)
+			writeJSONError(w, s, fmt.Sprintf("Request canceled: %v", err))
+			return false
+		}
+		if errors.Is(err, ErrReplyTimeout) {
+			audit.Result = "timeout"
+			recordAudit(audit)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":    fmt.Sprintf("Failed to send command: %v", err),
+				"delivery": deliveryTimeout,
+			})
+			return false
+		}
+		if errors.Is(err, ErrStationDisconnected) {
+			audit.Result = "disconnected"
+			status = http.StatusBadGateway
+		}
+		recordAudit(audit)
+		writeJSONError(w, status, fmt.Sprintf("Failed to send command: %v", err))
+		return false
+	}
+
+	response := map[string]interface{}{
+		"status":    "success",
+		"stationID": station.ID,
+		"command":   cmd,
+		"payload":   fmt.Sprintf("%x", payload),
+		"reply":     fmt.Sprintf("%x", msg.Payload),
+		"delivery":  deliveryAcknowledged,
+	}
+	response["decoded"] = decodedReply(msg)
+	if msg.Inventory != nil {
+		inventory := msg.Inventory
+		if slotFilter != 0 {
+			inventory = protocol.FilterInventory(inventory, slotFilter)
+		}
+		response["inventory"] = inventory
+	}
+	if msg.SlotResult != nil {
+		response["slotResult"] = msg.SlotResult
+		if !msg.SlotResult.Success {
+			response["status"] = "failed"
+			audit.Result = "failed"
+			audit.Error = fmt.Sprintf("station returned result 0x%02x for slot %d", msg.SlotResult.Result, msg.SlotResult.Slot)
+		}
+	}
+	recordAudit(audit)
+	json.NewEncoder(w).Encode(response)
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestDeliveryStatus(t *testing.T) {
+	fakeStation(t, "DELIVERY1", protocol.Version1)
+	tests := []struct {
+		name, query, want string
+	}{
+		{"acknowledged", "cmd=query_fw&wait=true", deliveryAcknowledged},
+		{"reply not awaited", "cmd=query_fw", deliveryPending},
+		{"no reply expected", "cmd=heartbeat&wait=true", deliveryWritten},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=DELIVERY1&"+tt.query, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := decodeJSON(t, rec)["delivery"]; got != tt.want {
+				t.Errorf("delivery = %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Станция молчит: delivery timeout и 504. Меняем одно поле, а не весь
+	// cfg: refreshInventory у фейковой станции читает его в своей горутине
+	replyTimeout := cfg.ReplyTimeout
+	t.Cleanup(func() { cfg.ReplyTimeout = replyTimeout })
+	cfg.ReplyTimeout = 20 * time.Millisecond
+	scriptStation(t, "DELIVERY2", &scriptConn{})
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=DELIVERY2&cmd=query_fw&wait=true", "")
+	if rec.Code != http.StatusGatewayTimeout || decodeJSON(t, rec)["delivery"] != deliveryTimeout {
+		t.Errorf("silent station: %d %s, want 504 with delivery timeout", rec.Code, rec.Body.String())
+	}
+}
+
+// Отмена контекста снимает ожидание сразу, не дожидаясь ReplyTimeout
+func TestSendAndWaitCanceled(t *testing.T) {
+	conn := &scriptConn{}
+	station := scriptStation(t, "CANCEL1", conn)
+	frame, err := protocol.CreateCommand("query_fw", "11223344", "", protocol.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := sendAndWait(ctx, station, "query_fw", frame, time.Minute)
+		done <- err
+	}()
+	eventually(t, "command written", func() bool { return conn.attempts() == 1 })
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("sendAndWait did not return after cancel")
+	}
+	station.mu.Lock()
+	pending := len(station.waiters)
+	station.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d commands still waiting after cancel", pending)
+	}
+}
+
+// В ответе rent - ID повербанка и расшифровка result byte, а не только hex
+func TestRentReplyDecoded(t *testing.T) {
+	defer protocol.ResetSlotResults()
+	fakeStation(t, "DECODED1", protocol.Version1)
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=DECODED1&cmd=rent&slot=1&sync=true", "")
+	decoded, _ := decodeJSON(t, rec)["decoded"].(map[string]interface{})
+	if decoded["command"] != "rent" || decoded["powerBankID"] != "RL1H|001" || decoded["meaning"] != "power bank released" {
+		t.Errorf("rent: decoded = %v", decoded)
+	}
+
+	protocol.SetSlotResult(2, protocol.SlotResultFailed)
+	rec = serve(handleSendCommand, http.MethodGet, "/send?stationID=DECODED1&cmd=rent&slot=2&sync=true", "")
+	decoded, _ = decodeJSON(t, rec)["decoded"].(map[string]interface{})
+	if decoded["success"] != false || decoded["meaning"] != "failed: slot empty or lock did not open" {
+		t.Errorf("failed rent: decoded = %v", decoded)
+	}
+}
+
+// Ответы на две одинаковые команды в полете достаются по Token, а не по
+// порядку: ответ с чужим токеном никому не отдается
+func TestRepliesRoutedByToken(t *testing.T) {
+	conn := &scriptConn{}
+	station := scriptStation(t, "TOKENS1", conn)
+
+	replies := make(map[string]chan protocol.DecodedMessage)
+	for _, token := range []string{"aaaaaaaa", "bbbbbbbb"} {
+		frame, err := protocol.CreateCommand("query_fw", token, "", protocol.Version1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan protocol.DecodedMessage, 1)
+		replies[token] = ch
+		go func() {
+			msg, err := sendAndWait(context.Background(), station, "query_fw", frame, testTimeout)
+			if err != nil {
+				t.Errorf("sendAndWait: %v", err)
+			}
+			ch <- msg
+		}()
+	}
+	eventually(t, "both commands written", func() bool { return conn.attempts() == 2 })
+
+	reply := func(token []byte, firmware string) bool {
+		return station.deliver(protocol.DecodedMessage{Cmd: protocol.CmdQueryFirmware, Token: token, Firmware: firmware})
+	}
+	if reply([]byte{0xCC, 0xCC, 0xCC, 0xCC}, "stray") {
+		t.Errorf("reply with an unknown token delivered")
+	}
+	reply([]byte{0xBB, 0xBB, 0xBB, 0xBB}, "second")
+	reply([]byte{0xAA, 0xAA, 0xAA, 0xAA}, "first")
+
+	for token, want := range map[string]string{"aaaaaaaa": "first", "bbbbbbbb": "second"} {
+		select {
+		case msg := <-replies[token]:
+			if msg.Firmware != want {
+				t.Errorf("token %s got firmware %q, want %q", token, msg.Firmware, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("token %s: no reply", token)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// commandPolicy решает, какие команды можно слать через API. Запросы,
+// которые ничего не меняют на станции, разрешены при любой политике.
+type commandPolicy struct {
+	name string
+	// Непустой allow разрешает только перечисленные команды
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// Команды только на чтение
+var readOnlyCommands = map[string]bool{
+	"heartbeat":        true,
+	"query_fw":         true,
+	"query_iccid":      true,
+	"query_power_bank": true,
+	"query_status":     true,
+	"query_server":     true,
+	"query_time":       true,
+	"query_capacity":   true,
+	"query_cycles":     true,
+	"voice_get":        true,
+}
+
+// Встроенные политики: open разрешает все, production запрещает команды,
+// которые выдают повербанки или меняют настройки станции
+var builtinPolicies = map[string][]string{
+	"open":       nil,
+	"production": {"eject", "eject_all", "multi_eject", "unlock_all", "set_server", "restart"},
+}
+
+// Политика /send, /send/bulk и /macro, см. -command-policy
+var sendPolicy = &commandPolicy{name: "open"}
+
+// parseCommandPolicy собирает политику из встроенной name и списков через
+// запятую: allow оставляет разрешенными только свои команды, deny
+// добавляет запреты к встроенным
+func parseCommandPolicy(name, allow, deny string) (*commandPolicy, error) {
+	denied, ok := builtinPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown policy %q, use open or production", name)
+	}
+	p := &commandPolicy{name: name, deny: make(map[string]bool)}
+	for _, cmd := range denied {
+		p.deny[cmd] = true
+	}
+
+	list := func(s string, into map[string]bool) error {
+		for _, cmd := range strings.Split(s, ",") {
+			if cmd = strings.TrimSpace(cmd); cmd == "" {
+				continue
+			}
+			if !isKnownCommand(cmd) {
+				return fmt.Errorf("unknown command %q", cmd)
+			}
+			into[cmd] = true
+		}
+		return nil
+	}
+	if strings.TrimSpace(allow) != "" {
+		p.allow = make(map[string]bool)
+		if err := list(allow, p.allow); err != nil {
+			return nil, err
+		}
+	}
+	if err := list(deny, p.deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// allowed сообщает, разрешена ли команда
+func (p *commandPolicy) allowed(cmd string) bool {
+	if readOnlyCommands[cmd] {
+		return true
+	}
+	if p.deny[cmd] {
+		return false
+	}
+	return p.allow == nil || p.allow[cmd]
+}
+
+// checkCommandPolicy отвечает 403 с именем политики, если команда запрещена
+func checkCommandPolicy(w http.ResponseWriter, cmd string) bool {
+	if sendPolicy.allowed(cmd) {
+		return true
+	}
+	commandsDenied.Inc(cmd)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  fmt.Sprintf("Command %s is not allowed by policy %s", cmd, sendPolicy.name),
+		"policy": sendPolicy.name,
+	})
+	return false
+}
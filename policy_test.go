@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+func TestCommandPolicy(t *testing.T) {
+	policy, err := parseCommandPolicy("production", "", "set_brightness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := sendPolicy
+	sendPolicy = policy
+	t.Cleanup(func() { sendPolicy = prev })
+	fakeStation(t, "POLICY1", protocol.Version1)
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"cmd=rent&slot=1&sync=true", http.StatusOK},
+		{"cmd=query_fw&wait=true", http.StatusOK},
+		{"cmd=eject&slot=2", http.StatusForbidden},
+		{"cmd=set_brightness", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=POLICY1&"+tt.query, "")
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, rec.Code, tt.code, rec.Body.String())
+			continue
+		}
+		if tt.code == http.StatusForbidden && (rec.Header().Get("Content-Type") != "application/json" || decodeJSON(t, rec)["policy"] != "production") {
+			t.Errorf("%s: body %s, want policy production", tt.query, rec.Body.String())
+		}
+	}
+
+	if _, err := parseCommandPolicy("staging", "", ""); err == nil {
+		t.Errorf("unknown policy accepted")
+	}
+}
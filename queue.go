@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/internal/protocol"
+	"server/internal/store"
+	"sync"
+)
+
+// delivery в ответе /send на команду, поставленную в очередь без ?sync
+const deliveryQueued = "queued"
+
+// commandQueue выполняет аппаратные команды станции строго по одной: две
+// выдачи не должны пересечься, пока мотор еще двигается. Очередь FIFO,
+// следующая команда начинается только после ответа (или таймаута) на
+// предыдущую.
+type commandQueue struct {
+	mu      sync.Mutex
+	busy    bool
+	waiting []*queueTicket
+}
+
+// queueTicket - место в очереди. turn закрывается, когда подходит очередь.
+type queueTicket struct {
+	// Сколько команд впереди, включая выполняющуюся, на момент постановки
+	position int
+	turn     chan struct{}
+}
+
+// enqueue ставит команду в конец очереди. Каждый ticket нужно передать в run.
+func (q *commandQueue) enqueue() *queueTicket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := &queueTicket{position: len(q.waiting), turn: make(chan struct{})}
+	if !q.busy {
+		q.busy = true
+		close(t.turn)
+		return t
+	}
+	t.position++
+	q.waiting = append(q.waiting, t)
+	return t
+}
+
+// run дожидается очереди ticket и выполняет job. Если ctx отменен раньше,
+// команда снимается с очереди без выполнения и возвращается ошибка ctx.
+func (q *commandQueue) run(ctx context.Context, t *queueTicket, job func()) error {
+	select {
+	case <-t.turn:
+	case <-ctx.Done():
+		q.abandon(t)
+		return fmt.Errorf("waiting in station command queue: %w", ctx.Err())
+	}
+	defer q.release()
+	job()
+	return nil
+}
+
+// release передает очередь следующей команде
+func (q *commandQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.busy = false
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.turn)
+}
+
+// abandon убирает ticket из очереди. Если очередь уже дошла до него,
+// передает ее дальше.
+func (q *commandQueue) abandon(t *queueTicket) {
+	q.mu.Lock()
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.mu.Unlock()
+			return
+		}
+	}
+	q.mu.Unlock()
+	q.release()
+}
+
+// length - сколько команд выполняется и ждет в очереди
+func (q *commandQueue) length() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.busy {
+		return 0
+	}
+	return 1 + len(q.waiting)
+}
+
+// dispatchQueued ставит собранный кадр аппаратной команды в очередь станции.
+// С blocking (?sync или wait) ждет очереди и ответа станции и отдает его
+// как /send с wait, иначе сразу отвечает 202 с позицией в очереди, а
+// результат попадает только в журнал. release вызывается, когда команда
+// выполнена или снята с очереди.
+func dispatchQueued(ctx context.Context, w http.ResponseWriter, station *Station, cmd string, payload []byte, params protocol.Params, audit store.AuditEntry, blocking bool, release func()) {
+	ticket := station.queue.enqueue()
+
+	if !blocking {
+		go func() {
+			defer release()
+			station.queue.run(context.Background(), ticket, func() {
+				msg, err := sendAndWait(context.Background(), station, cmd, payload, cfg.ReplyTimeout)
+				// Ответ уже ушел клиенту, writeReply нужен только ради журнала
+				if writeReply(&responseRecorder{header: make(http.Header)}, station, cmd, 0, payload, audit, msg, err) {
+					noteCommandSent(station, cmd, params)
+				}
+			})
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "queued",
+			"message":   fmt.Sprintf("Command queued for station %s", station.ID),
+			"stationID": station.ID,
+			"command":   cmd,
+			"payload":   fmt.Sprintf("%x", payload),
+			"position":  ticket.position,
+			"delivery":  deliveryQueued,
+		})
+		return
+	}
+
+	defer release()
+	var msg protocol.DecodedMessage
+	var err error
+	if qerr := station.queue.run(ctx, ticket, func() {
+		msg, err = sendAndWait(ctx, station, cmd, payload, cfg.ReplyTimeout)
+	}); qerr != nil {
+		err = qerr
+	}
+	if writeReply(w, station, cmd, 0, payload, audit, msg, err) {
+		noteCommandSent(station, cmd, params)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+// Второй eject уходит станции только после ответа на первый
+func TestEjectsSequential(t *testing.T) {
+	p := newTestPeer(t)
+	p.login(t, "QUEUE1", protocol.Version1)
+	profile := testProfile()
+
+	results := make(chan *httptest.ResponseRecorder, 2)
+	for _, slot := range []string{"1", "3"} {
+		go func(slot string) {
+			results <- serve(handleSendCommand, http.MethodGet, "/send?stationID=QUEUE1&cmd=eject&sync=true&slot="+slot, "")
+		}(slot)
+	}
+
+	for i := 0; i < 2; i++ {
+		frame := p.next(t)
+		if frame[2] != protocol.CmdEject {
+			t.Fatalf("frame %d cmd = 0x%02x, want eject", i+1, frame[2])
+		}
+		select {
+		case extra := <-p.frames:
+			t.Fatalf("second command %x sent before the first was answered", extra)
+		case <-time.After(50 * time.Millisecond):
+		}
+		p.send(t, protocol.EmulateResponse(frame, profile))
+	}
+	for i := 0; i < 2; i++ {
+		if rec := <-results; rec.Code != http.StatusOK || decodeJSON(t, rec)["status"] != "success" {
+			t.Errorf("eject: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Команды, которые двигают механику станции и ограничиваются строже
+var hardwareCommands = map[string]bool{
+	"rent":        true,
+	"eject":       true,
+	"eject_all":   true,
+	"multi_eject": true,
+	"restart":     true,
+	"unlock_all":  true,
+}
+
+var (
+	hardwareLimiter *rateLimiter
+	queryLimiter    *rateLimiter
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter - token bucket на каждую станцию. rate - команд в секунду,
+// burst - размер корзины. rate <= 0 отключает ограничение.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow забирает токен для key. Если токенов нет, возвращает время до
+// появления следующего.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil || l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func limiterFor(cmd string) *rateLimiter {
+	if hardwareCommands[cmd] {
+		return hardwareLimiter
+	}
+	return queryLimiter
+}
+
+// checkRateLimit отвечает 429, если станция исчерпала лимит для команды
+func checkRateLimit(w http.ResponseWriter, stationID, cmd string) bool {
+	ok, wait := limiterFor(cmd).allow(stationID)
+	if ok {
+		return true
+	}
+	rateLimited.Inc(cmd)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSONError(w, http.StatusTooManyRequests, fmt.Sprintf("Rate limit exceeded for %s on station %s, retry in %s", cmd, stationID, wait.Round(time.Millisecond)))
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+func TestHardwareRateLimit(t *testing.T) {
+	hardwareLimiter = newRateLimiter(0.5, 2)
+	defer func() { hardwareLimiter = nil }()
+	fakeStation(t, "LIMIT1", protocol.Version1)
+
+	for i, slot := range []string{"1", "2"} {
+		if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=LIMIT1&cmd=eject&slot="+slot+"&sync=true", ""); rec.Code != http.StatusOK {
+			t.Fatalf("eject %d: status %d: %s", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=LIMIT1&cmd=eject&slot=3&sync=true", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third eject: status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("Retry-After = %q, want 2", rec.Header().Get("Retry-After"))
+	}
+
+	// Запросы состояния ограничиваются отдельно
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=LIMIT1&cmd=query_iccid", ""); rec.Code != http.StatusOK {
+		t.Errorf("query after ejects were limited: status %d", rec.Code)
+	}
+}
+
+// Рассылка тратит тот же токен станции, что и /send
+func TestBulkRateLimited(t *testing.T) {
+	hardwareLimiter = newRateLimiter(0.5, 1)
+	defer func() { hardwareLimiter = nil }()
+	fakeStation(t, "LIMITBULK1", protocol.Version1)
+
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=LIMITBULK1&cmd=eject&slot=1&sync=true", ""); rec.Code != http.StatusOK {
+		t.Fatalf("eject: status %d: %s", rec.Code, rec.Body.String())
+	}
+	results := bulkResults(t, `{"station_ids":["LIMITBULK1"],"cmd":"unlock_all","token":"11223344"}`)
+	res, _ := results["LIMITBULK1"].(map[string]interface{})
+	if res["status"] != "error" || res["error"] != "rate limited" {
+		t.Errorf("bulk after the limit = %v, want rate limited", res)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RestartInfo - данные событий о перезагрузке станции по команде restart
+type RestartInfo struct {
+	// Сколько станция отсутствовала или сколько ее ждали, в секундах
+	Downtime float64 `json:"downtime"`
+}
+
+// Станции, которым отправлен restart и которые еще не перелогинились:
+// stationID -> время отправки. Обрыв соединения в это время ожидаем.
+var (
+	restartMu sync.Mutex
+	restarts  = make(map[string]time.Time)
+)
+
+// expectRestart отмечает, что станция ушла в перезагрузку. Пока идет окно
+// cfg.RestartGrace, она показывается как restarting, а не stale; если за
+// окно станция не перелогинилась, публикуется EventRestartTimeout.
+func expectRestart(stationID string) {
+	if cfg.RestartGrace <= 0 {
+		return
+	}
+	now := time.Now()
+	restartMu.Lock()
+	restarts[stationID] = now
+	restartMu.Unlock()
+
+	time.AfterFunc(cfg.RestartGrace, func() {
+		restartMu.Lock()
+		sent, ok := restarts[stationID]
+		// Новый restart за окно продлевает ожидание своим таймером
+		if !ok || !sent.Equal(now) {
+			restartMu.Unlock()
+			return
+		}
+		delete(restarts, stationID)
+		restartMu.Unlock()
+
+		slog.Warn("station did not reconnect after restart", "station_id", stationID, "grace", cfg.RestartGrace)
+		publish(Event{Type: EventRestartTimeout, StationID: stationID, Data: RestartInfo{Downtime: time.Since(sent).Seconds()}})
+	})
+}
+
+// restartCompleted вызывается при логине станции и закрывает ожидание
+// перезагрузки, если оно было
+func restartCompleted(stationID string) {
+	restartMu.Lock()
+	sent, ok := restarts[stationID]
+	delete(restarts, stationID)
+	restartMu.Unlock()
+	if !ok {
+		return
+	}
+	slog.Info("station reconnected after restart", "station_id", stationID, "downtime", time.Since(sent))
+	publish(Event{Type: EventRestarted, StationID: stationID, Data: RestartInfo{Downtime: time.Since(sent).Seconds()}})
+}
+
+// startReboot закрывает станцию для команд на cfg.RestartCooldown после
+// restart: пока шкаф загружается, они все равно не пройдут. После логина
+// станция получает новую запись, и ограничение снимается само.
+func (s *Station) startReboot(now time.Time) {
+	if cfg.RestartCooldown <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rebootUntil = now.Add(cfg.RestartCooldown)
+}
+
+func (s *Station) rebooting(now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebootUntil, now.Before(s.rebootUntil)
+}
+
+// checkRebooting отвечает 409, если станция еще загружается после restart
+func checkRebooting(w http.ResponseWriter, station *Station) bool {
+	until, ok := station.rebooting(time.Now())
+	if !ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	writeJSONError(w, http.StatusConflict, fmt.Sprintf("Station %s is rebooting after restart, retry after it logs in again", station.ID))
+	return false
+}
+
+// restarting сообщает, ждет ли сервер перелогина станции после restart
+func restarting(stationID string) bool {
+	restartMu.Lock()
+	defer restartMu.Unlock()
+	_, ok := restarts[stationID]
+	return ok
+}
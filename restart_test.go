@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+// waitEvent ждет событие типа typ, остальные пропускает
+func waitEvent(t *testing.T, events <-chan Event, typ string) Event {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-deadline:
+			t.Fatalf("no %s event", typ)
+			return Event{}
+		}
+	}
+}
+
+// Станция после restart переподключается - station_restarted, ожидание снято
+func TestRestartThenReconnect(t *testing.T) {
+	events, cancel := subscribe("test", func(ev Event) bool { return ev.StationID == "RESTART1" })
+	defer cancel()
+
+	p := newTestPeer(t)
+	p.login(t, "RESTART1", protocol.Version1)
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=RESTART1&cmd=restart", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("restart: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if frame := p.next(t); frame[2] != protocol.CmdRestart {
+		t.Fatalf("frame cmd = 0x%02x, want restart", frame[2])
+	}
+	eventually(t, "station marked restarting", func() bool { return restarting("RESTART1") })
+	p.conn.Close()
+
+	newTestPeer(t).login(t, "RESTART1", protocol.Version1)
+	waitEvent(t, events, EventRestarted)
+	if restarting("RESTART1") {
+		t.Errorf("station still restarting after login")
+	}
+}
+
+// Станция после restart не вернулась за RestartGrace - restart_timeout
+func TestRestartThenSilence(t *testing.T) {
+	grace := cfg.RestartGrace
+	t.Cleanup(func() { cfg.RestartGrace = grace })
+	cfg.RestartGrace = 20 * time.Millisecond
+	events, cancel := subscribe("test", func(ev Event) bool { return ev.StationID == "RESTART2" })
+	defer cancel()
+
+	conn := &scriptConn{}
+	scriptStation(t, "RESTART2", conn)
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=RESTART2&cmd=restart", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("restart: status %d: %s", rec.Code, rec.Body.String())
+	}
+	eventually(t, "station marked restarting", func() bool { return restarting("RESTART2") })
+	conn.Close()
+
+	ev := waitEvent(t, events, EventRestartTimeout)
+	if info, ok := ev.Data.(RestartInfo); !ok || info.Downtime < cfg.RestartGrace.Seconds() {
+		t.Errorf("restart_timeout data = %+v", ev.Data)
+	}
+	if restarting("RESTART2") {
+		t.Errorf("station still restarting after the grace window")
+	}
+}
+
+// После restart команды получают 409, пока станция не перелогинится
+func TestRestartCooldown(t *testing.T) {
+	p := newTestPeer(t)
+	station := p.login(t, "COOLDOWN1", protocol.Version1)
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=COOLDOWN1&cmd=restart", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("restart: status %d: %s", rec.Code, rec.Body.String())
+	}
+	p.next(t)
+	eventually(t, "cooldown started", func() bool {
+		_, ok := station.rebooting(time.Now())
+		return ok
+	})
+
+	rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=COOLDOWN1&cmd=heartbeat", "")
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("command during cooldown: status %d, Retry-After %q, want 409 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	p.conn.Close()
+	again := newTestPeer(t)
+	again.send(t, loginFrame("COOLDOWN1", protocol.Version1))
+	again.next(t)
+	eventually(t, "new connection registered", func() bool {
+		st, ok := lookupStation("COOLDOWN1", "")
+		return ok && st != station
+	})
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=COOLDOWN1&cmd=heartbeat", ""); rec.Code != http.StatusOK {
+		t.Errorf("command after re-login: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
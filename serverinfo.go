@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// buildVersion задается при сборке: -ldflags "-X main.buildVersion=v1.2.3".
+// Пустая - берем версию модуля из build info.
+var buildVersion string
+
+// Адреса, на которых реально слушают listener-ы: при :0 порт выбирает ядро
+var (
+	boundMu   sync.Mutex
+	boundTCP  string
+	boundHTTP string
+)
+
+func setBoundAddr(dst *string, addr net.Addr) {
+	boundMu.Lock()
+	defer boundMu.Unlock()
+	if addr == nil {
+		*dst = ""
+		return
+	}
+	*dst = addr.String()
+}
+
+type ServerFeatures struct {
+	// TLS сервер не поднимает ни на TCP, ни на HTTP
+	TLS      bool `json:"tls"`
+	Auth     bool `json:"auth"`
+	Webhooks bool `json:"webhooks"`
+}
+
+type ServerInfo struct {
+	TCPAddr  string         `json:"tcpAddr"`
+	HTTPAddr string         `json:"httpAddr"`
+	Version  string         `json:"version"`
+	Uptime   float64        `json:"uptimeSeconds"`
+	Features ServerFeatures `json:"features"`
+}
+
+func serverVersion() string {
+	if buildVersion != "" {
+		return buildVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// handleServerInfo отдает адреса listener-ов, версию и включенные функции.
+// Пустой tcpAddr - TCP listener сейчас не поднят.
+func handleServerInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use GET")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	boundMu.Lock()
+	info := ServerInfo{TCPAddr: boundTCP, HTTPAddr: boundHTTP}
+	boundMu.Unlock()
+
+	info.Version = serverVersion()
+	info.Uptime = time.Since(startTime).Seconds()
+	info.Features = ServerFeatures{
+		Auth:     len(apiKeys) > 0,
+		Webhooks: cfg.WebhookURL != "",
+	}
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// При :0 /server/info отдает порт, который выбрало ядро
+func TestServerInfoBoundPort(t *testing.T) {
+	l, err := listenStations("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	setBoundAddr(&boundTCP, l.Addr())
+	t.Cleanup(func() { setBoundAddr(&boundTCP, nil) })
+
+	rec := serve(handleServerInfo, http.MethodGet, "/server/info", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	addr, _ := decodeJSON(t, rec)["tcpAddr"].(string)
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "0" {
+		t.Fatalf("tcpAddr = %q, want the bound port", addr)
+	}
+	if want := l.Addr().(*net.TCPAddr).Port; port != strconv.Itoa(want) {
+		t.Errorf("reported port %s, listener port %d", port, want)
+	}
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial reported address: %v", err)
+	}
+	client.Close()
+
+	setBoundAddr(&boundTCP, nil)
+	if addr := decodeJSON(t, serve(handleServerInfo, http.MethodGet, "/server/info", ""))["tcpAddr"]; addr != "" {
+		t.Errorf("tcpAddr with the listener down = %v, want empty", addr)
+	}
+}
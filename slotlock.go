@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Слоты, на которых сейчас идет rent или eject: "stationID/slot". Вторая
+// команда тому же слоту, пока первая не получила ответ, дала бы станции
+// два противоречащих приказа мотору.
+var (
+	slotLockMu sync.Mutex
+	slotLocks  = make(map[string]bool)
+)
+
+// lockSlot занимает слот станции под аппаратную операцию. Если слот уже
+// занят, возвращает false; иначе release освобождает его.
+func lockSlot(stationID, slot string) (release func(), ok bool) {
+	// "01" и "1" - один и тот же слот
+	slot = strings.TrimSpace(slot)
+	if n, err := strconv.Atoi(slot); err == nil {
+		slot = strconv.Itoa(n)
+	}
+	key := stationID + "/" + slot
+
+	slotLockMu.Lock()
+	defer slotLockMu.Unlock()
+	if slotLocks[key] {
+		slotConflicts.Inc()
+		return nil, false
+	}
+	slotLocks[key] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			slotLockMu.Lock()
+			delete(slotLocks, key)
+			slotLockMu.Unlock()
+		})
+	}, true
+}
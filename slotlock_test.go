@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Два одновременных rent одного слота: один уходит станции, второй - 409
+func TestConcurrentRentSameSlot(t *testing.T) {
+	// Станция молчит, слот занят до ReplyTimeout: своя станция на прогон
+	id := fmt.Sprintf("SLOTLOCK%d", time.Now().UnixNano()%1e9)
+	conn := &scriptConn{}
+	scriptStation(t, id, conn)
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			codes[i] = serve(handleSendCommand, http.MethodGet, "/send?stationID="+id+"&cmd=rent&slot=1", "").Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if !(codes[0] == http.StatusAccepted && codes[1] == http.StatusConflict || codes[0] == http.StatusConflict && codes[1] == http.StatusAccepted) {
+		t.Errorf("statuses = %v, want one 202 and one 409", codes)
+	}
+	eventually(t, "rent written", func() bool { return conn.attempts() == 1 })
+
+	tests := []struct {
+		slot string
+		code int
+	}{
+		{"01", http.StatusConflict},
+		{"2", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID="+id+"&cmd=eject&slot="+tt.slot, ""); rec.Code != tt.code {
+			t.Errorf("eject slot %s: status %d, want %d: %s", tt.slot, rec.Code, tt.code, rec.Body.String())
+		}
+	}
+}
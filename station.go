@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"server/internal/protocol"
+	"server/internal/store"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StationConn - то, что реестру и записи команд нужно от соединения
+// станции. net.Conn подходит как есть; fakeConn держит станцию в памяти.
+type StationConn interface {
+	io.Writer
+	Close() error
+	RemoteAddr() net.Addr
+	SetWriteDeadline(t time.Time) error
+}
+
+// Station - запись о подключенной станции. Conn, ID, ConnID, SessionID и
+// ConnectedSince не меняются после регистрации, остальные поля защищены mu.
+type Station struct {
+	ID     string
+	ConnID string
+	// session_id соединения в логах, см. newSessionID
+	SessionID string
+	Conn      StationConn
+	// Когда соединение было принято, а не когда прошел логин
+	ConnectedSince time.Time
+
+	// Сериализует запись кадров в Conn: /send, /send/bulk и ответы из
+	// handleConnection пишут из разных горутин
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	token     []byte
+	version   byte
+	lastSeen  time.Time
+	hwRev     string
+	slotCount int
+	firmware  string
+	fwVersion *protocol.FirmwareVersion
+	iccid     string
+	inventory []protocol.SlotEntry
+	status    *protocol.CabinetStatus
+	// Состояние из последнего heartbeat с payload
+	hbStatus *protocol.HeartbeatStatus
+	// Кадры с неверной checksum за время соединения
+	checksumFailures int
+	// NACK на кадры с неверной checksum, см. retransmitRequested
+	retransmits int
+	server      *protocol.ServerConfig
+	clock       *ClockInfo
+	capacity    *protocol.Capacity
+	cycles      []protocol.PowerBankCycles
+	// До какого времени станция загружается после restart, см. restart.go
+	rebootUntil time.Time
+	// Части инвентаря, пришедшие кадрами с флагом продолжения, и время первой
+	invParts      []protocol.SlotEntry
+	invPartsSince time.Time
+	// Отправленные запросы query_power_bank по одному слоту
+	slotQueries []slotQuery
+
+	// Интервал heartbeat: ожидаемый (по умолчанию или из set_server) и
+	// последние наблюдаемые промежутки между heartbeat
+	expectedInterval time.Duration
+	lastHeartbeat    time.Time
+	heartbeatGaps    []time.Duration
+
+	// До какого момента кадры соединения пишутся в лог подробно, см. trace.go
+	traceUntil time.Time
+
+	// Ожидающие ответа команды по cmd байту, см. pending.go. После закрытия
+	// соединения waitersClosed, и новые ожидания сразу получают отказ.
+	waiters       map[byte][]replyWaiter
+	waitersClosed bool
+
+	// Очередь аппаратных команд, см. queue.go
+	queue commandQueue
+}
+
+// ClockInfo - часы шкафа из последнего ответа на query_time
+type ClockInfo struct {
+	Time time.Time `json:"time"`
+	// На сколько секунд часы шкафа спешат относительно сервера
+	Offset float64 `json:"offset"`
+}
+
+type StationDetail struct {
+	StationID       string                    `json:"stationID"`
+	ConnID          string                    `json:"connID"`
+	SessionID       string                    `json:"sessionID"`
+	ConnectedSince  time.Time                 `json:"connected_since"`
+	Uptime          float64                   `json:"uptime"`
+	Connections     []string                  `json:"connections,omitempty"`
+	Status          string                    `json:"status"`
+	Token           string                    `json:"token"`
+	Version         byte                      `json:"protocolVersion"`
+	RemoteAddr      string                    `json:"remoteAddr"`
+	LastSeen        time.Time                 `json:"lastSeen"`
+	HardwareRev     string                    `json:"hardwareRev,omitempty"`
+	SlotCount       int                       `json:"slotCount,omitempty"`
+	Firmware        string                    `json:"firmware,omitempty"`
+	FirmwareVersion *protocol.FirmwareVersion `json:"firmwareVersion,omitempty"`
+	ICCID           string                    `json:"iccid,omitempty"`
+	Inventory       []protocol.SlotEntry      `json:"inventory,omitempty"`
+	CabinetStatus   *protocol.CabinetStatus   `json:"cabinetStatus,omitempty"`
+	HeartbeatStatus *protocol.HeartbeatStatus `json:"heartbeatStatus,omitempty"`
+	ServerConfig    *protocol.ServerConfig    `json:"serverConfig,omitempty"`
+	Clock           *ClockInfo                `json:"clock,omitempty"`
+	Capacity        *protocol.Capacity        `json:"capacity,omitempty"`
+	Heartbeat       HeartbeatInfo             `json:"heartbeat"`
+	ChecksumErrors  int                       `json:"checksumFailures"`
+	Retransmits     int                       `json:"retransmitRequests"`
+	QueueLength     int                       `json:"queueLength"`
+	// Последний ответ на query_cycles
+	ChargeCycles []protocol.PowerBankCycles `json:"chargeCycles,omitempty"`
+	Rebooting    bool                       `json:"rebooting,omitempty"`
+}
+
+// HeartbeatInfo - ожидаемый и наблюдаемый интервал heartbeat в секундах.
+// Drift выставляется, когда наблюдаемый интервал отличается от ожидаемого
+// больше чем в полтора раза.
+type HeartbeatInfo struct {
+	ExpectedInterval float64 `json:"expected_interval"`
+	ObservedInterval float64 `json:"observed_interval,omitempty"`
+	Samples          int     `json:"samples"`
+	Drift            bool    `json:"drift"`
+}
+
+// Сколько последних промежутков усредняется в observed_interval
+const heartbeatWindow = 8
+
+// normalizeStationID убирает хвостовые нули и пробелы по краям и приводит
+// регистр по cfg.StationIDCase, чтобы ID из логина и из API совпадали
+func normalizeStationID(id string) string {
+	id = strings.TrimSpace(strings.Trim(id, "\x00"))
+	switch cfg.StationIDCase {
+	case "upper":
+		id = strings.ToUpper(id)
+	case "lower":
+		id = strings.ToLower(id)
+	}
+	return id
+}
+
+func newStation(id string, c StationConn, acceptedAt time.Time, token []byte, version byte) *Station {
+	return &Station{
+		ID:             id,
+		ConnID:         nextConnID(),
+		Conn:           c,
+		ConnectedSince: acceptedAt,
+		token:          append([]byte(nil), token...),
+		version:        version,
+		lastSeen:       time.Now(),
+
+		expectedInterval: cfg.HeartbeatInterval,
+	}
+}
+
+// write пишет кадр целиком под writeMu, чтобы кадры разных писателей не
+// перемешались в сокете
+func (s *Station) write(frame []byte, timeout time.Duration) (int, error) {
+	s.trace("out", frame)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeFrame(s.Conn, frame, timeout)
+}
+
+// connStatus - "restarting" после отправленного restart, "stale", если от
+// станции ничего не приходило дольше cfg.StaleAfter, иначе "connected"
+func (s *Station) connStatus(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statusLocked(now)
+}
+
+func (s *Station) statusLocked(now time.Time) string {
+	if restarting(s.ID) {
+		return "restarting"
+	}
+	if cfg.StaleAfter > 0 && now.Sub(s.lastSeen) > cfg.StaleAfter {
+		return "stale"
+	}
+	return "connected"
+}
+
+// uptime - сколько секунд живет соединение станции
+func (s *Station) uptime(now time.Time) float64 {
+	return now.Sub(s.ConnectedSince).Seconds()
+}
+
+func (s *Station) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+// heartbeat отмечает полученный heartbeat и запоминает промежуток с предыдущего
+func (s *Station) heartbeat(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.lastHeartbeat.IsZero() {
+		s.heartbeatGaps = append(s.heartbeatGaps, now.Sub(s.lastHeartbeat))
+		if len(s.heartbeatGaps) > heartbeatWindow {
+			s.heartbeatGaps = s.heartbeatGaps[1:]
+		}
+	}
+	s.lastHeartbeat = now
+}
+
+// setExpectedInterval вызывается после успешной отправки set_server.
+// Старые промежутки сбрасываются, они относятся к прошлому интервалу.
+func (s *Station) setExpectedInterval(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expectedInterval = d
+	s.heartbeatGaps = nil
+}
+
+// heartbeatInfo вызывается под s.mu
+func (s *Station) heartbeatInfo() HeartbeatInfo {
+	info := HeartbeatInfo{
+		ExpectedInterval: s.expectedInterval.Seconds(),
+		Samples:          len(s.heartbeatGaps),
+	}
+	if len(s.heartbeatGaps) == 0 {
+		return info
+	}
+	var total time.Duration
+	for _, gap := range s.heartbeatGaps {
+		total += gap
+	}
+	observed := total / time.Duration(len(s.heartbeatGaps))
+	info.ObservedInterval = observed.Seconds()
+	if s.expectedInterval > 0 {
+		ratio := float64(observed) / float64(s.expectedInterval)
+		info.Drift = ratio > 1.5 || ratio < 1/1.5
+	}
+	return info
+}
+
+// noteCommandSent обновляет ожидания по станции после успешной записи команды
+func noteCommandSent(s *Station, cmd string, params protocol.Params) {
+	switch cmd {
+	case "set_server":
+		if secs, err := strconv.Atoi(strings.TrimSpace(params.Slot)); err == nil && secs > 0 {
+			s.setExpectedInterval(time.Duration(secs) * time.Second)
+		}
+	}
+}
+
+// noteCommandWritten вызывается sendToStation сразу после записи кадра, не
+// дожидаясь ответа: restart может оборвать соединение раньше, чем станция
+// ответит
+func noteCommandWritten(s *Station, cmd string) {
+	if cmd == "restart" {
+		// Станция оборвет соединение и перелогинится
+		expectRestart(s.ID)
+		s.startReboot(time.Now())
+	}
+}
+
+// refreshInventory запрашивает весь инвентарь станции, чтобы заполнить кэш
+// после логина. Ответ разбирает receive, как любой другой.
+func refreshInventory(s *Station) {
+	if !cfg.RefreshOnLogin {
+		return
+	}
+	payload, err := protocol.CreateCommand("query_power_bank", s.tokenHex(), "", s.Version())
+	if err != nil {
+		slog.Warn("inventory refresh after login", "station_id", s.ID, "error", err)
+		return
+	}
+	if err := sendToStation(context.Background(), s, "query_power_bank", payload, cfg.WriteTimeout); err != nil {
+		slog.Warn("inventory refresh after login failed", "station_id", s.ID, "error", err)
+	}
+}
+
+// receive обрабатывает кадр, пришедший от залогинившейся станции:
+// обновляет запись и отдает ответ ожидающей команде
+func (s *Station) receive(frame []byte) {
+	s.trace("in", frame)
+	s.touch()
+	msg, err := protocol.Decode(frame)
+	if err != nil {
+		if errors.Is(err, protocol.ErrBadChecksum) {
+			s.checksumFailure()
+		}
+		return
+	}
+	if msg.Cmd == protocol.CmdHeartbeat {
+		s.heartbeat(time.Now())
+	}
+	if msg.Inventory != nil {
+		// Ожидающий ответа и кэш получают инвентарь только целиком
+		var complete bool
+		if msg.Inventory, complete = s.assembleInventory(msg.Inventory, msg.InventoryMore, time.Now()); !complete {
+			return
+		}
+		msg.InventoryMore = false
+	}
+	s.apply(msg)
+	s.deliver(msg)
+	if msg.Cmd != protocol.CmdHeartbeat {
+		persistStation(s)
+	}
+}
+
+// assembleInventory копит части инвентаря с флагом продолжения. Возвращает
+// весь инвентарь и true на последней части. Части старше
+// cfg.InventoryPartTimeout отбрасываются: продолжение потерялось.
+func (s *Station) assembleInventory(part []protocol.SlotEntry, more bool, now time.Time) ([]protocol.SlotEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.invParts != nil && now.Sub(s.invPartsSince) > cfg.InventoryPartTimeout {
+		slog.Warn("dropping incomplete inventory, continuation did not arrive", "station_id", s.ID, "entries", len(s.invParts), "timeout", cfg.InventoryPartTimeout)
+		inventoryPartsDropped.Inc()
+		s.invParts = nil
+	}
+	if !more {
+		if s.invParts == nil {
+			return part, true
+		}
+		full := append(s.invParts, part...)
+		s.invParts = nil
+		return full, true
+	}
+	if s.invParts == nil {
+		s.invParts = make([]protocol.SlotEntry, 0, len(part)*2)
+		s.invPartsSince = now
+	}
+	s.invParts = append(s.invParts, part...)
+	return nil, false
+}
+
+// apply обновляет запись по данным из ответа станции
+func (s *Station) apply(msg protocol.DecodedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case msg.Login != nil:
+		s.hwRev = msg.Login.HardwareRev
+		s.slotCount = msg.Login.SlotCount
+	case msg.Firmware != "":
+		s.firmware = msg.Firmware
+		s.fwVersion = msg.FirmwareVersion
+	case msg.ICCID != "":
+		// Невалидный ICCID все равно сохраняем: он нужен для разбора проблемы
+		if !protocol.ValidICCID(msg.ICCID) {
+			slog.Warn("implausible ICCID from station", "station_id", s.ID, "iccid", msg.ICCID)
+		}
+		s.iccid = msg.ICCID
+	case msg.Inventory != nil:
+		prev := s.inventory
+		defer func() {
+			for _, ev := range slotChanges(prev, s.inventory) {
+				ev.StationID = s.ID
+				publish(ev)
+			}
+		}()
+		if slot, ok := s.takeSlotQuery(msg.Token, msg.Inventory); ok {
+			// Без полного инвентаря один слот в кэш не кладем, иначе
+			// eject_all увидит только его
+			if s.inventory != nil {
+				s.inventory = mergeSlot(s.inventory, slot, msg.Inventory)
+			}
+			break
+		}
+		s.inventory = msg.Inventory
+	case msg.Status != nil:
+		s.status = msg.Status
+	case msg.Heartbeat != nil:
+		s.hbStatus = msg.Heartbeat
+	case msg.Server != nil:
+		s.server = msg.Server
+	case msg.Capacity != nil:
+		s.capacity = msg.Capacity
+	case msg.Cycles != nil:
+		s.cycles = msg.Cycles
+	case msg.Time != nil:
+		s.clock = &ClockInfo{Time: *msg.Time, Offset: time.Until(*msg.Time).Seconds()}
+	case msg.Return != nil:
+		publish(Event{Type: EventReturned, StationID: s.ID, Data: ReturnInfo{
+			PowerBankReturn: *msg.Return,
+			Accepted:        protocol.ReturnResult(*msg.Return) == protocol.ReturnAccepted,
+		}})
+	}
+}
+
+// checksumFailure учитывает кадр с неверной checksum. Растущий счетчик
+// обычно значит плохую связь или баг прошивки, поэтому на пороге
+// cfg.ChecksumAlertAfter публикуется событие.
+func (s *Station) checksumFailure() {
+	stationChecksumFailures.Inc(s.ID)
+
+	s.mu.Lock()
+	s.checksumFailures++
+	n := s.checksumFailures
+	s.mu.Unlock()
+
+	if cfg.ChecksumAlertAfter > 0 && n == cfg.ChecksumAlertAfter {
+		slog.Warn("checksum failures from station reached threshold", "station_id", s.ID, "failures", n)
+		publish(Event{Type: EventChecksum, StationID: s.ID, Data: ChecksumAlert{Failures: n}})
+	}
+}
+
+// retransmitBudget решает, просить ли станцию повторить кадр с неверной
+// checksum (-nack-checksum). После cfg.MaxRetransmits неудач подряд кадры
+// отбрасываются молча: повтор явно не помогает. Счетчик живет в
+// соединении, поэтому лимит действует и до логина.
+type retransmitBudget struct {
+	badRun int
+}
+
+// allow учитывает кадр и для кадра с неверной checksum сообщает, можно ли
+// ответить на него NACK. Верный кадр обнуляет счетчик.
+func (b *retransmitBudget) allow(valid bool) bool {
+	if valid {
+		b.badRun = 0
+		return true
+	}
+	b.badRun++
+	return cfg.MaxRetransmits <= 0 || b.badRun <= cfg.MaxRetransmits
+}
+
+// retransmitRequested учитывает отправленный станции NACK
+func (s *Station) retransmitRequested() {
+	s.mu.Lock()
+	s.retransmits++
+	s.mu.Unlock()
+	retransmitRequests.Inc(s.ID)
+}
+
+// slotQuery - query_power_bank по одному слоту, ждущий ответа. Ответ
+// находится по Token, как у ожидающих команд в pending.go: полный
+// инвентарь, пришедший в это время, не должен приниматься за ответ слота.
+type slotQuery struct {
+	token []byte
+	slot  byte
+}
+
+func (s *Station) beginSlotQuery(token []byte, slot byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slotQueries = append(s.slotQueries, slotQuery{token: token, slot: slot})
+}
+
+func (s *Station) cancelSlotQuery(token []byte, slot byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, q := range s.slotQueries {
+		if q.slot == slot && bytes.Equal(q.token, token) {
+			s.slotQueries = append(s.slotQueries[:i], s.slotQueries[i+1:]...)
+			return
+		}
+	}
+}
+
+// takeSlotQuery снимает запрос слота, на который отвечает инвентарь с
+// данным токеном, вызывается под mu. Ответ на запрос слота содержит только
+// этот слот: инвентарь с другими слотами - полный, даже при том же токене.
+func (s *Station) takeSlotQuery(token []byte, inventory []protocol.SlotEntry) (byte, bool) {
+	for i, q := range s.slotQueries {
+		if !bytes.Equal(q.token, token) || !onlySlot(inventory, q.slot) {
+			continue
+		}
+		s.slotQueries = append(s.slotQueries[:i], s.slotQueries[i+1:]...)
+		return q.slot, true
+	}
+	return 0, false
+}
+
+func onlySlot(inventory []protocol.SlotEntry, slot byte) bool {
+	for _, e := range inventory {
+		if e.Slot != slot {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSlot заменяет в инвентаре записи слота на записи из ответа.
+// Пустой ответ значит, что слот свободен.
+func mergeSlot(inventory []protocol.SlotEntry, slot byte, reply []protocol.SlotEntry) []protocol.SlotEntry {
+	merged := make([]protocol.SlotEntry, 0, len(inventory)+1)
+	for _, e := range inventory {
+		if e.Slot != slot {
+			merged = append(merged, e)
+		}
+	}
+	merged = append(merged, protocol.FilterInventory(reply, slot)...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Slot < merged[j].Slot })
+	return merged
+}
+
+// Version - версия протокола, с которой станция залогинилась
+func (s *Station) Version() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// SlotCount - число слотов из ReqData логина или из query_capacity, 0 если
+// станция его не сообщила
+func (s *Station) SlotCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Не сообщила при логине - берем из ответа на query_capacity
+	if s.slotCount == 0 && s.capacity != nil {
+		return s.capacity.Total
+	}
+	return s.slotCount
+}
+
+func (s *Station) cachedInventory() []protocol.SlotEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.SlotEntry(nil), s.inventory...)
+}
+
+func (s *Station) tokenHex() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%x", s.token)
+}
+
+func (s *Station) detail() StationDetail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+
+	return StationDetail{
+		StationID:       s.ID,
+		ConnID:          s.ConnID,
+		SessionID:       s.SessionID,
+		ConnectedSince:  s.ConnectedSince,
+		Uptime:          s.uptime(now),
+		Status:          s.statusLocked(now),
+		Token:           fmt.Sprintf("%x", s.token),
+		Version:         s.version,
+		RemoteAddr:      s.Conn.RemoteAddr().String(),
+		LastSeen:        s.lastSeen,
+		HardwareRev:     s.hwRev,
+		SlotCount:       s.slotCount,
+		Firmware:        s.firmware,
+		FirmwareVersion: s.fwVersion,
+		ICCID:           s.iccid,
+		Inventory:       append([]protocol.SlotEntry(nil), s.inventory...),
+		CabinetStatus:   s.status,
+		HeartbeatStatus: s.hbStatus,
+		ServerConfig:    s.server,
+		Clock:           s.clock,
+		Capacity:        s.capacity,
+		Heartbeat:       s.heartbeatInfo(),
+		ChecksumErrors:  s.checksumFailures,
+		Retransmits:     s.retransmits,
+		QueueLength:     s.queue.length(),
+		ChargeCycles:    s.cycles,
+		Rebooting:       time.Now().Before(s.rebootUntil),
+	}
+}
+
+func (s *Station) record() store.StationRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return store.StationRecord{
+		StationID: s.ID,
+		LastSeen:  s.lastSeen,
+		Firmware:  s.firmware,
+		ICCID:     s.iccid,
+		Inventory: append([]protocol.SlotEntry(nil), s.inventory...),
+	}
+}
+
+func persistStation(s *Station) {
+	rec := s.record()
+	rememberStation(rec)
+	if err := stationStore.SaveStation(rec); err != nil {
+		slog.Warn("failed to persist station", "station_id", s.ID, "error", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+// Полный инвентарь, пришедший во время запроса одного слота, не должен
+// приниматься за ответ на него: роли определяет Token
+func TestSlotQueryMatchedByToken(t *testing.T) {
+	station, _ := fakeStation(t, "SLOTTOKEN", protocol.Version2)
+	full := []protocol.SlotEntry{{Slot: 1, PowerBankID: "RL1H|001"}, {Slot: 3, PowerBankID: "RL1H|003"}}
+	station.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: testToken, Inventory: full})
+
+	queryToken := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+	station.beginSlotQuery(queryToken, 3)
+
+	// Обновление после логина со своим токеном: заменяет кэш целиком
+	refresh := []protocol.SlotEntry{{Slot: 1, PowerBankID: "RL1H|001"}, {Slot: 2, PowerBankID: "RL1H|002"}, {Slot: 3, PowerBankID: "RL1H|003"}}
+	station.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: testToken, Inventory: refresh})
+	if got := station.cachedInventory(); len(got) != 3 {
+		t.Fatalf("after full refresh inventory = %+v, want 3 entries", got)
+	}
+
+	// Ответ слота 3: слот пуст, остальные записи остаются
+	station.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: queryToken, Inventory: []protocol.SlotEntry{}})
+	got := station.cachedInventory()
+	if len(got) != 2 || got[0].Slot != 1 || got[1].Slot != 2 {
+		t.Errorf("after slot reply inventory = %+v, want slots 1 and 2", got)
+	}
+}
+
+func TestICCIDStored(t *testing.T) {
+	logs := captureLogs(t, "info")
+	tests := []struct {
+		id, iccid string
+		valid     bool
+	}{
+		{"ICCID1", "89860416121880245965", true},
+		{"ICCID2", "8986-BAD", false},
+	}
+	for _, tt := range tests {
+		station, _ := fakeStation(t, tt.id, protocol.Version1)
+		station.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryICCID, Token: testToken, ICCID: tt.iccid})
+		if got := station.detail().ICCID; got != tt.iccid {
+			t.Errorf("%s: stored ICCID = %q, want %q", tt.id, got, tt.iccid)
+		}
+
+		warned := false
+		for _, rec := range logs.records(t) {
+			if rec["msg"] == "implausible ICCID from station" && rec["station_id"] == tt.id {
+				warned = true
+			}
+		}
+		if warned == tt.valid {
+			t.Errorf("%s: warned = %v for ICCID %q", tt.id, warned, tt.iccid)
+		}
+	}
+}
+
+func TestObservedHeartbeatInterval(t *testing.T) {
+	station, _ := fakeStation(t, "HBINT1", protocol.Version1)
+	station.setExpectedInterval(30 * time.Second)
+
+	// Промежутки 20, 40 и 30 секунд: в среднем 30, дрейфа нет
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, offset := range []int{0, 20, 60, 90} {
+		station.heartbeat(start.Add(time.Duration(offset) * time.Second))
+	}
+	hb := station.detail().Heartbeat
+	if hb.Samples != 3 || hb.ObservedInterval != 30 || hb.ExpectedInterval != 30 || hb.Drift {
+		t.Errorf("heartbeat = %+v, want 3 samples averaging 30s without drift", hb)
+	}
+
+	// Станция замолкает: окно заполняется промежутками по 90 секунд
+	last := start.Add(90 * time.Second)
+	for i := 0; i < heartbeatWindow; i++ {
+		last = last.Add(90 * time.Second)
+		station.heartbeat(last)
+	}
+	hb = station.detail().Heartbeat
+	if hb.Samples != heartbeatWindow || hb.ObservedInterval != 90 || !hb.Drift {
+		t.Errorf("heartbeat = %+v, want a full window of 90s gaps with drift", hb)
+	}
+}
+
+func TestNormalizeStationID(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		mode, id, want string
+	}{
+		{"", "BOX1\x00\x00\x00\x00", "BOX1"},
+		{"", "  BOX1 ", "BOX1"},
+		{"", "Box1", "Box1"},
+		{"upper", "Box1\x00", "BOX1"},
+		{"lower", " Box1", "box1"},
+	}
+	for _, tt := range tests {
+		cfg.StationIDCase = tt.mode
+		if got := normalizeStationID(tt.id); got != tt.want {
+			t.Errorf("case %q: normalizeStationID(%q) = %q, want %q", tt.mode, tt.id, got, tt.want)
+		}
+	}
+
+	// Логин с нулями в BoxID находится по ID из API в другом регистре
+	cfg.StationIDCase = "upper"
+	p := newTestPeer(t)
+	p.send(t, loginFrame("mixed1\x00\x00", protocol.Version1))
+	p.next(t)
+	eventually(t, "normalized station registered", func() bool {
+		_, ok := lookupStation("Mixed1", "")
+		return ok
+	})
+}
+
+func TestStationUptime(t *testing.T) {
+	connected := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	station := newStation("UPTIME1", &scriptConn{}, connected, testToken, protocol.Version1)
+	if got := station.uptime(connected.Add(90 * time.Second)); got != 90 {
+		t.Errorf("uptime after 90s = %v", got)
+	}
+	if got := station.uptime(connected.Add(time.Hour)); got != 3600 {
+		t.Errorf("uptime after an hour = %v", got)
+	}
+
+	// В detail uptime считается от ConnectedSince, а не от последнего кадра
+	station.ConnectedSince = time.Now().Add(-time.Minute)
+	station.touch()
+	if d := station.detail(); d.Uptime < 60 || d.Uptime > 61 || !d.ConnectedSince.Equal(station.ConnectedSince) {
+		t.Errorf("detail uptime = %v since %v", d.Uptime, d.ConnectedSince)
+	}
+}
+
+func TestChecksumFailuresPerStation(t *testing.T) {
+	keepConfig(t)
+	cfg.ChecksumAlertAfter = 3
+	// Метрика глобальная: свой ID станции на каждый запуск теста
+	id := fmt.Sprintf("CSUM%d", time.Now().UnixNano()%1e9)
+	alerts, cancel := subscribe("test", func(ev Event) bool { return ev.StationID == id && ev.Type == EventChecksum })
+	defer cancel()
+
+	p := newTestPeer(t)
+	station := p.login(t, id, protocol.Version1)
+	for i := 0; i < 3; i++ {
+		bad := heartbeatFrame(t, protocol.Version1)
+		bad[4] ^= 0xFF
+		p.send(t, bad)
+	}
+	p.send(t, heartbeatFrame(t, protocol.Version1))
+	p.next(t)
+
+	if got := station.detail().ChecksumErrors; got != 3 {
+		t.Errorf("checksumFailures = %d, want 3", got)
+	}
+	if got := scrapeMetric(t, fmt.Sprintf("station_checksum_failures_by_station_total{station_id=%q}", id)); got != "3" {
+		t.Errorf("per-station metric = %s, want 3", got)
+	}
+	select {
+	case ev := <-alerts:
+		if alert, _ := ev.Data.(ChecksumAlert); alert.Failures != 3 {
+			t.Errorf("alert = %+v", ev.Data)
+		}
+	case <-time.After(testTimeout):
+		t.Errorf("no checksum alert at the threshold")
+	}
+}
+
+// Части инвентаря с флагом продолжения склеиваются в один список; часть,
+// продолжение которой не пришло за InventoryPartTimeout, отбрасывается
+func TestInventoryPartsMerged(t *testing.T) {
+	station := scriptStation(t, "INVPARTS1", &scriptConn{})
+	first := []protocol.SlotEntry{{Slot: 1, PowerBankID: "RL1H|001", Level: 4}, {Slot: 2, PowerBankID: "RL1H|002", Level: 3}}
+	last := []protocol.SlotEntry{{Slot: 3, PowerBankID: "RL1H|003", Level: 1}}
+	now := time.Now()
+
+	if inv, complete := station.assembleInventory(first, true, now); complete || inv != nil {
+		t.Fatalf("first part: %+v, complete=%v, want nothing yet", inv, complete)
+	}
+	inv, complete := station.assembleInventory(last, false, now.Add(time.Second))
+	if want := append(append([]protocol.SlotEntry(nil), first...), last...); !complete || !reflect.DeepEqual(inv, want) {
+		t.Errorf("merged inventory = %+v, complete=%v, want %+v", inv, complete, want)
+	}
+
+	station.assembleInventory(first, true, now)
+	inv, complete = station.assembleInventory(last, false, now.Add(cfg.InventoryPartTimeout+time.Second))
+	if !complete || !reflect.DeepEqual(inv, last) {
+		t.Errorf("inventory after a lost continuation = %+v, want only the last part", inv)
+	}
+}
+
+// Ответ на query_cycles остается в записи станции и виден в /stations/{id}
+func TestChargeCyclesInDetail(t *testing.T) {
+	fakeStation(t, "CYCLES1", protocol.Version1)
+	if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID=CYCLES1&cmd=query_cycles&wait=true", ""); rec.Code != http.StatusOK {
+		t.Fatalf("query_cycles: status %d: %s", rec.Code, rec.Body.String())
+	}
+	detail := decodeJSON(t, serve(handleStation, http.MethodGet, "/stations/CYCLES1", ""))
+	cycles, _ := detail["chargeCycles"].([]interface{})
+	if len(cycles) != len(protocol.DefaultSlots.Inventory()) {
+		t.Fatalf("chargeCycles = %v", detail["chargeCycles"])
+	}
+	if first, _ := cycles[0].(map[string]interface{}); first["powerBankID"] != "RL1H|001" || first["cycles"] != float64(150) {
+		t.Errorf("first entry = %v", cycles[0])
+	}
+}
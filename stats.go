@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StatsResponse - сводка для дашбордов. Connected включает stale станции,
+// PowerBanks считается только по станциям с кэшированным inventory.
+type StatsResponse struct {
+	Connected        int            `json:"connected"`
+	Stale            int            `json:"stale"`
+	PowerBanks       int            `json:"powerBanks"`
+	InventoryUnknown int            `json:"inventoryUnknown"`
+	FirmwareVersions map[string]int `json:"firmwareVersions"`
+	ProtocolVersions map[string]int `json:"protocolVersions"`
+}
+
+// stationStats - то, что /stats берет у одной станции, под ее mu
+type stationStats struct {
+	status     string
+	firmware   string
+	version    byte
+	powerBanks int
+	inventory  bool
+}
+
+func (s *Station) stats(now time.Time) stationStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := stationStats{
+		status:    s.statusLocked(now),
+		firmware:  s.firmware,
+		version:   s.version,
+		inventory: s.inventory != nil,
+	}
+	for _, e := range s.inventory {
+		if e.PowerBankID != "" {
+			st.powerBanks++
+		}
+	}
+	return st
+}
+
+// handleStats - сводка по парку станций. Под mu только снимаем список
+// станций, кэш каждой станции читается уже без глобальной блокировки.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use GET")
+		return
+	}
+
+	mu.RLock()
+	all := make([]*Station, 0, len(connections))
+	for _, st := range connections {
+		all = append(all, st)
+	}
+	mu.RUnlock()
+
+	resp := StatsResponse{
+		Connected:        len(all),
+		FirmwareVersions: make(map[string]int),
+		ProtocolVersions: make(map[string]int),
+	}
+	now := time.Now()
+	for _, st := range all {
+		s := st.stats(now)
+		if s.status == "stale" {
+			resp.Stale++
+		}
+		if s.inventory {
+			resp.PowerBanks += s.powerBanks
+		} else {
+			resp.InventoryUnknown++
+		}
+		fw := s.firmware
+		if fw == "" {
+			fw = "unknown"
+		}
+		resp.FirmwareVersions[fw]++
+		resp.ProtocolVersions[fmt.Sprintf("v%d", s.version)]++
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
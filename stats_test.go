@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"server/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestStatsSummary(t *testing.T) {
+	a, _ := fakeStation(t, "STATS1", protocol.Version1)
+	a.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryFirmware, Token: testToken, Firmware: "RL1,H6,08,14"})
+	a.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: testToken, Inventory: []protocol.SlotEntry{
+		{Slot: 1, PowerBankID: "RL1H|001"}, {Slot: 3, PowerBankID: "RL1H|003"},
+	}})
+	b, _ := fakeStation(t, "STATS2", protocol.Version2)
+	b.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryFirmware, Token: testToken, Firmware: "RL1,H6,08,14"})
+	b.apply(protocol.DecodedMessage{Cmd: protocol.CmdQueryPowerBank, Token: testToken, Inventory: []protocol.SlotEntry{{Slot: 2, PowerBankID: "RL1H|002"}}})
+	stale, _ := fakeStation(t, "STATS3", protocol.Version1)
+	stale.mu.Lock()
+	stale.lastSeen = time.Now().Add(-2 * cfg.StaleAfter)
+	stale.mu.Unlock()
+
+	rec := serve(handleStats, http.MethodGet, "/stats", "")
+	var got StatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	want := StatsResponse{
+		Connected:        3,
+		Stale:            1,
+		PowerBanks:       3,
+		InventoryUnknown: 1,
+		FirmwareVersions: map[string]int{"RL1,H6,08,14": 2, "unknown": 1},
+		ProtocolVersions: map[string]int{"v1": 2, "v2": 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server/internal/protocol"
+	"strconv"
+	"time"
+)
+
+// Сколько длится трассировка, если в запросе нет ?ttl
+const defaultTraceTTL = 10 * time.Minute
+
+// setTrace включает подробный лог кадров соединения до until, нулевое
+// время выключает его
+func (s *Station) setTrace(until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traceUntil = until
+}
+
+func (s *Station) tracing(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.traceUntil)
+}
+
+// trace пишет кадр в лог с разобранными полями, если для соединения
+// включена трассировка. direction - "in" от станции или "out" к ней.
+func (s *Station) trace(direction string, frame []byte) {
+	if !s.tracing(time.Now()) {
+		return
+	}
+	in := protocol.Inspect(frame)
+	decoded, _ := json.Marshal(in)
+	slog.Info("station trace", "station_id", s.ID, "conn_id", s.ConnID, "session_id", s.SessionID, "direction", direction,
+		"cmd", in.Command, "len", len(frame), "hex", fmt.Sprintf("%x", frame), "decoded", string(decoded))
+}
+
+// handleStationTrace - POST /stations/{id}/trace?enable=true[&ttl=5m]:
+// подробный лог кадров одной станции. Выключается сам по истечении ttl.
+func handleStationTrace(w http.ResponseWriter, r *http.Request, stationID string) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST to change station tracing")
+		return
+	}
+
+	q := r.URL.Query()
+	enable, err := strconv.ParseBool(q.Get("enable"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid enable: %q (use true or false)", q.Get("enable")))
+		return
+	}
+	ttl := defaultTraceTTL
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ttl: %s", v))
+			return
+		}
+		ttl = d
+	}
+
+	station, exists := lookupStation(stationID, q.Get("connID"))
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No station connected with ID: %s", stationID))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"stationID": station.ID,
+		"connID":    station.ConnID,
+		"trace":     enable,
+	}
+	if enable {
+		until := time.Now().Add(ttl)
+		station.setTrace(until)
+		resp["until"] = until
+		slog.Info("station trace enabled", "station_id", station.ID, "conn_id", station.ConnID, "ttl", ttl)
+	} else {
+		station.setTrace(time.Time{})
+		slog.Info("station trace disabled", "station_id", station.ID, "conn_id", station.ConnID)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
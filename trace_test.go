@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"server/internal/protocol"
+	"testing"
+)
+
+// Трассировка включается для одной станции: кадры соседней в лог не идут
+func TestStationTrace(t *testing.T) {
+	logs := captureLogs(t, "info")
+	fakeStation(t, "TRACE1", protocol.Version1)
+	fakeStation(t, "TRACE2", protocol.Version1)
+
+	trace := func(id, query string) {
+		t.Helper()
+		rec := serve(func(w http.ResponseWriter, r *http.Request) { handleStationTrace(w, r, id) }, http.MethodPost, "/stations/"+id+"/trace?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("trace %s: status %d: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+	query := func() {
+		t.Helper()
+		for _, id := range []string{"TRACE1", "TRACE2"} {
+			if rec := serve(handleSendCommand, http.MethodGet, "/send?stationID="+id+"&cmd=query_fw&wait=true", ""); rec.Code != http.StatusOK {
+				t.Fatalf("query_fw %s: status %d", id, rec.Code)
+			}
+		}
+	}
+	traced := func() map[string]int {
+		seen := map[string]int{}
+		for _, rec := range logs.records(t) {
+			if rec["msg"] == "station trace" {
+				seen[rec["station_id"].(string)+" "+rec["direction"].(string)]++
+				if rec["cmd"] != "query_fw" || rec["decoded"] == "" {
+					t.Errorf("trace record = %v", rec)
+				}
+			}
+		}
+		return seen
+	}
+
+	trace("TRACE1", "enable=true&ttl=1m")
+	query()
+	if seen := traced(); seen["TRACE1 out"] != 1 || seen["TRACE1 in"] != 1 || seen["TRACE2 out"]+seen["TRACE2 in"] != 0 {
+		t.Errorf("traced frames = %v, want one in and one out for TRACE1 only", seen)
+	}
+
+	trace("TRACE1", "enable=false")
+	query()
+	if seen := traced(); seen["TRACE1 out"] != 1 || seen["TRACE1 in"] != 1 {
+		t.Errorf("traced frames after disable = %v", seen)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Остановка пачечного вебхука: закрытие webhookStop просит отправить
+// накопленное, webhookDone закрывается, когда последняя пачка ушла
+var (
+	webhookStop = make(chan struct{})
+	webhookDone = make(chan struct{})
+)
+
+// runWebhookBatches копит события и отправляет их JSON массивом, когда
+// набралось cfg.WebhookBatch событий или первое ждет дольше
+// cfg.WebhookWindow. Одна горутина шлет пачки по очереди, поэтому порядок
+// событий сохраняется.
+func runWebhookBatches(client *http.Client, events <-chan Event) {
+	defer close(webhookDone)
+
+	var batch []Event
+	timer := time.NewTimer(cfg.WebhookWindow)
+	timer.Stop()
+	flush := func() {
+		timer.Stop()
+		for len(batch) > 0 {
+			n := min(len(batch), cfg.WebhookBatch)
+			deliverBatch(client, batch[:n])
+			batch = batch[n:]
+		}
+	}
+
+	for {
+		select {
+		case ev := <-events:
+			if len(batch) == 0 {
+				timer.Reset(cfg.WebhookWindow)
+			}
+			batch = append(batch, ev)
+			if len(batch) >= cfg.WebhookBatch {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-webhookStop:
+			// Забираем то, что уже лежит в буфере подписчика
+			for len(events) > 0 {
+				batch = append(batch, <-events)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// deliverBatch отправляет пачку одним POST, с cfg.WebhookGzip - сжатой
+func deliverBatch(client *http.Client, batch []Event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return
+	}
+	if cfg.WebhookGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("webhook delivery failed", "events", len(batch), "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.WebhookGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Warn("webhook delivery failed", "events", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("webhook rejected batch", "events", len(batch), "status", resp.StatusCode)
+	}
+}
+
+// flushWebhookOnSignal по SIGINT/SIGTERM отправляет накопленную пачку и
+// завершает процесс. Без -webhook-batch события не копятся, и сигнал
+// обрабатывается как обычно.
+func flushWebhookOnSignal() {
+	if cfg.WebhookURL == "" || cfg.WebhookBatch <= 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		slog.Info("shutting down, flushing webhook batch", "signal", s.String())
+		flushWebhook()
+		os.Exit(0)
+	}()
+}
+
+// flushWebhook при остановке сервера отправляет неотправленную пачку и
+// ждет ее не дольше cfg.WebhookTimeout
+func flushWebhook() {
+	if cfg.WebhookURL == "" || cfg.WebhookBatch <= 0 {
+		return
+	}
+	close(webhookStop)
+	select {
+	case <-webhookDone:
+	case <-time.After(cfg.WebhookTimeout):
+		slog.Warn("webhook batch not delivered before shutdown", "timeout", cfg.WebhookTimeout)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc отдает запросы вебхука тесту вместо сети
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// webhookBodies запускает runWebhookBatches с клиентом, который разжимает
+// тела пачек и отдает их в канал
+func webhookBodies(t *testing.T) (chan<- Event, <-chan []Event) {
+	t.Helper()
+	bodies := make(chan []Event, 4)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("gzip body: %v", err)
+				return nil, err
+			}
+			body = zr
+		}
+		var batch []Event
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			t.Errorf("batch body: %v", err)
+		}
+		bodies <- batch
+		return &http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})}
+	events := make(chan Event, 8)
+	go runWebhookBatches(client, events)
+	return events, bodies
+}
+
+func nextBatch(t *testing.T, bodies <-chan []Event) []Event {
+	t.Helper()
+	select {
+	case batch := <-bodies:
+		return batch
+	case <-time.After(testTimeout):
+		t.Fatalf("no webhook batch")
+		return nil
+	}
+}
+
+// Пачка уходит, когда набралось WebhookBatch событий, сжатой gzip
+func TestWebhookBatchGzip(t *testing.T) {
+	keepConfig(t)
+	cfg.WebhookURL = "http://webhook.test/events"
+	cfg.WebhookBatch, cfg.WebhookWindow, cfg.WebhookGzip = 2, time.Minute, true
+	events, bodies := webhookBodies(t)
+
+	for i := 1; i <= 4; i++ {
+		events <- Event{Type: EventSlotOccupied, StationID: fmt.Sprintf("HOOK%d", i)}
+	}
+	for _, want := range []string{"HOOK1 HOOK2", "HOOK3 HOOK4"} {
+		batch := nextBatch(t, bodies)
+		var ids []string
+		for _, ev := range batch {
+			ids = append(ids, ev.StationID)
+		}
+		if got := strings.Join(ids, " "); got != want {
+			t.Errorf("batch = %s, want %s", got, want)
+		}
+	}
+}
+
+// Неполная пачка уходит по истечении WebhookWindow
+func TestWebhookBatchWindow(t *testing.T) {
+	keepConfig(t)
+	cfg.WebhookURL = "http://webhook.test/events"
+	cfg.WebhookBatch, cfg.WebhookWindow, cfg.WebhookGzip = 10, 20*time.Millisecond, false
+	events, bodies := webhookBodies(t)
+
+	events <- Event{Type: EventSlotEmpty, StationID: "HOOKWIN1"}
+	if batch := nextBatch(t, bodies); len(batch) != 1 || batch[0].StationID != "HOOKWIN1" {
+		t.Errorf("batch = %+v, want one HOOKWIN1 event", batch)
+	}
+}